@@ -24,12 +24,7 @@ func (s *SyncEventBus) Sub(topic string, handler SubHandler) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	handlers, ok := s.subs[topic]
-	if !ok {
-		s.subs[topic] = []SubHandler{handler}
-	} else {
-		handlers = append(handlers, handler)
-	}
+	s.subs[topic] = append(s.subs[topic], handler)
 }
 
 func (s *SyncEventBus) Pub(topic string, data interface{}) {
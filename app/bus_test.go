@@ -22,3 +22,19 @@ func ExampleSyncEventBus() {
 	// end sub
 	// end pub
 }
+
+func ExampleSyncEventBus_Sub() {
+	b := NewSyncEventBus()
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		b.Sub("test", func(e Event) {
+			fmt.Println(name, "receive", e.Data)
+		})
+	}
+
+	b.Pub("test", "hello")
+	// Output:
+	// first receive hello
+	// second receive hello
+	// third receive hello
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// RetryCountHeader is the message header recording how many times the message has been retried
+	RetryCountHeader = "x-retry-count"
+	// OriginalTopicHeader keep the topic a message was published to when it is rerouted, e.g. through a retry queue
+	OriginalTopicHeader = "x-original-topic"
+)
+
+// Backoff return the delay before the attempt-th retry, attempt start from 1
+type Backoff func(attempt int) time.Duration
+
+// FixedBackoff retry after the same delay every time
+func FixedBackoff(delay time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		return delay
+	}
+}
+
+// ExponentialBackoff double the delay on every attempt from base, never exceed max
+func ExponentialBackoff(base, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		delay := base
+		for i := 1; i < attempt; i++ {
+			delay *= 2
+			if delay >= max {
+				return max
+			}
+		}
+		if delay > max {
+			return max
+		}
+		return delay
+	}
+}
+
+// Jitter randomize the delay of backoff within ±factor of it, e.g. 0.2 for ±20%, to spread retries of many clients
+func Jitter(backoff Backoff, factor float64) Backoff {
+	return func(attempt int) time.Duration {
+		delay := float64(backoff(attempt))
+		return time.Duration(delay + delay*factor*(2*rand.Float64()-1))
+	}
+}
+
+// RetryCount return the retry count recorded in headers, 0 if absent
+func RetryCount(headers map[string]interface{}) int {
+	switch v := headers[RetryCountHeader].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	default:
+		return 0
+	}
+}
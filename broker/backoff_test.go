@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFixedBackoff(t *testing.T) {
+	b := FixedBackoff(time.Second)
+	assert.Equal(t, time.Second, b(1))
+	assert.Equal(t, time.Second, b(10))
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(time.Second, 10*time.Second)
+	assert.Equal(t, time.Second, b(1))
+	assert.Equal(t, 2*time.Second, b(2))
+	assert.Equal(t, 8*time.Second, b(4))
+	assert.Equal(t, 10*time.Second, b(5))
+	assert.Equal(t, 10*time.Second, b(100))
+}
+
+func TestRetryCount(t *testing.T) {
+	assert.Equal(t, 0, RetryCount(nil))
+	assert.Equal(t, 0, RetryCount(map[string]interface{}{RetryCountHeader: "1"}))
+	assert.Equal(t, 2, RetryCount(map[string]interface{}{RetryCountHeader: int32(2)}))
+	assert.Equal(t, 3, RetryCount(map[string]interface{}{RetryCountHeader: int64(3)}))
+}
+
+func TestJitter(t *testing.T) {
+	b := Jitter(FixedBackoff(100*time.Millisecond), 0.2)
+	for i := 0; i < 100; i++ {
+		if d := b(1); d < 80*time.Millisecond || d > 120*time.Millisecond {
+			t.Fatalf("expect delay within 80ms~120ms but %s", d)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrPublishMessageNotAck = errors.New("message not ack by broker")
+	ErrPublishMessageMiss   = errors.New("message cannot route to any queue")
+)
+
+// PublishStatus is the outcome of a confirmed publishing
+type PublishStatus int
+
+const (
+	// PublishAcked message accepted by broker
+	PublishAcked PublishStatus = iota
+	// PublishNacked message rejected by broker, see ErrPublishMessageNotAck
+	PublishNacked
+	// PublishReturned message cannot route to any queue, see ErrPublishMessageMiss
+	PublishReturned
+	// PublishFailed message not sent, e.g. marshal error, connection error or context done
+	PublishFailed
+)
+
+func (s PublishStatus) String() string {
+	switch s {
+	case PublishAcked:
+		return "acked"
+	case PublishNacked:
+		return "nacked"
+	case PublishReturned:
+		return "returned"
+	default:
+		return "failed"
+	}
+}
+
+// PublishStatusOf map the error of a publishing to its status
+func PublishStatusOf(err error) PublishStatus {
+	switch err {
+	case nil:
+		return PublishAcked
+	case ErrPublishMessageNotAck:
+		return PublishNacked
+	case ErrPublishMessageMiss:
+		return PublishReturned
+	default:
+		return PublishFailed
+	}
+}
+
+// PublishResult is the result of an asynchronous publishing
+type PublishResult struct {
+	Message   *Message
+	MessageID string
+	Status    PublishStatus
+	Err       error
+}
+
+// NewPublishResult create result of msg, status is decided by err
+func NewPublishResult(msg *Message, messageID string, err error) PublishResult {
+	return PublishResult{
+		Message:   msg,
+		MessageID: messageID,
+		Status:    PublishStatusOf(err),
+		Err:       err,
+	}
+}
+
+// PublishFuture is a pending asynchronous publishing
+type PublishFuture interface {
+	// Done is closed once the publishing confirmed or failed
+	Done() <-chan struct{}
+	// Result block until Done closed and return the result
+	Result() PublishResult
+}
+
+// BatchPublisher publish messages without waiting confirms one by one.
+// All publishings are confirmed and mandatory, the same as a Reliable publisher.
+type BatchPublisher interface {
+	// PublishAsync publish msg and return without waiting its confirm
+	PublishAsync(ctx context.Context, msg *Message, opts ...PublishOption) PublishFuture
+	// PublishBatch publish msgs asynchronously, results are sent in the order of msgs and the channel is closed after the last one.
+	// Messages not published yet when ctx done fail with ctx.Err()
+	PublishBatch(ctx context.Context, msgs []*Message, opts ...PublishOption) <-chan PublishResult
+}
+
+// PublishBatch implement BatchPublisher.PublishBatch with publishAsync
+func PublishBatch(ctx context.Context, msgs []*Message, publishAsync func(ctx context.Context, msg *Message) PublishFuture) <-chan PublishResult {
+	futures := make([]PublishFuture, len(msgs))
+	for i, msg := range msgs {
+		futures[i] = publishAsync(ctx, msg)
+	}
+
+	out := make(chan PublishResult, len(msgs))
+	go func() {
+		defer close(out)
+		for _, f := range futures {
+			out <- f.Result()
+		}
+	}()
+	return out
+}
+
+// CompletedFuture is a PublishFuture already done
+type CompletedFuture PublishResult
+
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+func (f CompletedFuture) Done() <-chan struct{} {
+	return closedChan
+}
+
+func (f CompletedFuture) Result() PublishResult {
+	return PublishResult(f)
+}
@@ -0,0 +1,72 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"testing"
+)
+
+func TestPublishStatusOf(t *testing.T) {
+	for err, expect := range map[error]PublishStatus{
+		nil:                     PublishAcked,
+		ErrPublishMessageNotAck: PublishNacked,
+		ErrPublishMessageMiss:   PublishReturned,
+		errors.New("test"):      PublishFailed,
+	} {
+		if got := PublishStatusOf(err); got != expect {
+			t.Errorf("%v: expect %s but %s", err, expect, got)
+		}
+	}
+}
+
+type pendingFuture struct {
+	done   chan struct{}
+	result PublishResult
+}
+
+func (f *pendingFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *pendingFuture) Result() PublishResult {
+	<-f.done
+	return f.result
+}
+
+func TestPublishBatch(t *testing.T) {
+	msgs := []*Message{
+		NewMessage("a", &wrappers.StringValue{Value: "1"}),
+		NewMessage("b", &wrappers.StringValue{Value: "2"}),
+		NewMessage("c", &wrappers.StringValue{Value: "3"}),
+	}
+	errs := []error{nil, ErrPublishMessageMiss, ErrPublishMessageNotAck}
+
+	var futures []*pendingFuture
+	results := PublishBatch(context.Background(), msgs, func(ctx context.Context, msg *Message) PublishFuture {
+		f := &pendingFuture{
+			done:   make(chan struct{}),
+			result: NewPublishResult(msg, msg.Topic, errs[len(futures)]),
+		}
+		futures = append(futures, f)
+		return f
+	})
+	if len(futures) != len(msgs) {
+		t.Fatalf("expect all messages published before return but %d", len(futures))
+	}
+
+	// confirms in reverse order, results still in publish order
+	for i := len(futures) - 1; i >= 0; i-- {
+		close(futures[i].done)
+	}
+	i := 0
+	for r := range results {
+		if r.Message != msgs[i] || r.Err != errs[i] || r.Status != PublishStatusOf(errs[i]) {
+			t.Errorf("unexpected result %d: %+v", i, r)
+		}
+		i++
+	}
+	if i != len(msgs) {
+		t.Errorf("expect %d results but %d", len(msgs), i)
+	}
+}
@@ -1,22 +1,59 @@
 // Package broker is an interface used for asynchronous messaging
 package broker
 
-import "github.com/golang/protobuf/proto"
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+var (
+	ErrClosed = errors.New("broker closed")
+)
 
 // Broker is an interface used for asynchronous messaging.
 type Broker interface {
 	TopicPublisher(topic string, opts ...Option) (Publisher, error)
 	MultiTopicPublisher(opts ...Option) (MultiTopicPublisher, error)
-	RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...Option) error
-	RegisterErrSubscribeHandler(name, topic string, handler interface{}) error
+	// BatchPublisher create a publisher for bulk publishing, it is always reliable
+	BatchPublisher(opts ...Option) (BatchPublisher, error)
+	// Requester create a requester with its own reply queue
+	Requester(opts ...Option) (Requester, error)
+	RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...Option) (Subscription, error)
+	// RegisterRouter bind queue name to every pattern of routes, each message is handled by the handler of the matched pattern.
+	// Failed messages are dead-lettered with topic error.<name>, see Fallback and NewRouter.
+	RegisterRouter(name string, routes map[string]interface{}, opts ...Option) (Subscription, error)
+	// RegisterResponder subscribe requests of topic, the result of handler is replied to the requester, see NewResponder
+	RegisterResponder(name, topic string, handler interface{}, opts ...Option) (Subscription, error)
+	// RegisterErrSubscribeHandler consume the dead-lettered messages of topic, e.g. error.<topic>, see DeadLetterOf.
+	// Messages are acked after handled, a failed one is retried until handled.
+	RegisterErrSubscribeHandler(name, topic string, handler interface{}, opts ...Option) (Subscription, error)
+	// Close stop all subscriptions, wait in-flight messages handled until ctx done, then release connections
+	Close(ctx context.Context) error
+}
+
+// HealthChecker is implemented by brokers able to report their connectivity
+type HealthChecker interface {
+	// Healthy report whether all connections of the broker are open
+	Healthy() bool
+}
+
+// Subscription is a registered subscribe handler
+type Subscription interface {
+	// Unsubscribe stop consuming and wait in-flight messages handled,
+	// handler contexts are cancelled and unacked messages are requeued if ctx done before that
+	Unsubscribe(ctx context.Context) error
 }
 
 type Publisher interface {
 	Publish(m interface{}) error
+	PublishContext(ctx context.Context, m proto.Message, opts ...PublishOption) error
 }
 
 type MultiTopicPublisher interface {
 	PublishMessage(msg *Message) error
+	PublishMessageContext(ctx context.Context, msg *Message, opts ...PublishOption) error
 }
 
 type Message struct {
@@ -32,8 +69,18 @@ func NewMessage(topic string, value proto.Message) *Message {
 }
 
 type Options struct {
-	Reliable bool
-	MaxRetry int
+	Reliable           bool
+	MaxRetry           int
+	Backoff            Backoff
+	Timeout            time.Duration
+	Concurrency        int
+	Prefetch           int
+	Dedup              DedupStore
+	Codec              Codec
+	Fallback           interface{}
+	Middlewares        []SubscriberMiddleware
+	PublishMiddlewares []PublisherMiddleware
+	Schemas            *SchemaRegistry
 }
 
 type Option func(opts *Options)
@@ -49,3 +96,32 @@ func MaxRetry(retry int) Option {
 		opts.MaxRetry = retry
 	}
 }
+
+// RetryBackoff set the delay between retries of a reliable subscription
+func RetryBackoff(backoff Backoff) Option {
+	return func(opts *Options) {
+		opts.Backoff = backoff
+	}
+}
+
+// Timeout set the deadline of the context passed to handler for each message
+func Timeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.Timeout = timeout
+	}
+}
+
+// Concurrency set the number of workers handling messages of a subscription concurrently, default 1
+func Concurrency(n int) Option {
+	return func(opts *Options) {
+		opts.Concurrency = n
+	}
+}
+
+// Prefetch limit the number of unacknowledged messages delivered to a reliable subscription,
+// default the concurrency of the subscription, a negative n means unlimited
+func Prefetch(n int) Option {
+	return func(opts *Options) {
+		opts.Prefetch = n
+	}
+}
@@ -0,0 +1,144 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/encoding/protojson"
+	"mime"
+)
+
+const (
+	ContentTypeProtobuf  = "application/protobuf"
+	ContentTypeProtoJSON = "application/protojson"
+	ContentTypeJSON      = "application/json"
+)
+
+var (
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+)
+
+// Codec encode messages into body of the content type
+type Codec interface {
+	ContentType() string
+	Marshal(m proto.Message) ([]byte, error)
+	Unmarshal(data []byte, m proto.Message) error
+}
+
+var (
+	// ProtoCodec is the default codec, the binary protobuf encoding
+	ProtoCodec Codec = protoCodec{}
+	// ProtoJSONCodec is the canonical JSON mapping of protobuf
+	ProtoJSONCodec Codec = protoJSONCodec{}
+	// JSONCodec encode messages by encoding/json, for services unaware of protobuf
+	JSONCodec Codec = jsonCodec{}
+
+	codecs = map[string]Codec{
+		ContentTypeProtobuf:  ProtoCodec,
+		ContentTypeProtoJSON: ProtoJSONCodec,
+		ContentTypeJSON:      JSONCodec,
+	}
+)
+
+// UseCodec set the codec of a publisher or subscription, default ProtoCodec.
+// A subscription decode a delivery by the codec of its content type,
+// c is preferred for the content type of c and used for deliveries without content type.
+func UseCodec(c Codec) Option {
+	return func(opts *Options) {
+		opts.Codec = c
+	}
+}
+
+// DecodeError is returned when a delivery cannot be decoded, the delivery is dead-lettered
+type DecodeError struct {
+	ContentType string
+	Err         error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("decode message of content type %q error: %v", e.ContentType, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// CodecFor return the codec of contentType, preferred is used if it is of the content type or contentType is empty
+func CodecFor(preferred Codec, contentType string) (Codec, error) {
+	if contentType == "" {
+		if preferred != nil {
+			return preferred, nil
+		}
+		return ProtoCodec, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, ErrUnsupportedContentType
+	}
+	if preferred != nil && preferred.ContentType() == mediaType {
+		return preferred, nil
+	}
+	if c, ok := codecs[mediaType]; ok {
+		return c, nil
+	}
+	return nil, ErrUnsupportedContentType
+}
+
+// Decode unmarshal data of contentType into m, the error is a *DecodeError
+func Decode(preferred Codec, contentType string, data []byte, m proto.Message) error {
+	c, err := CodecFor(preferred, contentType)
+	if err == nil {
+		err = c.Unmarshal(data, m)
+	}
+	if err != nil {
+		return &DecodeError{
+			ContentType: contentType,
+			Err:         err,
+		}
+	}
+	return nil
+}
+
+type protoCodec struct{}
+
+func (protoCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (protoCodec) Marshal(m proto.Message) ([]byte, error) {
+	return proto.Marshal(m)
+}
+
+func (protoCodec) Unmarshal(data []byte, m proto.Message) error {
+	return proto.Unmarshal(data, m)
+}
+
+type protoJSONCodec struct{}
+
+func (protoJSONCodec) ContentType() string {
+	return ContentTypeProtoJSON
+}
+
+func (protoJSONCodec) Marshal(m proto.Message) ([]byte, error) {
+	return protojson.Marshal(proto.MessageV2(m))
+}
+
+func (protoJSONCodec) Unmarshal(data []byte, m proto.Message) error {
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(data, proto.MessageV2(m))
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (jsonCodec) Marshal(m proto.Message) ([]byte, error) {
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Unmarshal(data []byte, m proto.Message) error {
+	return json.Unmarshal(data, m)
+}
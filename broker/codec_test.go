@@ -0,0 +1,64 @@
+package broker
+
+import (
+	"errors"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	for _, c := range []Codec{ProtoCodec, ProtoJSONCodec, JSONCodec} {
+		data, err := c.Marshal(&wrappers.StringValue{Value: "codec"})
+		if err != nil {
+			t.Fatalf("%s: %v", c.ContentType(), err)
+		}
+		out := &wrappers.StringValue{}
+		if err := Decode(nil, c.ContentType(), data, out); err != nil {
+			t.Fatalf("%s: %v", c.ContentType(), err)
+		}
+		if out.Value != "codec" {
+			t.Errorf("%s: expect codec but %s", c.ContentType(), out.Value)
+		}
+	}
+}
+
+func TestCodecFor(t *testing.T) {
+	for _, c := range []struct {
+		preferred   Codec
+		contentType string
+		expect      Codec
+	}{
+		{nil, "", ProtoCodec},
+		{JSONCodec, "", JSONCodec},
+		{nil, "application/json; charset=utf-8", JSONCodec},
+		{ProtoCodec, ContentTypeProtoJSON, ProtoJSONCodec},
+	} {
+		got, err := CodecFor(c.preferred, c.contentType)
+		if err != nil {
+			t.Fatalf("%q: %v", c.contentType, err)
+		}
+		if got != c.expect {
+			t.Errorf("%q: expect %s but %s", c.contentType, c.expect.ContentType(), got.ContentType())
+		}
+	}
+
+	if _, err := CodecFor(nil, "text/plain"); err != ErrUnsupportedContentType {
+		t.Errorf("expect %v but %v", ErrUnsupportedContentType, err)
+	}
+}
+
+func TestDecodeError(t *testing.T) {
+	err := Decode(nil, "text/plain", []byte("text"), &wrappers.StringValue{})
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrUnsupportedContentType) {
+		t.Fatalf("expect DecodeError but %v", err)
+	}
+	if decodeErr.ContentType != "text/plain" {
+		t.Errorf("expect text/plain but %s", decodeErr.ContentType)
+	}
+
+	err = Decode(nil, ContentTypeJSON, []byte("{"), &wrappers.StringValue{})
+	if !errors.As(err, &decodeErr) {
+		t.Fatalf("expect DecodeError but %v", err)
+	}
+}
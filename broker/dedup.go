@@ -0,0 +1,73 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+)
+
+// ErrInProgress is returned by DedupStore.Claim if the key is claimed but not completed yet, the claimant may be
+// still processing the message or may have crashed before completing it. Brokers redeliver a message failed with it
+// after the backoff of the subscription without counting it against MaxRetry, see CallOnce.
+var ErrInProgress = errors.New("message is being processed")
+
+// DedupStore remember message ids processed by subscriptions, see Dedup
+type DedupStore interface {
+	// Claim mark key in processing, return false if key is processed, or ErrInProgress if key is being processed
+	Claim(ctx context.Context, key string) (bool, error)
+	// Complete mark the claimed key processed
+	Complete(ctx context.Context, key string) error
+	// Release forget the claimed key so the message can be processed again
+	Release(ctx context.Context, key string) error
+}
+
+// Dedup skip messages whose id already processed by the subscription, duplicates are acknowledged without calling handler.
+// Publishers must set stable message ids, messages without id are always handled.
+func Dedup(store DedupStore) Option {
+	return func(opts *Options) {
+		opts.Dedup = store
+	}
+}
+
+// DedupKey is the key of a message id processed by subscription name in DedupStore
+func DedupKey(name, messageID string) string {
+	return name + ":" + messageID
+}
+
+// CallOnce call h unless the message is processed by subscription name according to store.
+// A message being processed is not acknowledged, ErrInProgress is returned and a reliable subscription redeliver it
+// until the claim is completed, released, or expired if the claimant crashed, however long it takes.
+// A subscription which is not reliable drop it as any failed message.
+// The message is handled if store fails, a duplicate is better than a lost message.
+func CallOnce(ctx context.Context, store DedupStore, name string, meta Metadata, h func(ctx context.Context) error) error {
+	if store == nil || meta.MessageID == "" {
+		return h(ctx)
+	}
+
+	key := DedupKey(name, meta.MessageID)
+	claimed, err := store.Claim(ctx, key)
+	if errors.Is(err, ErrInProgress) {
+		log.Info("message is being processed", zap.String("key", key))
+		return err
+	}
+	if err != nil {
+		log.Error("dedup claim error", zap.Error(err), zap.String("key", key))
+		return h(ctx)
+	}
+	if !claimed {
+		log.Info("skip duplicate message", zap.String("key", key))
+		return nil
+	}
+
+	if err := h(ctx); err != nil {
+		if err := store.Release(ctx, key); err != nil {
+			log.Error("dedup release error", zap.Error(err), zap.String("key", key))
+		}
+		return err
+	}
+
+	if err := store.Complete(ctx, key); err != nil {
+		log.Error("dedup complete error", zap.Error(err), zap.String("key", key))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"sync"
+)
+
+type lruStore struct {
+	size int
+
+	m       sync.Mutex
+	order   *list.List // front is the most recent
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key       string
+	processed bool
+}
+
+// NewLRUStore create a broker.DedupStore in process memory, it remembers the most recent size message ids.
+// It only deduplicates messages redelivered to the same process.
+func NewLRUStore(size int) broker.DedupStore {
+	if size < 1 {
+		size = 1
+	}
+	return &lruStore{
+		size:    size,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+	}
+}
+
+func (s *lruStore) Claim(_ context.Context, key string) (bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.order.MoveToFront(e)
+		if !e.Value.(*lruEntry).processed {
+			return false, broker.ErrInProgress
+		}
+		return false, nil
+	}
+
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key})
+	for s.order.Len() > s.size {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*lruEntry).key)
+	}
+	return true, nil
+}
+
+// Complete mark the claimed key processed, it is kept until evicted
+func (s *lruStore) Complete(_ context.Context, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		e.Value.(*lruEntry).processed = true
+	}
+	return nil
+}
+
+func (s *lruStore) Release(_ context.Context, key string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if e, ok := s.entries[key]; ok {
+		s.order.Remove(e)
+		delete(s.entries, key)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package dedup
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func claim(t *testing.T, s broker.DedupStore, key string) bool {
+	ok, err := s.Claim(context.Background(), key)
+	assert.NoError(t, err)
+	return ok
+}
+
+func inProgress(t *testing.T, s broker.DedupStore, key string) bool {
+	ok, err := s.Claim(context.Background(), key)
+	assert.False(t, ok)
+	return err == broker.ErrInProgress
+}
+
+func TestLRUStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewLRUStore(2)
+
+	assert.True(t, claim(t, s, "a"))
+	assert.True(t, inProgress(t, s, "a"))
+	assert.NoError(t, s.Complete(ctx, "a"))
+	assert.False(t, claim(t, s, "a"))
+
+	// released key can be claimed again
+	assert.True(t, claim(t, s, "b"))
+	assert.NoError(t, s.Release(ctx, "b"))
+	assert.True(t, claim(t, s, "b"))
+
+	// a is the most recent after the duplicate claim above, b is touched later, c evicts a
+	assert.True(t, claim(t, s, "c"))
+	assert.True(t, claim(t, s, "a"))
+	assert.True(t, inProgress(t, s, "c"))
+}
+
+func TestCallOnceCrash(t *testing.T) {
+	ctx := context.Background()
+	s := NewLRUStore(10)
+	meta := broker.Metadata{MessageID: "1"}
+	key := broker.DedupKey("sub", "1")
+
+	// the consumer crashed between claim and complete
+	assert.True(t, claim(t, s, key))
+
+	calls := 0
+	h := func(ctx context.Context) error {
+		calls++
+		return nil
+	}
+	// the redelivery is not acknowledged as a duplicate, it is retried
+	assert.Equal(t, broker.ErrInProgress, broker.CallOnce(ctx, s, "sub", meta, h))
+	assert.Equal(t, 0, calls)
+
+	// the claim expired
+	assert.NoError(t, s.Release(ctx, key))
+	assert.NoError(t, broker.CallOnce(ctx, s, "sub", meta, h))
+	assert.Equal(t, 1, calls)
+
+	// only a processed message is skipped
+	assert.NoError(t, broker.CallOnce(ctx, s, "sub", meta, h))
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,104 @@
+// Package dedup provides broker.DedupStore implementations
+package dedup
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/go-redis/redis"
+	"time"
+)
+
+const (
+	processing = "processing"
+	processed  = "processed"
+)
+
+// claimScript set the key processing unless it exists, and return the state of the existing key otherwise
+var claimScript = redis.NewScript(`
+if redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2], "NX") then
+	return ""
+end
+return redis.call("GET", KEYS[1])
+`)
+
+type RedisStoreOptions struct {
+	Prefix string
+	// TTL is how long a processed message id is remembered
+	TTL time.Duration
+	// ProcessingTTL is how long a claim is kept, the message can be processed again after the claimant crashed
+	ProcessingTTL time.Duration
+}
+
+type RedisStoreOption func(opts *RedisStoreOptions)
+
+func WithPrefix(prefix string) RedisStoreOption {
+	return func(opts *RedisStoreOptions) {
+		opts.Prefix = prefix
+	}
+}
+
+func WithTTL(ttl time.Duration) RedisStoreOption {
+	return func(opts *RedisStoreOptions) {
+		opts.TTL = ttl
+	}
+}
+
+func WithProcessingTTL(ttl time.Duration) RedisStoreOption {
+	return func(opts *RedisStoreOptions) {
+		opts.ProcessingTTL = ttl
+	}
+}
+
+type redisStore struct {
+	prefix        string
+	ttl           time.Duration
+	processingTTL time.Duration
+	cli           redis.Cmdable
+}
+
+// NewRedisStore create a broker.DedupStore shared by all instances of the subscriptions
+func NewRedisStore(cmdable redis.Cmdable, opts ...RedisStoreOption) broker.DedupStore {
+	options := &RedisStoreOptions{
+		Prefix:        "broker:dedup:",
+		TTL:           24 * time.Hour,
+		ProcessingTTL: 5 * time.Minute,
+	}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	return &redisStore{
+		prefix:        options.Prefix,
+		ttl:           options.TTL,
+		processingTTL: options.ProcessingTTL,
+		cli:           cmdable,
+	}
+}
+
+func (s *redisStore) Claim(_ context.Context, key string) (bool, error) {
+	state, err := claimScript.Run(s.cli, []string{s.wrapKey(key)}, processing, s.processingTTL.Milliseconds()).String()
+	if err != nil {
+		return false, err
+	}
+	switch state {
+	case "":
+		return true, nil
+	case processed:
+		return false, nil
+	default:
+		return false, broker.ErrInProgress
+	}
+}
+
+func (s *redisStore) Complete(_ context.Context, key string) error {
+	return s.cli.Set(s.wrapKey(key), processed, s.ttl).Err()
+}
+
+func (s *redisStore) Release(_ context.Context, key string) error {
+	return s.cli.Del(s.wrapKey(key)).Err()
+}
+
+func (s *redisStore) wrapKey(key string) string {
+	return s.prefix + key
+}
@@ -0,0 +1,36 @@
+//+build integration
+
+package dedup
+
+import (
+	"context"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRedisStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewRedisStore(redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+		DB:   1,
+	}), WithTTL(time.Second), WithProcessingTTL(time.Second))
+
+	key := time.Now().String()
+	assert.True(t, claim(t, s, key))
+	assert.True(t, inProgress(t, s, key))
+	assert.NoError(t, s.Release(ctx, key))
+	assert.True(t, claim(t, s, key))
+	assert.NoError(t, s.Complete(ctx, key))
+	assert.False(t, claim(t, s, key))
+
+	// the claimant crashed before complete
+	crashed := key + ":crashed"
+	assert.True(t, claim(t, s, crashed))
+	assert.True(t, inProgress(t, s, crashed))
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.True(t, claim(t, s, key))
+	assert.True(t, claim(t, s, crashed))
+}
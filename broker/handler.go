@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+)
+
+var (
+	protoMessageType         = reflect.TypeOf((*proto.Message)(nil)).Elem()
+	errorType                = reflect.TypeOf((*error)(nil)).Elem()
+	contextType              = reflect.TypeOf((*context.Context)(nil)).Elem()
+	metadataType             = reflect.TypeOf(Metadata{})
+	errTypeIsNotPtr          = errors.New("type must be pointer")
+	errTypeIsNotProtoMessage = errors.New("type must be proto.Message")
+	errTypeIsNotError        = errors.New("type must be error")
+	ErrInvalidHandler        = errors.New("invalid handler, must be func(*T) error, func(context.Context, *T) error or func(context.Context, *T, broker.Metadata) error which *T implement proto.Message")
+)
+
+// Handler is a reflected subscribe handler, shared by broker implementations
+type Handler struct {
+	methodValue reflect.Value
+	msgType     reflect.Type
+	withContext bool
+	withMeta    bool
+}
+
+// NewHandler check h is one of below, which *T implement proto.Message
+//
+//	func(msg *T) error
+//	func(ctx context.Context, msg *T) error
+//	func(ctx context.Context, msg *T, meta broker.Metadata) error
+func NewHandler(h interface{}) (*Handler, error) {
+	ht := reflect.TypeOf(h)
+	if ht == nil || ht.Kind() != reflect.Func {
+		return nil, ErrInvalidHandler
+	}
+
+	if ht.NumIn() < 1 || ht.NumIn() > 3 {
+		return nil, ErrInvalidHandler
+	}
+
+	if ht.NumOut() != 1 {
+		return nil, ErrInvalidHandler
+	}
+
+	out := &Handler{
+		methodValue: reflect.ValueOf(h),
+		withContext: ht.NumIn() > 1,
+		withMeta:    ht.NumIn() > 2,
+	}
+
+	msgIndex := 0
+	if out.withContext {
+		if ht.In(0) != contextType {
+			return nil, ErrInvalidHandler
+		}
+		msgIndex = 1
+	}
+	if out.withMeta && ht.In(2) != metadataType {
+		return nil, ErrInvalidHandler
+	}
+
+	mt := ht.In(msgIndex)
+	if err := checkIsProtoMessage(mt); err != nil {
+		return nil, ErrInvalidHandler
+	}
+
+	et := ht.Out(0)
+	if err := checkIsError(et); err != nil {
+		return nil, ErrInvalidHandler
+	}
+
+	out.msgType = mt
+
+	return out, nil
+}
+
+// NewMessage return an empty message of the handler's message type
+func (h *Handler) NewMessage() proto.Message {
+	return reflect.New(h.msgType.Elem()).Interface().(proto.Message)
+}
+
+// Call invoke the handler with msg, ctx and meta are passed only if the handler accept them
+func (h *Handler) Call(ctx context.Context, msg proto.Message, meta Metadata) error {
+	in := make([]reflect.Value, 0, 3)
+	if h.withContext {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+	in = append(in, reflect.ValueOf(msg))
+	if h.withMeta {
+		in = append(in, reflect.ValueOf(meta))
+	}
+	out := h.methodValue.Call(in)
+	if out[0].IsNil() {
+		return nil
+	}
+	return out[0].Interface().(error)
+}
+
+func checkIsProtoMessage(t reflect.Type) error {
+	if t.Kind() != reflect.Ptr {
+		return errTypeIsNotPtr
+	}
+
+	if !t.Implements(protoMessageType) {
+		return errTypeIsNotProtoMessage
+	}
+	return nil
+}
+
+func checkIsError(t reflect.Type) error {
+	if !t.Implements(errorType) {
+		return errTypeIsNotError
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var (
+	errTest = errors.New("test error")
+)
+
+type testProtoMessage struct{}
+
+func (t *testProtoMessage) Reset() {
+	panic("implement me")
+}
+
+func (t *testProtoMessage) String() string {
+	return "testProtoMessage"
+}
+
+func (t *testProtoMessage) ProtoMessage() {
+	panic("implement me")
+}
+
+type testKey struct{}
+
+type testErr struct {
+	error
+}
+
+func TestCheckIsProtoMessage(t *testing.T) {
+	a := testProtoMessage{}
+	err := checkIsProtoMessage(reflect.TypeOf(a))
+	if err == nil {
+		t.Error("expect err")
+	}
+	if err != errTypeIsNotPtr {
+		t.Errorf("expect %v but %v", errTypeIsNotPtr, err)
+	}
+
+	err = checkIsProtoMessage(reflect.TypeOf(&struct{}{}))
+	if err == nil {
+		t.Error("expect err")
+	}
+	if err != errTypeIsNotProtoMessage {
+		t.Errorf("expect %v but %v", errTypeIsNotProtoMessage, err)
+	}
+
+	if err := checkIsProtoMessage(reflect.TypeOf(&testProtoMessage{})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckIsError(t *testing.T) {
+	a := struct{}{}
+	err := checkIsError(reflect.TypeOf(a))
+	if err == nil {
+		t.Error("expect err")
+	}
+	if err != errTypeIsNotError {
+		t.Errorf("expect %v but %v", errTypeIsNotError, err)
+	}
+
+	if err := checkIsError(reflect.TypeOf(testErr{})); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNewHandler(t *testing.T) {
+	h, err := NewHandler(func(message *testProtoMessage) error {
+		return errTest
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	m := h.NewMessage()
+	if m.String() != "testProtoMessage" {
+		t.Errorf("expect %q, but %q", "testProtoMessage", m.String())
+	}
+
+	if err := h.Call(context.Background(), m, Metadata{}); err != errTest {
+		t.Errorf("expect %v but %v", errTest, err)
+	}
+
+	if _, err := NewHandler(func(message testProtoMessage) error { return nil }); err != ErrInvalidHandler {
+		t.Errorf("expect %v but %v", ErrInvalidHandler, err)
+	}
+	if _, err := NewHandler(nil); err != ErrInvalidHandler {
+		t.Errorf("expect %v but %v", ErrInvalidHandler, err)
+	}
+}
+
+func TestNewHandlerWithContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), testKey{}, "value")
+	meta := Metadata{Topic: "test", MessageID: "1"}
+
+	h, err := NewHandler(func(c context.Context, message *testProtoMessage) error {
+		if c.Value(testKey{}) != "value" {
+			t.Error("expect context passed")
+		}
+		return errTest
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := h.Call(ctx, h.NewMessage(), meta); err != errTest {
+		t.Errorf("expect %v but %v", errTest, err)
+	}
+
+	h, err = NewHandler(func(c context.Context, message *testProtoMessage, m Metadata) error {
+		if m.MessageID != "1" {
+			t.Errorf("expect metadata passed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if err := h.Call(ctx, h.NewMessage(), meta); err != nil {
+		t.Error(err)
+	}
+
+	invalids := []interface{}{
+		func(message *testProtoMessage, c context.Context) error { return nil },
+		func(c context.Context, message *testProtoMessage, m *Metadata) error { return nil },
+		func(c context.Context, message *testProtoMessage, m Metadata, extra int) error { return nil },
+	}
+	for _, invalid := range invalids {
+		if _, err := NewHandler(invalid); err != ErrInvalidHandler {
+			t.Errorf("expect %v but %v", ErrInvalidHandler, err)
+		}
+	}
+}
+
+func TestNewHandleContext(t *testing.T) {
+	meta := Metadata{Topic: "test"}
+	ctx, cancel := NewHandleContext(context.Background(), meta, time.Second)
+	defer cancel()
+
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("expect deadline")
+	}
+	if m, ok := GetMetadataFromContext(ctx); !ok || m.Topic != "test" {
+		t.Errorf("expect metadata in context but %v", m)
+	}
+
+	ctx, cancel = NewHandleContext(context.Background(), meta, 0)
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expect no deadline")
+	}
+}
@@ -0,0 +1,383 @@
+// Package kafka provides a Kafka broker, subscriptions are consumer groups named by the subscription name
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Ankr-network/kit/app"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrWildcardTopic is returned when subscribing topic patterns, Kafka consumers subscribe topics by name
+	ErrWildcardTopic = errors.New("kafka broker does not support wildcard topics")
+)
+
+var (
+	_ broker.Broker = (*kafkaBroker)(nil)
+)
+
+type Options struct {
+	Client          Client
+	Config          *sarama.Config
+	NackDelay       time.Duration
+	ShutdownTimeout time.Duration
+	Metrics         broker.MetricsRecorder
+}
+
+type Option func(opts *Options)
+
+// WithClient use client instead of connecting to the cluster, e.g. NewMockClient in tests
+func WithClient(client Client) Option {
+	return func(cfg *Options) {
+		cfg.Client = client
+	}
+}
+
+// WithConfig set the sarama config of the client, default DefaultConfig
+func WithConfig(config *sarama.Config) Option {
+	return func(cfg *Options) {
+		cfg.Config = config
+	}
+}
+
+// WithNackDelay set the default delay before a failed reliable message is retried
+func WithNackDelay(delay time.Duration) Option {
+	return func(cfg *Options) {
+		cfg.NackDelay = delay
+	}
+}
+
+// WithShutdownTimeout set how long the broker wait in-flight messages on application exit
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(cfg *Options) {
+		cfg.ShutdownTimeout = timeout
+	}
+}
+
+// WithMetrics record publishings and deliveries to recorder, see package broker/metrics
+func WithMetrics(recorder broker.MetricsRecorder) Option {
+	return func(cfg *Options) {
+		cfg.Metrics = recorder
+	}
+}
+
+type kafkaBroker struct {
+	client    Client
+	producer  sarama.AsyncProducer
+	nackDelay time.Duration
+	metrics   broker.MetricsRecorder
+	// ctx is the parent context of handlers, cancelled after the broker closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m             sync.Mutex
+	closed        bool
+	subscriptions map[*kafkaSubscription]struct{}
+
+	// pm guard sending to the producer, which must not happen after it closed
+	pm             sync.RWMutex
+	producerClosed bool
+	dispatched     chan struct{}
+}
+
+func NewKafkaBrokerWithConfig(opts ...Option) broker.Broker {
+	cfg := MustLoadConfig()
+	config := DefaultConfig()
+	version, err := sarama.ParseKafkaVersion(cfg.Version)
+	if err != nil {
+		log.Fatal("invalid Kafka version", zap.String("version", cfg.Version), zap.Error(err))
+	}
+	config.Version = version
+	config.ClientID = cfg.ClientID
+
+	return NewKafkaBroker(
+		cfg.Brokers,
+		append([]Option{
+			WithConfig(config),
+			WithNackDelay(cfg.NackDelay),
+			WithShutdownTimeout(cfg.ShutdownTimeout),
+		}, opts...)...,
+	)
+}
+
+// NewKafkaBroker connect to the cluster of addrs, which are ignored if WithClient given
+func NewKafkaBroker(addrs []string, opts ...Option) broker.Broker {
+	options := &Options{
+		NackDelay:       5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		Metrics:         broker.NopMetrics,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	client := options.Client
+	if client == nil {
+		var err error
+		if client, err = NewClient(addrs, options.Config); err != nil {
+			log.Fatal("connect Kafka error", zap.Strings("addrs", addrs), zap.Error(err))
+		}
+	}
+	producer, err := client.AsyncProducer()
+	if err != nil {
+		log.Fatal("create producer error", zap.Error(err))
+	}
+
+	out := &kafkaBroker{
+		client:        client,
+		producer:      producer,
+		nackDelay:     options.NackDelay,
+		metrics:       options.Metrics,
+		subscriptions: map[*kafkaSubscription]struct{}{},
+		dispatched:    make(chan struct{}),
+	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+	go out.dispatch()
+
+	app.SubSync(app.ExitTopic, func(_ app.Event) {
+		ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+		defer cancel()
+		if err := out.Close(ctx); err != nil && err != broker.ErrClosed {
+			log.Error("close broker error", zap.Error(err))
+		}
+	})
+
+	return out
+}
+
+// send pass record to the producer, future is resolved with the result of record
+func (b *kafkaBroker) send(ctx context.Context, record *sarama.ProducerMessage, future *publishFuture) error {
+	b.pm.RLock()
+	defer b.pm.RUnlock()
+	if b.producerClosed {
+		return broker.ErrClosed
+	}
+
+	record.Metadata = future
+	select {
+	case b.producer.Input() <- record:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// dispatch resolve the futures of records returned by the producer until it closed
+func (b *kafkaBroker) dispatch() {
+	defer close(b.dispatched)
+	successes, errs := b.producer.Successes(), b.producer.Errors()
+	for successes != nil || errs != nil {
+		select {
+		case record, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			record.Metadata.(*publishFuture).resolve(nil)
+		case e, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			e.Msg.Metadata.(*publishFuture).resolve(e.Err)
+		}
+	}
+}
+
+func (b *kafkaBroker) isClosed() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.closed
+}
+
+func (b *kafkaBroker) TopicPublisher(topic string, opts ...broker.Option) (broker.Publisher, error) {
+	return b.createPublisher(topic, opts...)
+}
+
+func (b *kafkaBroker) MultiTopicPublisher(opts ...broker.Option) (broker.MultiTopicPublisher, error) {
+	return b.createPublisher("", opts...)
+}
+
+func (b *kafkaBroker) BatchPublisher(opts ...broker.Option) (broker.BatchPublisher, error) {
+	return b.createPublisher("", append(opts, broker.Reliable())...)
+}
+
+func (b *kafkaBroker) createPublisher(topic string, opts ...broker.Option) (*kafkaPublisher, error) {
+	brokerOptions := &broker.Options{
+		Codec: broker.ProtoCodec,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	if b.isClosed() {
+		return nil, broker.ErrClosed
+	}
+	return &kafkaPublisher{
+		broker:     b,
+		topic:      topic,
+		reliable:   brokerOptions.Reliable,
+		codec:      brokerOptions.Codec,
+		middleware: broker.ChainPublisher(brokerOptions.PublishMiddlewares...),
+		schemas:    brokerOptions.Schemas,
+	}, nil
+}
+
+// Requester is not supported, Kafka has no exclusive reply queues
+func (b *kafkaBroker) Requester(opts ...broker.Option) (broker.Requester, error) {
+	return nil, ErrNotSupported
+}
+
+// RegisterResponder is not supported, see Requester
+func (b *kafkaBroker) RegisterResponder(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	return nil, ErrNotSupported
+}
+
+// RegisterSubscribeHandler join consumer group name on topic, failed messages of a reliable subscription are
+// dead-lettered to topic error.<topic>
+func (b *kafkaBroker) RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	fn, err := broker.NewHandler(handler)
+	if err != nil {
+		return nil, err
+	}
+	return b.register(name, []string{topic}, fmt.Sprintf("error.%s", topic), broker.SingleRouter(fn), opts)
+}
+
+// RegisterRouter join consumer group name on the topics of routes, which must not be wildcards.
+// broker.Fallback is not supported, a consumer group cannot subscribe every topic.
+func (b *kafkaBroker) RegisterRouter(name string, routes map[string]interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	if len(routes) == 0 {
+		return nil, broker.ErrNoRoute
+	}
+	brokerOptions := &broker.Options{}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	if brokerOptions.Fallback != nil {
+		return nil, fmt.Errorf("%w: fallback of router", ErrNotSupported)
+	}
+	router, err := broker.NewRouter(routes, brokerOptions.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	return b.register(name, router.Patterns(), fmt.Sprintf("error.%s", name), router, opts)
+}
+
+func (b *kafkaBroker) register(name string, topics []string, errTopic string, router *broker.Router, opts []broker.Option) (broker.Subscription, error) {
+	if err := checkTopics(topics); err != nil {
+		return nil, err
+	}
+
+	brokerOptions := &broker.Options{
+		Reliable: false,
+		MaxRetry: 0,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(b.nackDelay)
+	}
+	if err := brokerOptions.Schemas.CheckRouter(topics, router); err != nil {
+		return nil, err
+	}
+	if brokerOptions.Concurrency > 1 {
+		log.Warn("concurrency of kafka subscription is the number of assigned partitions", zap.String("group", name))
+	}
+
+	return b.subscribe(name, topics, newHandler(b, name, router, errTopic, brokerOptions))
+}
+
+// RegisterErrSubscribeHandler join consumer group name on the dead-letter topic, e.g. error.<topic>, see
+// broker.DeadLetterOf. The offset is committed after handled, a failed message is retried until handled.
+func (b *kafkaBroker) RegisterErrSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	if err := checkTopics([]string{topic}); err != nil {
+		return nil, err
+	}
+	fn, err := broker.NewHandler(handler)
+	if err != nil {
+		return nil, err
+	}
+
+	brokerOptions := &broker.Options{}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(b.nackDelay)
+	}
+
+	return b.subscribe(name, []string{topic}, newErrHandler(b, name, broker.SingleRouter(fn), brokerOptions))
+}
+
+func checkTopics(topics []string) error {
+	for _, topic := range topics {
+		if strings.ContainsAny(topic, "*#") {
+			return fmt.Errorf("%w: %s", ErrWildcardTopic, topic)
+		}
+	}
+	return nil
+}
+
+func (b *kafkaBroker) removeSubscription(s *kafkaSubscription) {
+	b.m.Lock()
+	delete(b.subscriptions, s)
+	b.m.Unlock()
+}
+
+// Close leave all consumer groups, wait in-flight messages handled until ctx done, then close the producer and client
+func (b *kafkaBroker) Close(ctx context.Context) error {
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		return broker.ErrClosed
+	}
+	b.closed = true
+	subscriptions := make([]*kafkaSubscription, 0, len(b.subscriptions))
+	for s := range b.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	b.m.Unlock()
+
+	var (
+		wg     sync.WaitGroup
+		em     sync.Mutex
+		result error
+	)
+	for _, s := range subscriptions {
+		wg.Add(1)
+		go func(s *kafkaSubscription) {
+			defer wg.Done()
+			if err := s.Unsubscribe(ctx); err != nil {
+				em.Lock()
+				if result == nil {
+					result = err
+				}
+				em.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	b.cancel()
+
+	// wait senders passed the closed check, then flush the records in flight
+	b.pm.Lock()
+	b.producerClosed = true
+	if err := b.producer.Close(); err != nil && result == nil {
+		result = err
+	}
+	b.pm.Unlock()
+	<-b.dispatched
+
+	if err := b.client.Close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
@@ -0,0 +1,264 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/dedup"
+	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	errTest = errors.New("test error")
+)
+
+func newTestBroker(t *testing.T) (broker.Broker, *MockClient) {
+	client := NewMockClient()
+	b := NewKafkaBroker(nil, WithClient(client), WithNackDelay(time.Millisecond))
+	t.Cleanup(func() {
+		_ = b.Close(context.Background())
+	})
+	return b, client
+}
+
+type received struct {
+	msg  *wrappers.StringValue
+	meta broker.Metadata
+}
+
+func receive(t *testing.T, ch <-chan received) received {
+	select {
+	case r := <-ch:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting message")
+		return received{}
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b, client := newTestBroker(t)
+
+	ch := make(chan received, 1)
+	_, err := b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		ch <- received{msg: msg, meta: meta}
+		return nil
+	}, broker.Reliable())
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created", broker.Reliable())
+	require.NoError(t, err)
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "alice"},
+		broker.MessageID("1"), broker.Header("tenant", "t1"), broker.PartitionKey("alice")))
+
+	r := receive(t, ch)
+	assert.Equal(t, "alice", r.msg.Value)
+	assert.Equal(t, "user.created", r.meta.Topic)
+	assert.Equal(t, "1", r.meta.MessageID)
+	assert.Equal(t, broker.ContentTypeProtobuf, r.meta.ContentType)
+	assert.Equal(t, "t1", r.meta.Headers["tenant"])
+
+	messages := client.Messages("user.created")
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte("alice"), messages[0].Key)
+	require.Eventually(t, func() bool {
+		return client.Committed("audit", "user.created") == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	b, client := newTestBroker(t)
+
+	var (
+		m       sync.Mutex
+		retries []int
+	)
+	_, err := b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		m.Lock()
+		defer m.Unlock()
+		retries = append(retries, broker.RetryCount(meta.Headers))
+		return errTest
+	}, broker.Reliable(), broker.MaxRetry(2), broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)))
+	require.NoError(t, err)
+
+	ch := make(chan received, 1)
+	attempts := 0
+	_, err = b.RegisterErrSubscribeHandler("quarantine", "error.user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		// a failed error handler get the message again instead of losing it
+		if attempts++; attempts < 2 {
+			return errTest
+		}
+		ch <- received{msg: msg, meta: meta}
+		return nil
+	}, broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created", broker.Reliable())
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "poison"}))
+
+	r := receive(t, ch)
+	assert.Equal(t, "poison", r.msg.Value)
+	dead := broker.DeadLetterOf(r.meta)
+	assert.Equal(t, "user.created", dead.OriginalTopic)
+	assert.Equal(t, "audit", dead.Subscription)
+	assert.Equal(t, errTest.Error(), dead.Reason)
+
+	m.Lock()
+	assert.Equal(t, []int{0, 1, 2}, retries)
+	m.Unlock()
+	assert.Equal(t, int64(1), client.Committed("audit", "user.created"))
+	require.Eventually(t, func() bool {
+		return client.Committed("quarantine", "error.user.created") == 1
+	}, time.Second, time.Millisecond)
+}
+
+func TestDedupInProgress(t *testing.T) {
+	b, client := newTestBroker(t)
+
+	store := dedup.NewLRUStore(10)
+	ch := make(chan received, 1)
+	_, err := b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		ch <- received{msg: msg, meta: meta}
+		return nil
+	}, broker.Reliable(), broker.MaxRetry(1), broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)), broker.Dedup(store))
+	require.NoError(t, err)
+
+	// another consumer claimed the message, and hold it far longer than MaxRetry×backoff
+	key := broker.DedupKey("audit", "1")
+	claimed, err := store.Claim(context.Background(), key)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	p, err := b.TopicPublisher("user.created", broker.Reliable())
+	require.NoError(t, err)
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "held"}, broker.MessageID("1")))
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, ch)
+	assert.Empty(t, client.Messages("error.user.created"), "not dead-lettered")
+
+	require.NoError(t, store.Release(context.Background(), key))
+	r := receive(t, ch)
+	assert.Equal(t, "held", r.msg.Value)
+	assert.Equal(t, 0, broker.RetryCount(r.meta.Headers), "the redeliveries are not attempts")
+}
+
+func TestUnfinishedMessageConsumedAgain(t *testing.T) {
+	b, client := newTestBroker(t)
+
+	started := make(chan struct{})
+	s, err := b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}, broker.Reliable(), broker.MaxRetry(3))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "slow"}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Unsubscribe(ctx))
+	assert.Equal(t, int64(0), client.Committed("audit", "user.created"))
+
+	ch := make(chan received, 1)
+	_, err = b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		ch <- received{msg: msg, meta: meta}
+		return nil
+	}, broker.Reliable())
+	require.NoError(t, err)
+	assert.Equal(t, "slow", receive(t, ch).msg.Value)
+}
+
+func TestBatchPublish(t *testing.T) {
+	b, client := newTestBroker(t)
+
+	p, err := b.BatchPublisher()
+	require.NoError(t, err)
+	msgs := []*broker.Message{
+		broker.NewMessage("a", &wrappers.StringValue{Value: "1"}),
+		broker.NewMessage("b", &wrappers.StringValue{Value: "2"}),
+	}
+	var results []broker.PublishResult
+	for r := range p.PublishBatch(context.Background(), msgs) {
+		results = append(results, r)
+	}
+	require.Len(t, results, 2)
+	for i, r := range results {
+		assert.NoError(t, r.Err)
+		assert.Equal(t, msgs[i], r.Message)
+		assert.NotEmpty(t, r.MessageID)
+	}
+	assert.Len(t, client.Messages("a"), 1)
+	assert.Len(t, client.Messages("b"), 1)
+}
+
+func TestUnsupported(t *testing.T) {
+	b, _ := newTestBroker(t)
+
+	_, err := b.Requester()
+	assert.Equal(t, ErrNotSupported, err)
+
+	p, err := b.TopicPublisher("user.created")
+	require.NoError(t, err)
+	assert.Equal(t, ErrNotSupported, p.PublishContext(context.Background(), &wrappers.StringValue{}, broker.DeliverAfter(time.Minute)))
+
+	_, err = b.RegisterSubscribeHandler("audit", "user.*", func(msg *wrappers.StringValue) error { return nil })
+	assert.True(t, errors.Is(err, ErrWildcardTopic))
+
+	_, err = b.RegisterRouter("audit", map[string]interface{}{
+		"user.created": func(msg *wrappers.StringValue) error { return nil },
+	}, broker.Fallback(func(msg *wrappers.StringValue) error { return nil }))
+	assert.True(t, errors.Is(err, ErrNotSupported))
+}
+
+func TestClose(t *testing.T) {
+	b, _ := newTestBroker(t)
+	p, err := b.TopicPublisher("user.created")
+	require.NoError(t, err)
+
+	require.NoError(t, b.Close(context.Background()))
+	assert.Equal(t, broker.ErrClosed, p.Publish(&wrappers.StringValue{}))
+	assert.Equal(t, broker.ErrClosed, b.Close(context.Background()))
+}
+
+func TestInitialOffset(t *testing.T) {
+	for _, c := range []struct {
+		initial  int64
+		expected int64
+	}{
+		{sarama.OffsetOldest, 0},
+		{sarama.OffsetNewest, 2},
+	} {
+		config := DefaultConfig()
+		config.Consumer.Offsets.Initial = c.initial
+		client := NewMockClientWithConfig(config)
+		for _, v := range []string{"a", "b"} {
+			require.NoError(t, client.append(&sarama.ProducerMessage{Topic: "user.created", Value: sarama.StringEncoder(v)}))
+		}
+
+		// a new group start from the initial offset, a committed one from where it committed
+		assert.Equal(t, c.expected, client.offset("audit", "user.created"))
+		client.commit("audit", map[string]int64{"user.created": 1})
+		assert.Equal(t, int64(1), client.offset("audit", "user.created"))
+	}
+	assert.Equal(t, sarama.OffsetOldest, NewMockClient().initial)
+}
+
+func TestNewClientKeepConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.Metadata.Retry.Max = 0
+	// nothing listen on port 1
+	_, err := NewClient([]string{"127.0.0.1:1"}, config)
+	assert.Error(t, err)
+	assert.False(t, config.Producer.Return.Successes, "the config of caller is not modified")
+}
@@ -0,0 +1,58 @@
+package kafka
+
+import (
+	"github.com/Shopify/sarama"
+)
+
+// Client create the producer and consumer groups of the broker, see NewClient and NewMockClient
+type Client interface {
+	// AsyncProducer create a producer returning both successes and errors
+	AsyncProducer() (sarama.AsyncProducer, error)
+	// ConsumerGroup create a member of group
+	ConsumerGroup(group string) (sarama.ConsumerGroup, error)
+	Close() error
+}
+
+type saramaClient struct {
+	client sarama.Client
+}
+
+// NewClient connect to the Kafka cluster of addrs, config nil means DefaultConfig. config is copied, not modified.
+func NewClient(addrs []string, config *sarama.Config) (Client, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	copied := *config
+	config = &copied
+	// the broker correlate publishings with their results
+	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+
+	client, err := sarama.NewClient(addrs, config)
+	if err != nil {
+		return nil, err
+	}
+	return &saramaClient{client: client}, nil
+}
+
+// DefaultConfig is the config of a Kafka 2.1 cluster, publishings are acked by all in-sync replicas.
+// A new consumer group consume topics from the oldest message, so messages published before it joined are not lost.
+func DefaultConfig() *sarama.Config {
+	out := sarama.NewConfig()
+	out.Version = sarama.V2_1_0_0
+	out.Producer.RequiredAcks = sarama.WaitForAll
+	out.Consumer.Offsets.Initial = sarama.OffsetOldest
+	return out
+}
+
+func (c *saramaClient) AsyncProducer() (sarama.AsyncProducer, error) {
+	return sarama.NewAsyncProducerFromClient(c.client)
+}
+
+func (c *saramaClient) ConsumerGroup(group string) (sarama.ConsumerGroup, error) {
+	return sarama.NewConsumerGroupFromClient(group, c.client)
+}
+
+func (c *saramaClient) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,20 @@
+package kafka
+
+import (
+	"github.com/Ankr-network/kit/util"
+	"time"
+)
+
+type Config struct {
+	Brokers         []string      `env:"KAFKA_BROKERS" envDefault:"127.0.0.1:9092" envSeparator:","`
+	Version         string        `env:"KAFKA_VERSION" envDefault:"2.1.0"`
+	ClientID        string        `env:"KAFKA_CLIENT_ID" envDefault:"kit"`
+	NackDelay       time.Duration `env:"KAFKA_NACK_DELAY" envDefault:"5s"`
+	ShutdownTimeout time.Duration `env:"KAFKA_SHUTDOWN_TIMEOUT" envDefault:"30s"`
+}
+
+func MustLoadConfig() *Config {
+	out := new(Config)
+	util.MustLoadConfig(out)
+	return out
+}
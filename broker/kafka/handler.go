@@ -0,0 +1,206 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"math"
+	"time"
+)
+
+// handler is the sarama.ConsumerGroupHandler of a subscription. Messages of a partition are handled one by one,
+// a failed message is retried in place so the partition order is kept, then dead-lettered to errTopic.
+type handler struct {
+	broker     *kafkaBroker
+	name       string
+	router     *broker.Router
+	middleware broker.SubscriberMiddleware
+	dedup      broker.DedupStore
+	codec      broker.Codec
+	schemas    *broker.SchemaRegistry
+	reliable   bool
+	maxRetry   int
+	backoff    broker.Backoff
+	timeout    time.Duration
+	// errTopic is where failed messages are dead-lettered, empty to drop them
+	errTopic string
+	// ctx is the parent context of handlers, cancelled once the subscription stopped waiting them
+	ctx context.Context
+}
+
+func newHandler(b *kafkaBroker, name string, router *broker.Router, errTopic string, opts *broker.Options) *handler {
+	return &handler{
+		broker:     b,
+		name:       name,
+		router:     router,
+		middleware: broker.ChainSubscriber(opts.Middlewares...),
+		dedup:      opts.Dedup,
+		codec:      opts.Codec,
+		schemas:    opts.Schemas,
+		reliable:   opts.Reliable,
+		maxRetry:   opts.MaxRetry,
+		backoff:    opts.Backoff,
+		timeout:    opts.Timeout,
+		errTopic:   errTopic,
+	}
+}
+
+// newErrHandler is a reliable handler of a dead-letter topic, failed messages are retried until handled since there
+// is nowhere else to dead-letter them
+func newErrHandler(b *kafkaBroker, name string, router *broker.Router, opts *broker.Options) *handler {
+	out := newHandler(b, name, router, "", opts)
+	out.reliable = true
+	out.maxRetry = math.MaxInt32
+	return out
+}
+
+func (h *handler) Setup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+func (h *handler) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim handle messages of a partition until the session end. A reliable subscription commit the offset after
+// a message handled or dead-lettered, otherwise the offset is marked before handling and committed periodically.
+func (h *handler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if !h.reliable {
+				session.MarkMessage(msg, "")
+				h.handle(session.Context(), msg)
+				continue
+			}
+			if !h.handle(session.Context(), msg) {
+				// the partition is revoked, the message is left to the next owner
+				return nil
+			}
+			session.MarkMessage(msg, "")
+			session.Commit()
+		case <-session.Context().Done():
+			return nil
+		}
+	}
+}
+
+// handle msg until succeeded, dead-lettered or dropped, false if the session ended before that
+func (h *handler) handle(session context.Context, msg *sarama.ConsumerMessage) bool {
+	meta := newMetadata(msg)
+	fn, err := h.router.Route(meta.Topic)
+	if err != nil {
+		log.Error("route message error, reject it", zap.Error(err), zap.String("topic", meta.Topic), zap.String("group", h.name))
+		h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleNoRoute, 0)
+		return h.deadLetter(session, msg, meta, err)
+	}
+
+	for attempt := 0; ; {
+		if attempt > 0 {
+			meta.Headers = withRetryCount(meta.Headers, attempt)
+		}
+
+		if err := h.schemas.CheckType(meta, fn); err != nil {
+			log.Error("message type mismatch, reject it", zap.Error(err), zap.String("topic", msg.Topic),
+				zap.String("message_id", meta.MessageID))
+			h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleDecodeFailed, 0)
+			return h.deadLetter(session, msg, meta, err)
+		}
+
+		m := fn.NewMessage()
+		if err := broker.Decode(h.codec, meta.ContentType, msg.Value, m); err != nil {
+			// undecodable message can never succeed, dead-letter it without retry
+			log.Error("decode message error, reject it", zap.Error(err), zap.String("topic", msg.Topic),
+				zap.String("message_id", meta.MessageID), zap.ByteString("body", msg.Value))
+			h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleDecodeFailed, 0)
+			return h.deadLetter(session, msg, meta, err)
+		}
+
+		start := time.Now()
+		ctx, cancel := broker.NewHandleContext(h.ctx, meta, h.timeout)
+		err := broker.Dispatch(ctx, h.middleware, h.dedup, h.name, fn, m, meta)
+		cancel()
+		duration := time.Since(start)
+
+		delay := h.backoff(attempt + 1)
+		switch {
+		case err == nil:
+			h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleAcked, duration)
+			return true
+		case !h.reliable:
+			h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleNacked, duration)
+			return true
+		case errors.Is(err, broker.ErrInProgress):
+			// another consumer hold the claim, the redelivery is not an attempt
+		case attempt >= h.maxRetry:
+			h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleNacked, duration)
+			return h.deadLetter(session, msg, meta, err)
+		default:
+			attempt++
+		}
+
+		h.broker.metrics.Handled(h.name, meta.Topic, broker.HandleRetried, duration)
+		select {
+		case <-time.After(delay):
+		case <-session.Done():
+			return false
+		}
+	}
+}
+
+// deadLetter publish msg to errTopic with cause in headers, it is retried until published or the session ended
+func (h *handler) deadLetter(session context.Context, msg *sarama.ConsumerMessage, meta broker.Metadata, cause error) bool {
+	if !h.reliable || h.errTopic == "" {
+		log.Warn("drop failed message", zap.Error(cause), zap.String("topic", msg.Topic), zap.String("group", h.name),
+			zap.Int64("offset", msg.Offset))
+		return true
+	}
+
+	headers := broker.DeadLetterHeaders(meta.Headers, msg.Topic, h.name, cause)
+	record := &sarama.ProducerMessage{
+		Topic:     h.errTopic,
+		Value:     sarama.ByteEncoder(msg.Value),
+		Headers:   recordHeaders(meta.ContentType, publishOptions(meta, headers)),
+		Timestamp: time.Now(),
+	}
+	if msg.Key != nil {
+		record.Key = sarama.ByteEncoder(msg.Key)
+	}
+
+	for attempt := 1; ; attempt++ {
+		future := newPublishFuture(nil, meta.MessageID)
+		err := h.broker.send(session, record, future)
+		if err == nil {
+			select {
+			case <-future.done:
+				err = future.err
+			case <-session.Done():
+				return false
+			}
+		}
+		if err == nil {
+			return true
+		}
+
+		log.Error("dead-letter message error", zap.Error(err), zap.String("topic", h.errTopic), zap.Int("attempt", attempt))
+		select {
+		case <-time.After(h.backoff(attempt)):
+		case <-session.Done():
+			return false
+		}
+	}
+}
+
+func withRetryCount(headers map[string]interface{}, attempt int) map[string]interface{} {
+	out := make(map[string]interface{}, len(headers)+1)
+	for k, v := range headers {
+		out[k] = v
+	}
+	out[broker.RetryCountHeader] = int32(attempt)
+	return out
+}
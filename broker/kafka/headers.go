@@ -0,0 +1,96 @@
+package kafka
+
+import (
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+)
+
+// the properties of a message are carried by record headers, as Kafka has no such attributes
+const (
+	ContentTypeHeader   = "content-type"
+	MessageIDHeader     = "message-id"
+	CorrelationIDHeader = "correlation-id"
+	ReplyToHeader       = "reply-to"
+	TypeHeader          = "type"
+)
+
+// recordHeaders encode the properties and headers of a message, header values are formatted by fmt.Sprint unless
+// string or []byte
+func recordHeaders(contentType string, options *broker.PublishOptions) []sarama.RecordHeader {
+	out := make([]sarama.RecordHeader, 0, len(options.Headers)+4)
+	add := func(key string, value interface{}) {
+		var data []byte
+		switch v := value.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		default:
+			data = []byte(fmt.Sprint(v))
+		}
+		out = append(out, sarama.RecordHeader{Key: []byte(key), Value: data})
+	}
+
+	add(ContentTypeHeader, contentType)
+	if options.MessageID != "" {
+		add(MessageIDHeader, options.MessageID)
+	}
+	if options.CorrelationID != "" {
+		add(CorrelationIDHeader, options.CorrelationID)
+	}
+	if options.ReplyTo != "" {
+		add(ReplyToHeader, options.ReplyTo)
+	}
+	if options.Type != "" {
+		add(TypeHeader, options.Type)
+	}
+	for k, v := range options.Headers {
+		add(k, v)
+	}
+	return out
+}
+
+// newMetadata decode the record headers of msg, header values are strings
+func newMetadata(msg *sarama.ConsumerMessage) broker.Metadata {
+	out := broker.Metadata{
+		Topic:     msg.Topic,
+		Headers:   map[string]interface{}{},
+		Timestamp: msg.Timestamp,
+	}
+	for _, h := range msg.Headers {
+		if h == nil {
+			continue
+		}
+		switch key, value := string(h.Key), string(h.Value); key {
+		case ContentTypeHeader:
+			out.ContentType = value
+		case MessageIDHeader:
+			out.MessageID = value
+		case CorrelationIDHeader:
+			out.CorrelationID = value
+		case ReplyToHeader:
+			out.ReplyTo = value
+		case TypeHeader:
+			out.Type = value
+		default:
+			out.Headers[key] = value
+		}
+	}
+	if original, ok := out.Headers[broker.OriginalTopicHeader].(string); ok {
+		out.Topic = original
+	}
+	return out
+}
+
+// publishOptions restore the properties and headers of meta for republishing, e.g. to a dead-letter topic
+func publishOptions(meta broker.Metadata, headers map[string]interface{}) *broker.PublishOptions {
+	return &broker.PublishOptions{
+		Headers:       headers,
+		MessageID:     meta.MessageID,
+		CorrelationID: meta.CorrelationID,
+		ReplyTo:       meta.ReplyTo,
+		Type:          meta.Type,
+		Persistent:    true,
+	}
+}
@@ -0,0 +1,33 @@
+package kafka
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRecordHeaders(t *testing.T) {
+	headers := recordHeaders(broker.ContentTypeJSON, &broker.PublishOptions{
+		MessageID:     "1",
+		CorrelationID: "2",
+		Type:          "google.protobuf.StringValue",
+		Headers:       map[string]interface{}{"tenant": "t1", "version": 2, "raw": []byte("r")},
+	})
+
+	msg := &sarama.ConsumerMessage{Topic: "user.created"}
+	for i := range headers {
+		msg.Headers = append(msg.Headers, &headers[i])
+	}
+	meta := newMetadata(msg)
+	assert.Equal(t, "user.created", meta.Topic)
+	assert.Equal(t, broker.ContentTypeJSON, meta.ContentType)
+	assert.Equal(t, "1", meta.MessageID)
+	assert.Equal(t, "2", meta.CorrelationID)
+	assert.Empty(t, meta.ReplyTo)
+	assert.Equal(t, "google.protobuf.StringValue", meta.Type)
+	assert.Equal(t, map[string]interface{}{"tenant": "t1", "version": "2", "raw": "r"}, meta.Headers)
+
+	msg.Headers = append(msg.Headers, &sarama.RecordHeader{Key: []byte(broker.OriginalTopicHeader), Value: []byte("user.updated")})
+	assert.Equal(t, "user.updated", newMetadata(msg).Topic)
+}
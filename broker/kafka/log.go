@@ -0,0 +1,7 @@
+package kafka
+
+import (
+	"github.com/Ankr-network/kit/mlog"
+)
+
+var log = mlog.Logger("broker")
@@ -0,0 +1,415 @@
+package kafka
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"sync"
+	"time"
+)
+
+// MockClient is an in-process Kafka of single partition topics, useful for tests without a cluster.
+// A new consumer group consume topics from Consumer.Offsets.Initial of the config, and only one member of a group
+// consume at a time.
+type MockClient struct {
+	m         sync.Mutex
+	c         *sync.Cond
+	closed    bool
+	initial   int64
+	topics    map[string][]*sarama.ConsumerMessage
+	committed map[string]map[string]int64
+	members   map[string]chan struct{}
+}
+
+// NewMockClient create a MockClient of DefaultConfig
+func NewMockClient() *MockClient {
+	return NewMockClientWithConfig(DefaultConfig())
+}
+
+func NewMockClientWithConfig(config *sarama.Config) *MockClient {
+	out := &MockClient{
+		initial:   config.Consumer.Offsets.Initial,
+		topics:    map[string][]*sarama.ConsumerMessage{},
+		committed: map[string]map[string]int64{},
+		members:   map[string]chan struct{}{},
+	}
+	out.c = sync.NewCond(&out.m)
+	return out
+}
+
+func (c *MockClient) AsyncProducer() (sarama.AsyncProducer, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil, sarama.ErrClosedClient
+	}
+
+	out := &mockProducer{
+		client:    c,
+		input:     make(chan *sarama.ProducerMessage),
+		successes: make(chan *sarama.ProducerMessage, 256),
+		errors:    make(chan *sarama.ProducerError, 256),
+		done:      make(chan struct{}),
+	}
+	go out.run()
+	return out, nil
+}
+
+func (c *MockClient) ConsumerGroup(group string) (sarama.ConsumerGroup, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return nil, sarama.ErrClosedClient
+	}
+	if _, ok := c.members[group]; !ok {
+		c.members[group] = make(chan struct{}, 1)
+	}
+
+	return &mockGroup{
+		client: c,
+		name:   group,
+		errors: make(chan error),
+	}, nil
+}
+
+func (c *MockClient) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.closed = true
+	c.c.Broadcast()
+	return nil
+}
+
+// Messages return the messages appended to topic
+func (c *MockClient) Messages(topic string) []*sarama.ConsumerMessage {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]*sarama.ConsumerMessage(nil), c.topics[topic]...)
+}
+
+// Committed return the offset group will consume topic from, -1 if group never committed
+func (c *MockClient) Committed(group, topic string) int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if offset, ok := c.committed[group][topic]; ok {
+		return offset
+	}
+	return -1
+}
+
+func (c *MockClient) append(msg *sarama.ProducerMessage) error {
+	out := &sarama.ConsumerMessage{
+		Topic:     msg.Topic,
+		Timestamp: msg.Timestamp,
+	}
+	if out.Timestamp.IsZero() {
+		out.Timestamp = time.Now()
+	}
+	var err error
+	if msg.Key != nil {
+		if out.Key, err = msg.Key.Encode(); err != nil {
+			return err
+		}
+	}
+	if msg.Value != nil {
+		if out.Value, err = msg.Value.Encode(); err != nil {
+			return err
+		}
+	}
+	for i := range msg.Headers {
+		out.Headers = append(out.Headers, &msg.Headers[i])
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.closed {
+		return sarama.ErrClosedClient
+	}
+	out.Offset = int64(len(c.topics[msg.Topic]))
+	c.topics[msg.Topic] = append(c.topics[msg.Topic], out)
+	msg.Offset = out.Offset
+	c.c.Broadcast()
+	return nil
+}
+
+// offset return where group start consuming topic, the initial offset of the config for a new group
+func (c *MockClient) offset(group, topic string) int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if offset, ok := c.committed[group][topic]; ok {
+		return offset
+	}
+	if c.initial == sarama.OffsetNewest {
+		return int64(len(c.topics[topic]))
+	}
+	return 0
+}
+
+func (c *MockClient) commit(group string, offsets map[string]int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.committed[group] == nil {
+		c.committed[group] = map[string]int64{}
+	}
+	for topic, offset := range offsets {
+		c.committed[group][topic] = offset
+	}
+}
+
+// next block until the message at offset of topic available, nil if ctx done or the client closed
+func (c *MockClient) next(ctx context.Context, topic string, offset int64) *sarama.ConsumerMessage {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for int64(len(c.topics[topic])) <= offset {
+		if c.closed || ctx.Err() != nil {
+			return nil
+		}
+		c.c.Wait()
+	}
+	return c.topics[topic][offset]
+}
+
+func (c *MockClient) wake() {
+	c.m.Lock()
+	c.c.Broadcast()
+	c.m.Unlock()
+}
+
+type mockProducer struct {
+	client    *MockClient
+	input     chan *sarama.ProducerMessage
+	successes chan *sarama.ProducerMessage
+	errors    chan *sarama.ProducerError
+	once      sync.Once
+	done      chan struct{}
+}
+
+func (p *mockProducer) run() {
+	defer close(p.done)
+	defer close(p.errors)
+	defer close(p.successes)
+	for msg := range p.input {
+		if err := p.client.append(msg); err != nil {
+			p.errors <- &sarama.ProducerError{Msg: msg, Err: err}
+			continue
+		}
+		p.successes <- msg
+	}
+}
+
+func (p *mockProducer) AsyncClose() {
+	p.once.Do(func() {
+		close(p.input)
+	})
+}
+
+func (p *mockProducer) Close() error {
+	p.AsyncClose()
+	<-p.done
+	return nil
+}
+
+func (p *mockProducer) Input() chan<- *sarama.ProducerMessage {
+	return p.input
+}
+
+func (p *mockProducer) Successes() <-chan *sarama.ProducerMessage {
+	return p.successes
+}
+
+func (p *mockProducer) Errors() <-chan *sarama.ProducerError {
+	return p.errors
+}
+
+type mockGroup struct {
+	client *MockClient
+	name   string
+	errors chan error
+
+	m      sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+}
+
+func (g *mockGroup) Consume(ctx context.Context, topics []string, handler sarama.ConsumerGroupHandler) error {
+	g.client.m.Lock()
+	member := g.client.members[g.name]
+	g.client.m.Unlock()
+	select {
+	case member <- struct{}{}:
+	case <-ctx.Done():
+		return nil
+	}
+	defer func() {
+		<-member
+	}()
+
+	g.m.Lock()
+	if g.closed {
+		g.m.Unlock()
+		return sarama.ErrClosedConsumerGroup
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	g.cancel = cancel
+	g.m.Unlock()
+	defer cancel()
+
+	session := &mockSession{
+		ctx:    ctx,
+		client: g.client,
+		group:  g.name,
+		marked: map[string]int64{},
+	}
+	if err := handler.Setup(session); err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		g.client.wake()
+	}()
+
+	var wg sync.WaitGroup
+	for _, topic := range topics {
+		claim := &mockClaim{
+			client:   g.client,
+			topic:    topic,
+			offset:   g.client.offset(g.name, topic),
+			messages: make(chan *sarama.ConsumerMessage),
+		}
+		session.ResetOffset(topic, 0, claim.offset, "")
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			claim.feed(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			if err := handler.ConsumeClaim(session, claim); err != nil {
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// marked offsets are committed when the session ends, like auto commit
+	session.Commit()
+	return handler.Cleanup(session)
+}
+
+func (g *mockGroup) Errors() <-chan error {
+	return g.errors
+}
+
+func (g *mockGroup) Close() error {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if g.closed {
+		return sarama.ErrClosedConsumerGroup
+	}
+	g.closed = true
+	if g.cancel != nil {
+		g.cancel()
+	}
+	close(g.errors)
+	return nil
+}
+
+type mockSession struct {
+	ctx    context.Context
+	client *MockClient
+	group  string
+
+	m      sync.Mutex
+	marked map[string]int64
+}
+
+func (s *mockSession) Claims() map[string][]int32 {
+	s.m.Lock()
+	defer s.m.Unlock()
+	out := map[string][]int32{}
+	for topic := range s.marked {
+		out[topic] = []int32{0}
+	}
+	return out
+}
+
+func (s *mockSession) MemberID() string {
+	return "mock"
+}
+
+func (s *mockSession) GenerationID() int32 {
+	return 1
+}
+
+func (s *mockSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if offset > s.marked[topic] {
+		s.marked[topic] = offset
+	}
+}
+
+func (s *mockSession) Commit() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.client.commit(s.group, s.marked)
+}
+
+func (s *mockSession) ResetOffset(topic string, partition int32, offset int64, metadata string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.marked[topic] = offset
+}
+
+func (s *mockSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *mockSession) Context() context.Context {
+	return s.ctx
+}
+
+type mockClaim struct {
+	client   *MockClient
+	topic    string
+	offset   int64
+	messages chan *sarama.ConsumerMessage
+}
+
+// feed send messages of topic from offset until ctx done
+func (c *mockClaim) feed(ctx context.Context) {
+	defer close(c.messages)
+	for offset := c.offset; ; offset++ {
+		msg := c.client.next(ctx, c.topic, offset)
+		if msg == nil {
+			return
+		}
+		select {
+		case c.messages <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *mockClaim) Topic() string {
+	return c.topic
+}
+
+func (c *mockClaim) Partition() int32 {
+	return 0
+}
+
+func (c *mockClaim) InitialOffset() int64 {
+	return c.offset
+}
+
+func (c *mockClaim) HighWaterMarkOffset() int64 {
+	c.client.m.Lock()
+	defer c.client.m.Unlock()
+	return int64(len(c.client.topics[c.topic]))
+}
+
+func (c *mockClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return c.messages
+}
@@ -0,0 +1,164 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"time"
+)
+
+var (
+	ErrMessageIsNotProtoMessage = errors.New("message must be proto.Message")
+	// ErrNotSupported is returned by features of RabbitMQ without Kafka counterparts, e.g. delayed delivery and request/reply
+	ErrNotSupported = errors.New("not supported by kafka broker")
+)
+
+type kafkaPublisher struct {
+	broker     *kafkaBroker
+	topic      string
+	reliable   bool
+	codec      broker.Codec
+	middleware broker.PublisherMiddleware
+	schemas    *broker.SchemaRegistry
+}
+
+func (p *kafkaPublisher) Publish(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return ErrMessageIsNotProtoMessage
+	}
+	return p.PublishContext(context.Background(), msg)
+}
+
+func (p *kafkaPublisher) PublishContext(ctx context.Context, m proto.Message, opts ...broker.PublishOption) error {
+	return p.PublishMessageContext(ctx, broker.NewMessage(p.topic, m), opts...)
+}
+
+func (p *kafkaPublisher) PublishMessage(msg *broker.Message) error {
+	return p.PublishMessageContext(context.Background(), msg)
+}
+
+// PublishMessageContext publish msg and wait it acked by the cluster or ctx done
+func (p *kafkaPublisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	return broker.InterceptPublish(ctx, p.middleware, msg, broker.NewPublishOptions(p.reliable, opts...), func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+		future, err := p.doPublishAsync(ctx, msg, options)
+		if err != nil {
+			return err
+		}
+		select {
+		case <-future.done:
+			return future.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// doPublishAsync send msg to the producer and return the future of its result, the outcome is recorded to metrics
+func (p *kafkaPublisher) doPublishAsync(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) (_ *publishFuture, err error) {
+	defer func() {
+		if err != nil {
+			p.broker.metrics.Published(msg.Topic, broker.PublishFailed, 0)
+		}
+	}()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if options.Delay() > 0 || options.Expiration > 0 {
+		return nil, ErrNotSupported
+	}
+	if err := p.schemas.CheckPublish(msg.Topic, msg.Value, options); err != nil {
+		return nil, err
+	}
+
+	body, err := p.codec.Marshal(msg.Value)
+	if err != nil {
+		return nil, err
+	}
+	if options.MessageID == "" {
+		// consumers deduplicate by message id
+		options.MessageID = uuid.New().String()
+	}
+
+	record := &sarama.ProducerMessage{
+		Topic:     msg.Topic,
+		Value:     sarama.ByteEncoder(body),
+		Headers:   recordHeaders(p.codec.ContentType(), options),
+		Timestamp: time.Now(),
+	}
+	if options.PartitionKey != "" {
+		// messages of the same key are hashed to the same partition
+		record.Key = sarama.StringEncoder(options.PartitionKey)
+	}
+
+	future := newPublishFuture(msg, options.MessageID)
+	start := time.Now()
+	future.observe = func(err error) {
+		p.broker.metrics.Published(msg.Topic, broker.PublishStatusOf(err), time.Since(start))
+	}
+	if err := p.broker.send(ctx, record, future); err != nil {
+		future.observe = nil
+		return nil, err
+	}
+	return future, nil
+}
+
+func (p *kafkaPublisher) PublishAsync(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) broker.PublishFuture {
+	options := broker.NewPublishOptions(p.reliable, opts...)
+	var future *publishFuture
+	err := broker.InterceptPublish(ctx, p.middleware, msg, options, func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) (err error) {
+		future, err = p.doPublishAsync(ctx, msg, options)
+		return err
+	})
+	if err != nil {
+		log.Error("publish message error", zap.Error(err), zap.String("topic", msg.Topic), zap.Reflect("value", msg.Value))
+		return broker.CompletedFuture(broker.NewPublishResult(msg, options.MessageID, err))
+	}
+	return future
+}
+
+func (p *kafkaPublisher) PublishBatch(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) <-chan broker.PublishResult {
+	return broker.PublishBatch(ctx, msgs, func(ctx context.Context, msg *broker.Message) broker.PublishFuture {
+		return p.PublishAsync(ctx, msg, opts...)
+	})
+}
+
+// publishFuture is resolved by the broker once the producer return the record, it is the broker.PublishFuture as well
+type publishFuture struct {
+	msg       *broker.Message
+	messageID string
+	done      chan struct{}
+	err       error
+	// observe is called with the result before done closed, nil if unobserved
+	observe func(err error)
+}
+
+func newPublishFuture(msg *broker.Message, messageID string) *publishFuture {
+	return &publishFuture{
+		msg:       msg,
+		messageID: messageID,
+		done:      make(chan struct{}),
+	}
+}
+
+func (f *publishFuture) resolve(err error) {
+	f.err = err
+	if f.observe != nil {
+		f.observe(err)
+	}
+	close(f.done)
+}
+
+func (f *publishFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *publishFuture) Result() broker.PublishResult {
+	<-f.done
+	return broker.NewPublishResult(f.msg, f.messageID, f.err)
+}
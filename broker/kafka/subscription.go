@@ -0,0 +1,98 @@
+package kafka
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Shopify/sarama"
+	"go.uber.org/zap"
+	"sync/atomic"
+	"time"
+)
+
+// kafkaSubscription is a member of the consumer group of a subscription
+type kafkaSubscription struct {
+	broker  *kafkaBroker
+	name    string
+	topics  []string
+	group   sarama.ConsumerGroup
+	handler *handler
+	// stop end the consume loop, cancel abort in-flight handlers
+	stop    context.CancelFunc
+	cancel  context.CancelFunc
+	done    chan struct{}
+	stopped int32
+}
+
+func (b *kafkaBroker) subscribe(name string, topics []string, h *handler) (*kafkaSubscription, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return nil, broker.ErrClosed
+	}
+
+	group, err := b.client.ConsumerGroup(name)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &kafkaSubscription{
+		broker:  b,
+		name:    name,
+		topics:  topics,
+		group:   group,
+		handler: h,
+		done:    make(chan struct{}),
+	}
+	h.ctx, out.cancel = context.WithCancel(b.ctx)
+	ctx, stop := context.WithCancel(context.Background())
+	out.stop = stop
+	b.subscriptions[out] = struct{}{}
+
+	go out.consume(ctx)
+	return out, nil
+}
+
+// consume join the group until stopped, a new session is started after each rebalance
+func (s *kafkaSubscription) consume(ctx context.Context) {
+	defer close(s.done)
+	for {
+		if err := s.group.Consume(ctx, s.topics, s.handler); err != nil {
+			if err == sarama.ErrClosedConsumerGroup {
+				return
+			}
+			log.Error("consume error", zap.Error(err), zap.String("group", s.name), zap.Strings("topics", s.topics))
+			select {
+			case <-time.After(s.broker.nackDelay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Unsubscribe leave the group after in-flight messages handled, their handler contexts are cancelled if ctx done
+// before that, and the unfinished messages are consumed again by the group
+func (s *kafkaSubscription) Unsubscribe(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&s.stopped, 0, 1) {
+		return nil
+	}
+	defer s.broker.removeSubscription(s)
+
+	s.stop()
+	var err error
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		s.cancel()
+		<-s.done
+	}
+	s.cancel()
+
+	if closeErr := s.group.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,415 @@
+// Package memory provides an in-process broker, useful for hermetic unit tests
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ErrMessageIsNotProtoMessage = errors.New("message must be proto.Message")
+	ErrPublishMessageMiss       = broker.ErrPublishMessageMiss
+)
+
+var (
+	_ broker.Broker        = (*Broker)(nil)
+	_ broker.HealthChecker = (*Broker)(nil)
+)
+
+type exchange int
+
+const (
+	exchangeTopic exchange = iota
+	exchangeDLX
+)
+
+type Options struct {
+	NackDelay time.Duration
+}
+
+type Option func(opts *Options)
+
+// WithNackDelay set the default delay before a failed reliable message is retried
+func WithNackDelay(delay time.Duration) Option {
+	return func(opts *Options) {
+		opts.NackDelay = delay
+	}
+}
+
+type binding struct {
+	exchange exchange
+	pattern  string
+	queue    *queue
+}
+
+// Broker is an in-memory broker.Broker, it follows the RabbitMQ topic exchange semantics,
+// includes wildcard bindings, reliable retry and dead-letter routing
+type Broker struct {
+	nackDelay time.Duration
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	m         sync.RWMutex
+	closed    bool
+	queues    map[string]*queue
+	bindings  []*binding
+	consumers map[*consumer]struct{}
+	replies   map[string]*requester
+
+	pm      sync.Mutex
+	pc      *sync.Cond
+	pending int
+}
+
+// NewMemoryBroker create an in-memory broker
+func NewMemoryBroker(opts ...Option) *Broker {
+	options := &Options{}
+	for _, o := range opts {
+		o(options)
+	}
+
+	out := &Broker{
+		nackDelay: options.NackDelay,
+		queues:    map[string]*queue{},
+		consumers: map[*consumer]struct{}{},
+		replies:   map[string]*requester{},
+	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+	out.pc = sync.NewCond(&out.pm)
+	return out
+}
+
+func (b *Broker) TopicPublisher(topic string, opts ...broker.Option) (broker.Publisher, error) {
+	return b.createPublisher(topic, opts...), nil
+}
+
+func (b *Broker) MultiTopicPublisher(opts ...broker.Option) (broker.MultiTopicPublisher, error) {
+	return b.createPublisher("", opts...), nil
+}
+
+func (b *Broker) BatchPublisher(opts ...broker.Option) (broker.BatchPublisher, error) {
+	return b.createPublisher("", append(opts, broker.Reliable())...), nil
+}
+
+// Requester create a requester with an exclusive reply queue, the queue is deleted after the broker closed
+func (b *Broker) Requester(opts ...broker.Option) (broker.Requester, error) {
+	brokerOptions := &broker.Options{
+		Codec: broker.ProtoCodec,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return nil, broker.ErrClosed
+	}
+
+	out := &requester{
+		broker:     b,
+		codec:      brokerOptions.Codec,
+		middleware: broker.ChainPublisher(brokerOptions.PublishMiddlewares...),
+		schemas:    brokerOptions.Schemas,
+		queue:      fmt.Sprintf("amq.gen-%s", uuid.New().String()),
+		pending:    map[string]chan *delivery{},
+	}
+	b.replies[out.queue] = out
+	return out, nil
+}
+
+// RegisterResponder subscribe requests of topic, a reply to a gone requester is dropped
+func (b *Broker) RegisterResponder(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	brokerOptions := &broker.Options{}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	fn, err := broker.NewResponder(handler, func(ctx context.Context, meta broker.Metadata, resp proto.Message, err error) error {
+		reply, replyErr := newReply(broker.ReplyCodec(brokerOptions.Codec, meta), meta, resp, err)
+		if replyErr != nil {
+			return replyErr
+		}
+		b.reply(reply)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b.register(name, []string{topic}, fmt.Sprintf("error.%s", topic), broker.SingleRouter(fn), opts)
+}
+
+func (b *Broker) RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	fn, err := broker.NewHandler(handler)
+	if err != nil {
+		return nil, err
+	}
+	return b.register(name, []string{topic}, fmt.Sprintf("error.%s", topic), broker.SingleRouter(fn), opts)
+}
+
+func (b *Broker) RegisterRouter(name string, routes map[string]interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	if len(routes) == 0 {
+		return nil, broker.ErrNoRoute
+	}
+	brokerOptions := &broker.Options{}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	router, err := broker.NewRouter(routes, brokerOptions.Fallback)
+	if err != nil {
+		return nil, err
+	}
+	return b.register(name, router.Bindings(), fmt.Sprintf("error.%s", name), router, opts)
+}
+
+func (b *Broker) register(name string, topics []string, errTopic string, router *broker.Router, opts []broker.Option) (broker.Subscription, error) {
+	brokerOptions := &broker.Options{
+		Reliable:    false,
+		MaxRetry:    0,
+		Concurrency: 1,
+	}
+
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	if brokerOptions.Concurrency < 1 {
+		brokerOptions.Concurrency = 1
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(b.nackDelay)
+	}
+	if err := brokerOptions.Schemas.CheckRouter(topics, router); err != nil {
+		return nil, err
+	}
+
+	c := &consumer{
+		name:       name,
+		router:     router,
+		middleware: broker.ChainSubscriber(brokerOptions.Middlewares...),
+		dedup:      brokerOptions.Dedup,
+		codec:      brokerOptions.Codec,
+		schemas:    brokerOptions.Schemas,
+		reliable:   brokerOptions.Reliable,
+		maxRetry:   brokerOptions.MaxRetry,
+		backoff:    brokerOptions.Backoff,
+		timeout:    brokerOptions.Timeout,
+		errTopic:   errTopic,
+	}
+	if err := b.subscribe(name, exchangeTopic, topics, c, brokerOptions.Concurrency); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// RegisterErrSubscribeHandler consume the messages dead-lettered with topic, a failed one is retried until handled
+func (b *Broker) RegisterErrSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	h, err := broker.NewHandler(handler)
+	if err != nil {
+		return nil, err
+	}
+
+	brokerOptions := &broker.Options{
+		Concurrency: 1,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	if brokerOptions.Concurrency < 1 {
+		brokerOptions.Concurrency = 1
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(b.nackDelay)
+	}
+
+	c := &consumer{
+		name:       name,
+		router:     broker.SingleRouter(h),
+		middleware: broker.ChainSubscriber(brokerOptions.Middlewares...),
+		dedup:      brokerOptions.Dedup,
+		codec:      brokerOptions.Codec,
+		schemas:    brokerOptions.Schemas,
+		reliable:   true,
+		maxRetry:   math.MaxInt32,
+		backoff:    brokerOptions.Backoff,
+		timeout:    brokerOptions.Timeout,
+	}
+	if err := b.subscribe(name, exchangeDLX, []string{topic}, c, brokerOptions.Concurrency); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (b *Broker) Close(ctx context.Context) error {
+	b.m.Lock()
+	if b.closed {
+		b.m.Unlock()
+		return broker.ErrClosed
+	}
+	b.closed = true
+	consumers := make([]*consumer, 0, len(b.consumers))
+	for c := range b.consumers {
+		consumers = append(consumers, c)
+	}
+	b.m.Unlock()
+
+	var result error
+	for _, c := range consumers {
+		if err := c.Unsubscribe(ctx); err != nil && result == nil {
+			result = err
+		}
+	}
+	b.cancel()
+
+	// release Wait, messages left in queues are never consumed after closed
+	b.pm.Lock()
+	b.pc.Broadcast()
+	b.pm.Unlock()
+
+	return result
+}
+
+// Wait block until every published message has been handled, retried to the end or dead-lettered
+func (b *Broker) Wait() {
+	b.pm.Lock()
+	for b.pending > 0 && !b.isClosed() {
+		b.pc.Wait()
+	}
+	b.pm.Unlock()
+}
+
+// Healthy report whether the broker is not closed
+func (b *Broker) Healthy() bool {
+	return !b.isClosed()
+}
+
+func (b *Broker) isClosed() bool {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	return b.closed
+}
+
+func (b *Broker) subscribe(name string, ex exchange, patterns []string, c *consumer, concurrency int) error {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return broker.ErrClosed
+	}
+
+	c.broker = b
+	for _, pattern := range patterns {
+		c.queue = b.declare(name, ex, pattern)
+	}
+	c.ctx, c.cancel = context.WithCancel(b.ctx)
+	c.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go c.consume()
+	}
+	b.consumers[c] = struct{}{}
+
+	return nil
+}
+
+func (b *Broker) removeConsumer(c *consumer) {
+	b.m.Lock()
+	delete(b.consumers, c)
+	b.m.Unlock()
+}
+
+func (b *Broker) createPublisher(topic string, opts ...broker.Option) *publisher {
+	brokerOptions := &broker.Options{
+		Reliable: false,
+		MaxRetry: 0,
+		Codec:    broker.ProtoCodec,
+	}
+
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	return &publisher{
+		broker:     b,
+		topic:      topic,
+		reliable:   brokerOptions.Reliable,
+		codec:      brokerOptions.Codec,
+		middleware: broker.ChainPublisher(brokerOptions.PublishMiddlewares...),
+		schemas:    brokerOptions.Schemas,
+	}
+}
+
+func (b *Broker) declare(name string, ex exchange, pattern string) *queue {
+	q, ok := b.queues[name]
+	if !ok {
+		q = newQueue(name)
+		b.queues[name] = q
+	}
+
+	for _, bd := range b.bindings {
+		if bd.exchange == ex && bd.pattern == pattern && bd.queue == q {
+			return q
+		}
+	}
+	b.bindings = append(b.bindings, &binding{exchange: ex, pattern: pattern, queue: q})
+
+	return q
+}
+
+// route push d to every queue bound to ex with a pattern matched d.topic, return the number of matched queues
+func (b *Broker) route(ex exchange, d *delivery) int {
+	b.m.RLock()
+	matched := map[*queue]struct{}{}
+	for _, bd := range b.bindings {
+		if bd.exchange == ex && broker.MatchTopic(bd.pattern, d.topic) {
+			matched[bd.queue] = struct{}{}
+		}
+	}
+	b.m.RUnlock()
+
+	for q := range matched {
+		b.addPending(1)
+		q.push(d.clone())
+	}
+	return len(matched)
+}
+
+// delay route d after delay, like RabbitMQ the delayed message is not checked whether routable.
+// It is pending meanwhile, so Wait blocks until it is delivered.
+func (b *Broker) delay(d *delivery, delay time.Duration) {
+	b.addPending(1)
+	time.AfterFunc(delay, func() {
+		d.timestamp = time.Now()
+		b.route(exchangeTopic, d)
+		b.addPending(-1)
+	})
+}
+
+// reply send d to the requester owned the reply queue d.topic through the default exchange
+func (b *Broker) reply(d *delivery) {
+	b.m.RLock()
+	r, ok := b.replies[d.topic]
+	b.m.RUnlock()
+	if !ok {
+		log.Info("drop reply to unknown queue", zap.String("queue", d.topic), zap.String("correlation_id", d.options.CorrelationID))
+		return
+	}
+	r.resolve(d)
+}
+
+func (b *Broker) addPending(delta int) {
+	b.pm.Lock()
+	b.pending += delta
+	if b.pending <= 0 {
+		b.pc.Broadcast()
+	}
+	b.pm.Unlock()
+}
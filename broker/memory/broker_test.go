@@ -0,0 +1,755 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/dedup"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	errTest = errors.New("test error")
+)
+
+type recorder struct {
+	m    sync.Mutex
+	msgs []string
+}
+
+func (r *recorder) handle(msg *wrappers.StringValue) error {
+	r.m.Lock()
+	r.msgs = append(r.msgs, msg.Value)
+	r.m.Unlock()
+	return nil
+}
+
+func (r *recorder) values() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string(nil), r.msgs...)
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := NewMemoryBroker()
+
+	exact, wildcard, multi := &recorder{}, &recorder{}, &recorder{}
+	_, err := b.RegisterSubscribeHandler("exact", "user.created", exact.handle)
+	require.NoError(t, err)
+	_, err = b.RegisterSubscribeHandler("wildcard", "user.*", wildcard.handle)
+	require.NoError(t, err)
+	_, err = b.RegisterSubscribeHandler("multi", "#", multi.handle)
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "alice"}))
+
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("user.deleted", &wrappers.StringValue{Value: "bob"})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("order.paid.card", &wrappers.StringValue{Value: "carol"})))
+
+	b.Wait()
+	assert.Equal(t, []string{"alice"}, exact.values())
+	assert.ElementsMatch(t, []string{"alice", "bob"}, wildcard.values())
+	assert.ElementsMatch(t, []string{"alice", "bob", "carol"}, multi.values())
+}
+
+func TestPublishErrors(t *testing.T) {
+	b := NewMemoryBroker()
+
+	p, err := b.TopicPublisher("nobody.listen")
+	require.NoError(t, err)
+	assert.Equal(t, ErrMessageIsNotProtoMessage, p.Publish("text"))
+	assert.NoError(t, p.Publish(&wrappers.StringValue{}))
+
+	rp, err := b.TopicPublisher("nobody.listen", broker.Reliable())
+	require.NoError(t, err)
+	assert.Equal(t, ErrPublishMessageMiss, rp.Publish(&wrappers.StringValue{}))
+
+	_, err = b.RegisterSubscribeHandler("invalid", "test", func(string) error { return nil })
+	assert.Equal(t, broker.ErrInvalidHandler, err)
+}
+
+func TestReliableRetryAndDeadLetter(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m       sync.Mutex
+		retries []int
+	)
+	_, err := b.RegisterSubscribeHandler("retry", "task", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		m.Lock()
+		defer m.Unlock()
+		retries = append(retries, broker.RetryCount(meta.Headers))
+		return errTest
+	}, broker.Reliable(), broker.MaxRetry(3), broker.RetryBackoff(broker.ExponentialBackoff(time.Millisecond, 4*time.Millisecond)))
+	require.NoError(t, err)
+
+	dead := &recorder{}
+	_, err = b.RegisterErrSubscribeHandler("dead", "error.#", dead.handle)
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("task", broker.Reliable())
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "poison"}))
+
+	b.Wait()
+	assert.Equal(t, []int{0, 1, 2, 3}, retries)
+	assert.Equal(t, []string{"poison"}, dead.values())
+}
+
+func TestUnreliableDropFailure(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m     sync.Mutex
+		calls int
+	)
+	_, err := b.RegisterSubscribeHandler("drop", "task", func(msg *wrappers.StringValue) error {
+		m.Lock()
+		defer m.Unlock()
+		calls++
+		return errTest
+	}, broker.MaxRetry(3))
+	require.NoError(t, err)
+
+	dead := &recorder{}
+	_, err = b.RegisterErrSubscribeHandler("dead", "error.#", dead.handle)
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("task")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "lost"}))
+
+	b.Wait()
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, dead.values())
+}
+
+func TestCompetingConsumers(t *testing.T) {
+	b := NewMemoryBroker()
+
+	r := &recorder{}
+	_, err := b.RegisterSubscribeHandler("shared", "job", r.handle)
+	require.NoError(t, err)
+	_, err = b.RegisterSubscribeHandler("shared", "job", r.handle)
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("job")
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, p.Publish(&wrappers.StringValue{Value: "job"}))
+	}
+
+	b.Wait()
+	assert.Len(t, r.values(), 10)
+}
+
+func TestPublishContext(t *testing.T) {
+	b := NewMemoryBroker()
+
+	r := &recorder{}
+	_, err := b.RegisterSubscribeHandler("ctx", "ctx", r.handle)
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("ctx")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, p.PublishContext(ctx, &wrappers.StringValue{Value: "sent"}, broker.MessageID("1")))
+	cancel()
+	assert.Equal(t, context.Canceled, p.PublishContext(ctx, &wrappers.StringValue{Value: "cancelled"}))
+
+	b.Wait()
+	assert.Equal(t, []string{"sent"}, r.values())
+}
+
+func TestHandlerWithMetadata(t *testing.T) {
+	b := NewMemoryBroker()
+
+	metas := make(chan broker.Metadata, 1)
+	_, err := b.RegisterSubscribeHandler("meta", "meta.*", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		if _, ok := ctx.Deadline(); !ok {
+			return errTest
+		}
+		metas <- meta
+		return nil
+	}, broker.Timeout(time.Second))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("meta.created")
+	require.NoError(t, err)
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "meta"},
+		broker.MessageID("id"), broker.CorrelationID("cid"), broker.Header("tenant", "ankr")))
+
+	b.Wait()
+	meta := <-metas
+	assert.Equal(t, "meta.created", meta.Topic)
+	assert.Equal(t, "id", meta.MessageID)
+	assert.Equal(t, "cid", meta.CorrelationID)
+	assert.Equal(t, "ankr", meta.Headers["tenant"])
+	assert.False(t, meta.Redelivered)
+}
+
+func TestConcurrency(t *testing.T) {
+	b := NewMemoryBroker()
+
+	const workers = 4
+	started := make(chan struct{}, workers)
+	release := make(chan struct{})
+	_, err := b.RegisterSubscribeHandler("concurrent", "slow", func(msg *wrappers.StringValue) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}, broker.Concurrency(workers))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("slow")
+	require.NoError(t, err)
+	for i := 0; i < workers; i++ {
+		require.NoError(t, p.Publish(&wrappers.StringValue{}))
+	}
+
+	for i := 0; i < workers; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatalf("expect %d messages handled concurrently but %d", workers, i)
+		}
+	}
+	close(release)
+	b.Wait()
+}
+
+func TestUnsubscribeAndClose(t *testing.T) {
+	b := NewMemoryBroker()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var handled int32
+	sub, err := b.RegisterSubscribeHandler("drain", "drain", func(msg *wrappers.StringValue) error {
+		started <- struct{}{}
+		<-release
+		atomic.AddInt32(&handled, 1)
+		return nil
+	})
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("drain")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "in-flight"}))
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "queued"}))
+	<-started
+
+	// unsubscribe wait the in-flight message and leave the queued one
+	done := make(chan error)
+	go func() {
+		done <- sub.Unsubscribe(context.Background())
+	}()
+	for !sub.(*consumer).isStopped() {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	require.NoError(t, <-done)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&handled))
+
+	// a new subscription on the same queue take the queued message
+	r := &recorder{}
+	_, err = b.RegisterSubscribeHandler("drain", "drain", r.handle)
+	require.NoError(t, err)
+	b.Wait()
+	assert.Equal(t, []string{"queued"}, r.values())
+
+	require.NoError(t, b.Close(context.Background()))
+	assert.Equal(t, broker.ErrClosed, b.Close(context.Background()))
+	_, err = b.RegisterSubscribeHandler("closed", "closed", r.handle)
+	assert.Equal(t, broker.ErrClosed, err)
+}
+
+func TestCloseTimeout(t *testing.T) {
+	b := NewMemoryBroker()
+
+	started := make(chan struct{})
+	cancelled := make(chan struct{})
+	_, err := b.RegisterSubscribeHandler("stuck", "stuck", func(ctx context.Context, msg *wrappers.StringValue) error {
+		close(started)
+		<-ctx.Done()
+		close(cancelled)
+		return ctx.Err()
+	})
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("stuck")
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{}))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, b.Close(ctx))
+	<-cancelled
+}
+
+func TestBatchPublisher(t *testing.T) {
+	b := NewMemoryBroker()
+
+	r := &recorder{}
+	_, err := b.RegisterSubscribeHandler("batch", "batch.*", r.handle)
+	require.NoError(t, err)
+
+	p, err := b.BatchPublisher()
+	require.NoError(t, err)
+
+	msgs := []*broker.Message{
+		broker.NewMessage("batch.a", &wrappers.StringValue{Value: "a"}),
+		broker.NewMessage("nobody.listen", &wrappers.StringValue{Value: "miss"}),
+		broker.NewMessage("batch.b", &wrappers.StringValue{Value: "b"}),
+	}
+	var statuses []broker.PublishStatus
+	for result := range p.PublishBatch(context.Background(), msgs) {
+		statuses = append(statuses, result.Status)
+	}
+	assert.Equal(t, []broker.PublishStatus{broker.PublishAcked, broker.PublishReturned, broker.PublishAcked}, statuses)
+
+	future := p.PublishAsync(context.Background(), msgs[0], broker.MessageID("async"))
+	<-future.Done()
+	assert.Equal(t, "async", future.Result().MessageID)
+	assert.NoError(t, future.Result().Err)
+
+	b.Wait()
+	assert.ElementsMatch(t, []string{"a", "b", "a"}, r.values())
+}
+
+func TestDedup(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m     sync.Mutex
+		calls []string
+	)
+	store := dedup.NewLRUStore(10)
+	_, err := b.RegisterSubscribeHandler("dedup", "dedup", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		m.Lock()
+		defer m.Unlock()
+		calls = append(calls, msg.Value)
+		if msg.Value == "flaky" && broker.RetryCount(meta.Headers) == 0 {
+			return errTest
+		}
+		return nil
+	}, broker.Reliable(), broker.MaxRetry(1), broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)), broker.Dedup(store))
+	require.NoError(t, err)
+
+	other := &recorder{}
+	_, err = b.RegisterSubscribeHandler("other", "dedup", other.handle, broker.Dedup(store))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("dedup")
+	require.NoError(t, err)
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "once"}, broker.MessageID("1")))
+	b.Wait()
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "once"}, broker.MessageID("1")))
+	b.Wait()
+	// a failed message is released and handled again on retry
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "flaky"}, broker.MessageID("2")))
+	b.Wait()
+	// without message id
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "anonymous"}))
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "anonymous"}))
+	b.Wait()
+
+	assert.Equal(t, []string{"once", "flaky", "flaky", "anonymous", "anonymous"}, calls)
+	// ids are deduplicated per subscription
+	assert.Equal(t, []string{"once", "flaky", "anonymous", "anonymous"}, other.values())
+}
+
+func TestDedupInProgress(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var calls int32
+	store := dedup.NewLRUStore(10)
+	_, err := b.RegisterSubscribeHandler("held", "dedup", func(msg *wrappers.StringValue) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}, broker.Reliable(), broker.MaxRetry(1), broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)), broker.Dedup(store))
+	require.NoError(t, err)
+
+	// another consumer claimed the message, and hold it far longer than MaxRetry×backoff
+	key := broker.DedupKey("held", "1")
+	claimed, err := store.Claim(context.Background(), key)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	p, err := b.TopicPublisher("dedup")
+	require.NoError(t, err)
+	require.NoError(t, p.PublishContext(context.Background(), &wrappers.StringValue{Value: "held"}, broker.MessageID("1")))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	// the claim expired, the message is neither dead-lettered nor dropped
+	require.NoError(t, store.Release(context.Background(), key))
+	b.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string {
+	return "text/plain"
+}
+
+func (textCodec) Marshal(m proto.Message) ([]byte, error) {
+	return []byte(m.(*wrappers.StringValue).Value), nil
+}
+
+func (textCodec) Unmarshal(data []byte, m proto.Message) error {
+	m.(*wrappers.StringValue).Value = string(data)
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m      sync.Mutex
+		values []string
+	)
+	_, err := b.RegisterSubscribeHandler("codec", "codec", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		m.Lock()
+		defer m.Unlock()
+		values = append(values, meta.ContentType+":"+msg.Value)
+		return nil
+	}, broker.Reliable())
+	require.NoError(t, err)
+
+	for _, c := range []broker.Codec{broker.ProtoCodec, broker.ProtoJSONCodec, broker.JSONCodec} {
+		p, err := b.TopicPublisher("codec", broker.UseCodec(c))
+		require.NoError(t, err)
+		require.NoError(t, p.Publish(&wrappers.StringValue{Value: "v"}))
+	}
+	b.Wait()
+	assert.ElementsMatch(t, []string{"application/protobuf:v", "application/protojson:v", "application/json:v"}, values)
+
+	// the subscription does not understand text/plain, the message is dead-lettered with its content type
+	b.m.Lock()
+	dlq := b.declare("dlq", exchangeDLX, "error.#")
+	b.m.Unlock()
+
+	p, err := b.TopicPublisher("codec", broker.UseCodec(textCodec{}))
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "text"}))
+	assert.Eventually(t, func() bool {
+		dlq.m.Lock()
+		defer dlq.m.Unlock()
+		return len(dlq.items) == 1 && dlq.items[0].contentType == "text/plain"
+	}, time.Second, time.Millisecond)
+	assert.Len(t, values, 3)
+}
+
+func TestRouter(t *testing.T) {
+	b := NewMemoryBroker()
+
+	users, orders, others := &recorder{}, &recorder{}, &recorder{}
+	var amounts []int64
+	_, err := b.RegisterRouter("router", map[string]interface{}{
+		"user.*": users.handle,
+		"order.paid": func(msg *wrappers.Int64Value) error {
+			amounts = append(amounts, msg.Value)
+			return nil
+		},
+		"order.#": orders.handle,
+	}, broker.Fallback(others.handle), broker.Reliable())
+	require.NoError(t, err)
+
+	dead := &recorder{}
+	_, err = b.RegisterErrSubscribeHandler("dead", "error.router", dead.handle)
+	require.NoError(t, err)
+
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("user.created", &wrappers.StringValue{Value: "alice"})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("order.paid", &wrappers.Int64Value{Value: 100})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("order.refund.partial", &wrappers.StringValue{Value: "refund"})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("task.done", &wrappers.StringValue{Value: "task"})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("unbound", &wrappers.StringValue{Value: "unbound"})))
+	b.Wait()
+
+	assert.Equal(t, []string{"alice"}, users.values())
+	assert.Equal(t, []int64{100}, amounts)
+	assert.Equal(t, []string{"refund"}, orders.values())
+	// the fallback binds every topic
+	assert.Equal(t, []string{"task", "unbound"}, others.values())
+	assert.Empty(t, dead.values())
+
+	// without fallback the topics matching no route are not received
+	users = &recorder{}
+	_, err = b.RegisterRouter("router.nofallback", map[string]interface{}{"user.*": users.handle}, broker.Reliable())
+	require.NoError(t, err)
+	_, err = b.RegisterErrSubscribeHandler("dead.nofallback", "error.router.nofallback", dead.handle)
+	require.NoError(t, err)
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("task.done", &wrappers.StringValue{Value: "task"})))
+	b.Wait()
+	assert.Empty(t, users.values())
+	assert.Empty(t, dead.values())
+
+	_, err = b.RegisterRouter("empty", nil)
+	assert.Equal(t, broker.ErrNoRoute, err)
+}
+
+func TestRequestReply(t *testing.T) {
+	b := NewMemoryBroker()
+
+	_, err := b.RegisterResponder("echo", "rpc.echo", func(ctx context.Context, req *wrappers.StringValue) (*wrappers.StringValue, error) {
+		if req.Value == "fail" {
+			return nil, errTest
+		}
+		return &wrappers.StringValue{Value: "echo " + req.Value}, nil
+	})
+	require.NoError(t, err)
+
+	r, err := b.Requester()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	resp := &wrappers.StringValue{}
+	require.NoError(t, r.Request(ctx, "rpc.echo", &wrappers.StringValue{Value: "alice"}, resp))
+	assert.Equal(t, "echo alice", resp.Value)
+
+	// replies are encoded as the requests
+	jr, err := b.Requester(broker.UseCodec(broker.ProtoJSONCodec))
+	require.NoError(t, err)
+	require.NoError(t, jr.Request(ctx, "rpc.echo", &wrappers.StringValue{Value: "bob"}, resp))
+	assert.Equal(t, "echo bob", resp.Value)
+
+	err = r.Request(ctx, "rpc.echo", &wrappers.StringValue{Value: "fail"}, resp)
+	var remote *broker.RemoteError
+	require.True(t, errors.As(err, &remote))
+	assert.Equal(t, errTest.Error(), remote.Message)
+
+	assert.Equal(t, ErrPublishMessageMiss, r.Request(ctx, "rpc.missing", &wrappers.StringValue{}, resp))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	b := NewMemoryBroker()
+
+	release := make(chan struct{})
+	replied := make(chan struct{})
+	_, err := b.RegisterResponder("slow", "rpc.slow", func(ctx context.Context, req *wrappers.StringValue) (*wrappers.StringValue, error) {
+		<-release
+		return req, nil
+	})
+	require.NoError(t, err)
+
+	r, err := b.Requester()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = r.Request(ctx, "rpc.slow", &wrappers.StringValue{Value: "late"}, &wrappers.StringValue{})
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// the late reply is orphaned and dropped
+	rq := r.(*requester)
+	rq.m.Lock()
+	assert.Empty(t, rq.pending)
+	rq.m.Unlock()
+	go func() {
+		b.Wait()
+		close(replied)
+	}()
+	close(release)
+	<-replied
+}
+
+func TestDelayedPublish(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m       sync.Mutex
+		elapsed = map[string]time.Duration{}
+	)
+	start := time.Now()
+	rec := &recorder{}
+	_, err := b.RegisterSubscribeHandler("delay", "delay.test", func(msg *wrappers.StringValue) error {
+		m.Lock()
+		elapsed[msg.Value] = time.Since(start)
+		m.Unlock()
+		return rec.handle(msg)
+	})
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("delay.test", broker.Reliable())
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, p.PublishContext(ctx, &wrappers.StringValue{Value: "later"}, broker.DeliverAfter(100*time.Millisecond)))
+	require.NoError(t, p.PublishContext(ctx, &wrappers.StringValue{Value: "now"}, broker.DeliverAt(time.Now().Add(-time.Second))))
+	assert.Equal(t, broker.ErrDelayedExpiration,
+		p.PublishContext(ctx, &wrappers.StringValue{}, broker.DeliverAfter(time.Second), broker.Expiration(time.Second)))
+
+	b.Wait()
+	assert.Equal(t, []string{"now", "later"}, rec.values())
+	m.Lock()
+	assert.True(t, elapsed["later"] >= 100*time.Millisecond, elapsed["later"])
+	m.Unlock()
+}
+
+func TestMiddlewareAndPanic(t *testing.T) {
+	b := NewMemoryBroker()
+
+	var (
+		m      sync.Mutex
+		topics []string
+		errs   []error
+	)
+	record := func(ctx context.Context, msg proto.Message, meta broker.Metadata, next broker.HandlerFunc) error {
+		err := next(ctx, msg, meta)
+		m.Lock()
+		topics = append(topics, meta.Topic)
+		errs = append(errs, err)
+		m.Unlock()
+		return err
+	}
+	rec := &recorder{}
+	_, err := b.RegisterSubscribeHandler("panic", "panic.*", func(msg *wrappers.StringValue) error {
+		if msg.Value == "boom" {
+			panic(msg.Value)
+		}
+		return rec.handle(msg)
+	}, broker.Reliable(), broker.Middleware(record))
+	require.NoError(t, err)
+	dead := &recorder{}
+	_, err = b.RegisterErrSubscribeHandler("panic.dlq", "error.panic.*", dead.handle)
+	require.NoError(t, err)
+
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("panic.a", &wrappers.StringValue{Value: "boom"})))
+	require.NoError(t, mp.PublishMessage(broker.NewMessage("panic.b", &wrappers.StringValue{Value: "ok"})))
+	b.Wait()
+
+	// the consumer survives the panic, the panicked message is dead-lettered
+	assert.Equal(t, []string{"ok"}, rec.values())
+	assert.Equal(t, []string{"boom"}, dead.values())
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, []string{"panic.a", "panic.b"}, topics)
+	assert.IsType(t, &broker.PanicError{}, errs[0])
+	assert.NoError(t, errs[1])
+}
+
+func TestPublisherMiddleware(t *testing.T) {
+	b := NewMemoryBroker()
+
+	tenants := make(chan string, 2)
+	_, err := b.RegisterSubscribeHandler("tenant", "tenant", func(ctx context.Context, msg *wrappers.StringValue) error {
+		tenant, _ := broker.TenantFromContext(ctx)
+		tenants <- tenant
+		return nil
+	}, broker.Middleware(broker.ExtractContext(broker.TenantPropagator)))
+	require.NoError(t, err)
+
+	inject := broker.PublishMiddleware(broker.InjectContext(broker.TenantPropagator))
+	p, err := b.TopicPublisher("tenant", inject)
+	require.NoError(t, err)
+	bp, err := b.BatchPublisher(inject)
+	require.NoError(t, err)
+
+	ctx := broker.NewTenantContext(context.Background(), "ankr")
+	require.NoError(t, p.PublishContext(ctx, &wrappers.StringValue{}))
+	require.NoError(t, bp.PublishAsync(ctx, broker.NewMessage("tenant", &wrappers.StringValue{})).Result().Err)
+	b.Wait()
+
+	assert.Equal(t, "ankr", <-tenants)
+	assert.Equal(t, "ankr", <-tenants)
+}
+
+func TestQuarantine(t *testing.T) {
+	b := NewMemoryBroker()
+
+	_, err := b.RegisterSubscribeHandler("audit", "user.created", func(msg *wrappers.StringValue) error {
+		return errTest
+	}, broker.Reliable(), broker.MaxRetry(1), broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)))
+	require.NoError(t, err)
+
+	var (
+		m        sync.Mutex
+		attempts int
+		dead     *broker.DeadLetter
+	)
+	_, err = b.RegisterErrSubscribeHandler("quarantine", "error.#", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		m.Lock()
+		defer m.Unlock()
+		// a failed error handler get the message again instead of losing it
+		if attempts++; attempts < 3 {
+			return errTest
+		}
+		dead = broker.DeadLetterOf(meta)
+		return nil
+	}, broker.RetryBackoff(broker.FixedBackoff(time.Millisecond)))
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created", broker.Reliable())
+	require.NoError(t, err)
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "poison"}))
+
+	b.Wait()
+	m.Lock()
+	defer m.Unlock()
+	assert.Equal(t, 3, attempts)
+	require.NotNil(t, dead)
+	assert.Equal(t, "user.created", dead.OriginalTopic)
+	assert.Equal(t, "audit", dead.Subscription)
+	assert.Equal(t, errTest.Error(), dead.Reason)
+}
+
+func TestSchemas(t *testing.T) {
+	b := NewMemoryBroker()
+	schemas := broker.NewSchemaRegistry()
+	require.NoError(t, schemas.Register("user.created", 1, &wrappers.StringValue{}))
+
+	_, err := b.RegisterSubscribeHandler("audit", "user.*", func(msg *wrappers.Int64Value) error {
+		return nil
+	}, broker.Schemas(schemas))
+	assert.True(t, errors.Is(err, broker.ErrSchemaMismatch))
+
+	metas := make(chan broker.Metadata, 1)
+	_, err = b.RegisterSubscribeHandler("audit", "user.created", func(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+		metas <- meta
+		return nil
+	}, broker.Reliable(), broker.Schemas(schemas))
+	require.NoError(t, err)
+	var dead *broker.DeadLetter
+	_, err = b.RegisterErrSubscribeHandler("quarantine", "error.user.created", func(ctx context.Context, msg *wrappers.Int64Value, meta broker.Metadata) error {
+		dead = broker.DeadLetterOf(meta)
+		return nil
+	})
+	require.NoError(t, err)
+
+	p, err := b.TopicPublisher("user.created", broker.Schemas(schemas))
+	require.NoError(t, err)
+	assert.True(t, errors.Is(p.Publish(&wrappers.Int64Value{Value: 1}), broker.ErrSchemaMismatch))
+	require.NoError(t, p.Publish(&wrappers.StringValue{Value: "alice"}))
+	b.Wait()
+	meta := <-metas
+	assert.Equal(t, "google.protobuf.StringValue", meta.Type)
+	assert.Equal(t, "v1", meta.Headers[broker.SchemaVersionHeader])
+
+	// a publisher unaware of the schemas can't reach the handler with another type
+	unchecked, err := b.TopicPublisher("user.created")
+	require.NoError(t, err)
+	require.NoError(t, unchecked.Publish(&wrappers.Int64Value{Value: 1}))
+	b.Wait()
+	assert.Empty(t, metas)
+	require.NotNil(t, dead)
+	assert.Contains(t, dead.Reason, broker.ErrSchemaMismatch.Error())
+}
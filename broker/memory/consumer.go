@@ -0,0 +1,147 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// consumer is the workers of a subscription, it is the broker.Subscription as well
+type consumer struct {
+	broker     *Broker
+	name       string
+	queue      *queue
+	router     *broker.Router
+	middleware broker.SubscriberMiddleware
+	dedup      broker.DedupStore
+	codec      broker.Codec
+	schemas    *broker.SchemaRegistry
+	reliable   bool
+	maxRetry   int
+	backoff    broker.Backoff
+	timeout    time.Duration
+	errTopic   string
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	stopped int32
+}
+
+func (c *consumer) Unsubscribe(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&c.stopped, 0, 1) {
+		return nil
+	}
+	defer c.broker.removeConsumer(c)
+	c.queue.wake()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	c.cancel()
+	return err
+}
+
+func (c *consumer) isStopped() bool {
+	return atomic.LoadInt32(&c.stopped) == 1
+}
+
+func (c *consumer) consume() {
+	defer c.wg.Done()
+	for {
+		d := c.queue.pop(c.isStopped)
+		if d == nil {
+			return
+		}
+		c.handle(d)
+	}
+}
+
+func (c *consumer) handle(d *delivery) {
+	if d.expired() {
+		c.broker.addPending(-1)
+		return
+	}
+
+	meta := d.metadata()
+	fn, err := c.router.Route(meta.Topic)
+	if err != nil {
+		log.Error("route message error, reject it", zap.Error(err), zap.String("topic", d.topic), zap.String("queue", c.name))
+		c.deadLetter(d, err)
+		return
+	}
+
+	if err := c.schemas.CheckType(meta, fn); err != nil {
+		log.Error("message type mismatch, reject it", zap.Error(err), zap.String("topic", d.topic), zap.String("queue", c.name))
+		c.deadLetter(d, err)
+		return
+	}
+
+	msg := fn.NewMessage()
+	if err := broker.Decode(c.codec, d.contentType, d.body, msg); err != nil {
+		log.Error("decode message error, reject it", zap.Error(err), zap.String("topic", d.topic), zap.ByteString("body", d.body))
+		c.deadLetter(d, err)
+		return
+	}
+
+	ctx, cancel := broker.NewHandleContext(c.ctx, meta, c.timeout)
+	err = broker.Dispatch(ctx, c.middleware, c.dedup, c.name, fn, msg, meta)
+	cancel()
+	if err != nil {
+		if c.reliable && errors.Is(err, broker.ErrInProgress) {
+			// another consumer hold the claim, the redelivery is not an attempt
+			c.delay(d, c.backoff(d.retries+1))
+			return
+		}
+		if c.reliable && d.retries < c.maxRetry {
+			c.retry(d)
+			return
+		}
+		c.deadLetter(d, err)
+		return
+	}
+
+	c.broker.addPending(-1)
+}
+
+func (c *consumer) retry(d *delivery) {
+	d.retries++
+	c.delay(d, c.backoff(d.retries))
+}
+
+func (c *consumer) delay(d *delivery, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		c.queue.push(d)
+	})
+}
+
+// deadLetter route the failed delivery to DLX like a quarantined message in a reliable RabbitMQ queue,
+// cause and the original topic are stamped into headers
+func (c *consumer) deadLetter(d *delivery, cause error) {
+	if c.reliable && c.errTopic != "" {
+		options := *d.options
+		options.Headers = broker.DeadLetterHeaders(d.metadata().Headers, d.topic, c.name, cause)
+		dead := &delivery{
+			topic:       c.errTopic,
+			contentType: d.contentType,
+			body:        d.body,
+			options:     &options,
+			timestamp:   d.timestamp,
+		}
+		c.broker.route(exchangeDLX, dead)
+	}
+	c.broker.addPending(-1)
+}
@@ -0,0 +1,7 @@
+package memory
+
+import (
+	"github.com/Ankr-network/kit/mlog"
+)
+
+var log = mlog.Logger("broker")
@@ -0,0 +1,90 @@
+package memory
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"time"
+)
+
+type publisher struct {
+	broker     *Broker
+	topic      string
+	reliable   bool
+	codec      broker.Codec
+	middleware broker.PublisherMiddleware
+	schemas    *broker.SchemaRegistry
+}
+
+func (p *publisher) Publish(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return ErrMessageIsNotProtoMessage
+	}
+	return p.PublishContext(context.Background(), msg)
+}
+
+func (p *publisher) PublishContext(ctx context.Context, m proto.Message, opts ...broker.PublishOption) error {
+	return p.PublishMessageContext(ctx, &broker.Message{
+		Topic: p.topic,
+		Value: m,
+	}, opts...)
+}
+
+func (p *publisher) PublishMessage(msg *broker.Message) error {
+	return p.PublishMessageContext(context.Background(), msg)
+}
+
+func (p *publisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	return broker.InterceptPublish(ctx, p.middleware, msg, broker.NewPublishOptions(p.reliable, opts...), p.publish)
+}
+
+func (p *publisher) publish(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := p.schemas.CheckPublish(msg.Topic, msg.Value, options); err != nil {
+		return err
+	}
+
+	body, err := p.codec.Marshal(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	d := &delivery{
+		topic:       msg.Topic,
+		contentType: p.codec.ContentType(),
+		body:        body,
+		options:     options,
+		timestamp:   time.Now(),
+	}
+	if delay := d.options.Delay(); delay > 0 {
+		if d.options.Expiration > 0 {
+			return broker.ErrDelayedExpiration
+		}
+		p.broker.delay(d, delay)
+		return nil
+	}
+	if d.options.Expiration > 0 {
+		d.expireAt = time.Now().Add(d.options.Expiration)
+	}
+
+	if p.broker.route(exchangeTopic, d) == 0 && p.reliable {
+		return ErrPublishMessageMiss
+	}
+	return nil
+}
+
+// PublishAsync route msg synchronously, the returned future is already done
+func (p *publisher) PublishAsync(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) broker.PublishFuture {
+	options := broker.NewPublishOptions(p.reliable, opts...)
+	err := p.PublishMessageContext(ctx, msg, opts...)
+	return broker.CompletedFuture(broker.NewPublishResult(msg, options.MessageID, err))
+}
+
+func (p *publisher) PublishBatch(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) <-chan broker.PublishResult {
+	return broker.PublishBatch(ctx, msgs, func(ctx context.Context, msg *broker.Message) broker.PublishFuture {
+		return p.PublishAsync(ctx, msg, opts...)
+	})
+}
@@ -0,0 +1,95 @@
+package memory
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"sync"
+	"time"
+)
+
+type delivery struct {
+	topic       string
+	contentType string
+	body        []byte
+	options     *broker.PublishOptions
+	timestamp   time.Time
+	expireAt    time.Time
+	retries     int
+}
+
+func (d *delivery) metadata() broker.Metadata {
+	headers := d.options.Headers
+	if d.retries > 0 {
+		headers = map[string]interface{}{}
+		for k, v := range d.options.Headers {
+			headers[k] = v
+		}
+		headers[broker.RetryCountHeader] = int32(d.retries)
+	}
+	return broker.Metadata{
+		Topic:         d.topic,
+		MessageID:     d.options.MessageID,
+		CorrelationID: d.options.CorrelationID,
+		ReplyTo:       d.options.ReplyTo,
+		ContentType:   d.contentType,
+		Type:          d.options.Type,
+		Headers:       headers,
+		Timestamp:     d.timestamp,
+	}
+}
+
+func (d *delivery) expired() bool {
+	return !d.expireAt.IsZero() && time.Now().After(d.expireAt)
+}
+
+func (d *delivery) clone() *delivery {
+	out := *d
+	return &out
+}
+
+// queue is an unbounded FIFO shared by the competing consumers registered with the same name
+type queue struct {
+	name string
+
+	m     sync.Mutex
+	c     *sync.Cond
+	items []*delivery
+}
+
+func newQueue(name string) *queue {
+	out := &queue{name: name}
+	out.c = sync.NewCond(&out.m)
+	return out
+}
+
+func (q *queue) push(d *delivery) {
+	q.m.Lock()
+	q.items = append(q.items, d)
+	q.m.Unlock()
+	q.c.Broadcast()
+}
+
+// pop block until a delivery available, return nil once stopped
+func (q *queue) pop(stopped func() bool) *delivery {
+	q.m.Lock()
+	defer q.m.Unlock()
+	for {
+		if stopped() {
+			return nil
+		}
+		if len(q.items) > 0 {
+			break
+		}
+		q.c.Wait()
+	}
+	out := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return out
+}
+
+// wake up the blocked consumers to check whether they are stopped
+func (q *queue) wake() {
+	q.m.Lock()
+	q.c.Broadcast()
+	q.m.Unlock()
+}
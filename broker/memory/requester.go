@@ -0,0 +1,125 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// requester own an exclusive reply queue, replies are correlated to the pending requests by correlation id
+type requester struct {
+	broker     *Broker
+	codec      broker.Codec
+	middleware broker.PublisherMiddleware
+	schemas    *broker.SchemaRegistry
+	queue      string
+
+	m       sync.Mutex
+	pending map[string]chan *delivery
+}
+
+func (r *requester) Request(ctx context.Context, topic string, req, resp proto.Message, opts ...broker.PublishOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	correlationID := uuid.New().String()
+	replyCh := make(chan *delivery, 1)
+	r.m.Lock()
+	r.pending[correlationID] = replyCh
+	r.m.Unlock()
+	defer func() {
+		r.m.Lock()
+		delete(r.pending, correlationID)
+		r.m.Unlock()
+	}()
+
+	err := broker.InterceptPublish(ctx, r.middleware, broker.NewMessage(topic, req), broker.NewPublishOptions(true, opts...),
+		func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+			return r.publish(ctx, msg, options, correlationID)
+		})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replyCh:
+		if err := broker.ReplyError(reply.options.Headers); err != nil {
+			return err
+		}
+		return broker.Decode(r.codec, reply.contentType, reply.body, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *requester) publish(ctx context.Context, msg *broker.Message, options *broker.PublishOptions, correlationID string) error {
+	if err := r.schemas.CheckPublish(msg.Topic, msg.Value, options); err != nil {
+		return err
+	}
+	body, err := r.codec.Marshal(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	options.CorrelationID = correlationID
+	options.ReplyTo = r.queue
+	if options.MessageID == "" {
+		options.MessageID = uuid.New().String()
+	}
+	d := &delivery{
+		topic:       msg.Topic,
+		contentType: r.codec.ContentType(),
+		body:        body,
+		options:     options,
+		timestamp:   time.Now(),
+	}
+	if expiration := broker.RequestExpiration(ctx); expiration > 0 {
+		d.options.Expiration = expiration
+		d.expireAt = time.Now().Add(expiration)
+	}
+
+	if r.broker.route(exchangeTopic, d) == 0 {
+		return ErrPublishMessageMiss
+	}
+	return nil
+}
+
+// resolve deliver the reply to the pending request, a reply of a finished request is dropped
+func (r *requester) resolve(reply *delivery) {
+	r.m.Lock()
+	replyCh, ok := r.pending[reply.options.CorrelationID]
+	delete(r.pending, reply.options.CorrelationID)
+	r.m.Unlock()
+	if !ok {
+		log.Info("drop orphaned reply", zap.String("queue", r.queue), zap.String("correlation_id", reply.options.CorrelationID))
+		return
+	}
+	replyCh <- reply
+}
+
+// newReply create the reply to the request meta with the result of a responder
+func newReply(codec broker.Codec, meta broker.Metadata, resp proto.Message, err error) (*delivery, error) {
+	var body []byte
+	if err == nil && resp != nil {
+		var marshalErr error
+		if body, marshalErr = codec.Marshal(resp); marshalErr != nil {
+			return nil, fmt.Errorf("marshal reply error: %w", marshalErr)
+		}
+	}
+	return &delivery{
+		topic:       meta.ReplyTo,
+		contentType: codec.ContentType(),
+		body:        body,
+		options: &broker.PublishOptions{
+			Headers:       broker.ReplyHeaders(err),
+			CorrelationID: meta.CorrelationID,
+		},
+		timestamp: time.Now(),
+	}, nil
+}
@@ -0,0 +1,50 @@
+package broker
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/trace"
+	"time"
+)
+
+// Metadata is the delivery information of a consumed message
+type Metadata struct {
+	Topic         string
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	ContentType   string
+	Type          string
+	Headers       map[string]interface{}
+	Timestamp     time.Time
+	Redelivered   bool
+}
+
+type metadataKey struct{}
+
+// ContextWithMetadata return a copy of ctx carrying meta
+func ContextWithMetadata(ctx context.Context, meta Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, meta)
+}
+
+// GetMetadataFromContext return the metadata of the message being handled
+func GetMetadataFromContext(ctx context.Context) (Metadata, bool) {
+	out, ok := ctx.Value(metadataKey{}).(Metadata)
+	return out, ok
+}
+
+// NewHandleContext derive the context for handling a single message from the subscription context,
+// it carry meta, a consume span and the handle timeout if positive
+func NewHandleContext(parent context.Context, meta Metadata, timeout time.Duration) (context.Context, context.CancelFunc) {
+	span, ctx := trace.StartSpanFromContext(ContextWithMetadata(parent, meta), "broker.consume")
+	span.SetTag("message_bus.destination", meta.Topic)
+
+	cancel := func() {}
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	return ctx, func() {
+		cancel()
+		span.Finish()
+	}
+}
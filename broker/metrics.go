@@ -0,0 +1,66 @@
+package broker
+
+import "time"
+
+// HandleOutcome is what a consumer did with a delivery
+type HandleOutcome int
+
+const (
+	// HandleAcked handler succeeded
+	HandleAcked HandleOutcome = iota
+	// HandleRetried handler failed, the message is delayed for retry
+	HandleRetried
+	// HandleRequeued handler failed and the retry could not be scheduled, the message is requeued
+	HandleRequeued
+	// HandleNacked handler failed, the message is dead-lettered or dropped
+	HandleNacked
+	// HandleDecodeFailed the message cannot be decoded, it is dead-lettered or dropped without calling handler
+	HandleDecodeFailed
+	// HandleNoRoute no handler matches the topic, it is dead-lettered or dropped
+	HandleNoRoute
+)
+
+func (o HandleOutcome) String() string {
+	switch o {
+	case HandleAcked:
+		return "acked"
+	case HandleRetried:
+		return "retried"
+	case HandleRequeued:
+		return "requeued"
+	case HandleNacked:
+		return "nacked"
+	case HandleDecodeFailed:
+		return "decode_failed"
+	case HandleNoRoute:
+		return "no_route"
+	default:
+		return "unknown"
+	}
+}
+
+// MetricsRecorder record what a broker does, implementations must be safe for concurrent use and never block.
+// See package broker/metrics for the Prometheus and in-memory recorders.
+type MetricsRecorder interface {
+	// Published record a publishing to topic, latency is the time until confirmed if reliable, or until sent
+	Published(topic string, status PublishStatus, latency time.Duration)
+	// Handled record a delivery of topic consumed by subscription, duration is the time spent in handler
+	Handled(subscription, topic string, outcome HandleOutcome, duration time.Duration)
+	// Redelivered record a delivery redelivered to subscription, e.g. requeued after a consumer lost
+	Redelivered(subscription, topic string)
+	// QueueStat record the depth and number of consumers of a queue
+	QueueStat(queue string, messages, consumers int)
+}
+
+// NopMetrics discard everything
+var NopMetrics MetricsRecorder = nopMetrics{}
+
+type nopMetrics struct{}
+
+func (nopMetrics) Published(string, PublishStatus, time.Duration) {}
+
+func (nopMetrics) Handled(string, string, HandleOutcome, time.Duration) {}
+
+func (nopMetrics) Redelivered(string, string) {}
+
+func (nopMetrics) QueueStat(string, int, int) {}
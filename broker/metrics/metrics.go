@@ -0,0 +1,112 @@
+// Package metrics provides broker.MetricsRecorder implementations
+package metrics
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"sync"
+	"time"
+)
+
+var (
+	_ broker.MetricsRecorder = (*MemoryRecorder)(nil)
+	_ broker.MetricsRecorder = (*PrometheusRecorder)(nil)
+)
+
+// QueueStat is the last reported stat of a queue
+type QueueStat struct {
+	Messages  int
+	Consumers int
+}
+
+type publishKey struct {
+	topic  string
+	status broker.PublishStatus
+}
+
+type handleKey struct {
+	subscription string
+	outcome      broker.HandleOutcome
+}
+
+// MemoryRecorder keep counters in memory, useful for asserting in tests
+type MemoryRecorder struct {
+	m           sync.Mutex
+	published   map[publishKey]int
+	handled     map[handleKey]int
+	durations   map[string][]time.Duration
+	redelivered map[string]int
+	queues      map[string]QueueStat
+}
+
+func NewMemoryRecorder() *MemoryRecorder {
+	return &MemoryRecorder{
+		published:   map[publishKey]int{},
+		handled:     map[handleKey]int{},
+		durations:   map[string][]time.Duration{},
+		redelivered: map[string]int{},
+		queues:      map[string]QueueStat{},
+	}
+}
+
+func (r *MemoryRecorder) Published(topic string, status broker.PublishStatus, _ time.Duration) {
+	r.m.Lock()
+	r.published[publishKey{topic, status}]++
+	r.m.Unlock()
+}
+
+func (r *MemoryRecorder) Handled(subscription, _ string, outcome broker.HandleOutcome, duration time.Duration) {
+	r.m.Lock()
+	r.handled[handleKey{subscription, outcome}]++
+	if outcome != broker.HandleDecodeFailed && outcome != broker.HandleNoRoute {
+		r.durations[subscription] = append(r.durations[subscription], duration)
+	}
+	r.m.Unlock()
+}
+
+func (r *MemoryRecorder) Redelivered(subscription, _ string) {
+	r.m.Lock()
+	r.redelivered[subscription]++
+	r.m.Unlock()
+}
+
+func (r *MemoryRecorder) QueueStat(queue string, messages, consumers int) {
+	r.m.Lock()
+	r.queues[queue] = QueueStat{Messages: messages, Consumers: consumers}
+	r.m.Unlock()
+}
+
+// PublishCount return the number of publishings to topic with status
+func (r *MemoryRecorder) PublishCount(topic string, status broker.PublishStatus) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.published[publishKey{topic, status}]
+}
+
+// HandleCount return the number of deliveries consumed by subscription with outcome
+func (r *MemoryRecorder) HandleCount(subscription string, outcome broker.HandleOutcome) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.handled[handleKey{subscription, outcome}]
+}
+
+// HandleDurations return the durations of handler calls of subscription
+func (r *MemoryRecorder) HandleDurations(subscription string) []time.Duration {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]time.Duration(nil), r.durations[subscription]...)
+}
+
+// RedeliveryCount return the number of redeliveries to subscription
+func (r *MemoryRecorder) RedeliveryCount(subscription string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.redelivered[subscription]
+}
+
+// Queue return the last reported stat of queue
+func (r *MemoryRecorder) Queue(queue string) (QueueStat, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	stat, ok := r.queues[queue]
+	return stat, ok
+}
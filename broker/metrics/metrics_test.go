@@ -0,0 +1,62 @@
+package metrics
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemoryRecorder(t *testing.T) {
+	r := NewMemoryRecorder()
+	r.Published("user.created", broker.PublishAcked, time.Millisecond)
+	r.Published("user.created", broker.PublishAcked, time.Millisecond)
+	r.Published("user.created", broker.PublishReturned, time.Millisecond)
+	r.Handled("user", "user.created", broker.HandleAcked, time.Second)
+	r.Handled("user", "user.created", broker.HandleDecodeFailed, 0)
+	r.Redelivered("user", "user.created")
+	r.QueueStat("user", 3, 1)
+
+	assert.Equal(t, 2, r.PublishCount("user.created", broker.PublishAcked))
+	assert.Equal(t, 1, r.PublishCount("user.created", broker.PublishReturned))
+	assert.Equal(t, 0, r.PublishCount("user.created", broker.PublishNacked))
+	assert.Equal(t, 1, r.HandleCount("user", broker.HandleAcked))
+	assert.Equal(t, 1, r.HandleCount("user", broker.HandleDecodeFailed))
+	// decode failures never reach handler
+	assert.Equal(t, []time.Duration{time.Second}, r.HandleDurations("user"))
+	assert.Equal(t, 1, r.RedeliveryCount("user"))
+
+	stat, ok := r.Queue("user")
+	assert.True(t, ok)
+	assert.Equal(t, QueueStat{Messages: 3, Consumers: 1}, stat)
+	_, ok = r.Queue("missing")
+	assert.False(t, ok)
+}
+
+func TestPrometheusRecorder(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	r, err := NewPrometheusRecorder(registry, "test")
+	require.NoError(t, err)
+
+	r.Published("user.created", broker.PublishAcked, time.Millisecond)
+	r.Published("user.created", broker.PublishFailed, 0)
+	r.Handled("user", "user.created", broker.HandleRetried, time.Second)
+	r.Redelivered("user", "user.created")
+	r.QueueStat("user", 3, 1)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.published.WithLabelValues("user.created", "acked")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.published.WithLabelValues("user.created", "failed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.handled.WithLabelValues("user", "user.created", "retried")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.redelivered.WithLabelValues("user", "user.created")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(r.queueMessages.WithLabelValues("user")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(r.queueConsumers.WithLabelValues("user")))
+	// failed publishing is not observed for latency
+	assert.Equal(t, 1, testutil.CollectAndCount(r.publishDuration))
+
+	// collectors can be registered only once
+	_, err = NewPrometheusRecorder(registry, "test")
+	assert.Error(t, err)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/prometheus/client_golang/prometheus"
+	"time"
+)
+
+// PrometheusRecorder export broker metrics as Prometheus collectors
+type PrometheusRecorder struct {
+	published       *prometheus.CounterVec
+	publishDuration *prometheus.HistogramVec
+	handled         *prometheus.CounterVec
+	handleDuration  *prometheus.HistogramVec
+	redelivered     *prometheus.CounterVec
+	queueMessages   *prometheus.GaugeVec
+	queueConsumers  *prometheus.GaugeVec
+}
+
+// NewPrometheusRecorder create collectors named <namespace>_broker_* and register them to registerer,
+// e.g. NewPrometheusRecorder(prometheus.DefaultRegisterer, "app")
+func NewPrometheusRecorder(registerer prometheus.Registerer, namespace string) (*PrometheusRecorder, error) {
+	out := &PrometheusRecorder{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "published_total",
+			Help:      "Number of publishings by topic and status.",
+		}, []string{"topic", "status"}),
+		publishDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "publish_duration_seconds",
+			Help:      "Latency of publishings until confirmed.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"topic"}),
+		handled: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "handled_total",
+			Help:      "Number of consumed deliveries by subscription, topic and outcome.",
+		}, []string{"subscription", "topic", "outcome"}),
+		handleDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "handle_duration_seconds",
+			Help:      "Time spent in handlers.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"subscription", "topic"}),
+		redelivered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "redelivered_total",
+			Help:      "Number of redelivered deliveries by subscription and topic.",
+		}, []string{"subscription", "topic"}),
+		queueMessages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "queue_messages",
+			Help:      "Number of messages ready in queue.",
+		}, []string{"queue"}),
+		queueConsumers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "broker",
+			Name:      "queue_consumers",
+			Help:      "Number of consumers of queue.",
+		}, []string{"queue"}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		out.published, out.publishDuration, out.handled, out.handleDuration,
+		out.redelivered, out.queueMessages, out.queueConsumers,
+	} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func (r *PrometheusRecorder) Published(topic string, status broker.PublishStatus, latency time.Duration) {
+	r.published.WithLabelValues(topic, status.String()).Inc()
+	if status != broker.PublishFailed {
+		r.publishDuration.WithLabelValues(topic).Observe(latency.Seconds())
+	}
+}
+
+func (r *PrometheusRecorder) Handled(subscription, topic string, outcome broker.HandleOutcome, duration time.Duration) {
+	r.handled.WithLabelValues(subscription, topic, outcome.String()).Inc()
+	if outcome != broker.HandleDecodeFailed && outcome != broker.HandleNoRoute {
+		r.handleDuration.WithLabelValues(subscription, topic).Observe(duration.Seconds())
+	}
+}
+
+func (r *PrometheusRecorder) Redelivered(subscription, topic string) {
+	r.redelivered.WithLabelValues(subscription, topic).Inc()
+}
+
+func (r *PrometheusRecorder) QueueStat(queue string, messages, consumers int) {
+	r.queueMessages.WithLabelValues(queue).Set(float64(messages))
+	r.queueConsumers.WithLabelValues(queue).Set(float64(consumers))
+}
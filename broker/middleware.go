@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"runtime/debug"
+)
+
+// HandlerFunc is the invocation of a handler with a decoded message
+type HandlerFunc func(ctx context.Context, msg proto.Message, meta Metadata) error
+
+// SubscriberMiddleware intercept the handling of messages, it must call next to continue the chain,
+// the returned error decides whether the message is acked, retried or dead-lettered
+type SubscriberMiddleware func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error
+
+// Middleware append middlewares of a subscription, the first one is the outermost
+func Middleware(middlewares ...SubscriberMiddleware) Option {
+	return func(opts *Options) {
+		opts.Middlewares = append(opts.Middlewares, middlewares...)
+	}
+}
+
+// ChainSubscriber create a single middleware out of middlewares, the first one is the outermost.
+// It returns nil if there is no middleware.
+func ChainSubscriber(middlewares ...SubscriberMiddleware) SubscriberMiddleware {
+	switch len(middlewares) {
+	case 0:
+		return nil
+	case 1:
+		return middlewares[0]
+	}
+	return func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error {
+		return middlewares[0](ctx, msg, meta, chainHandler(middlewares[1:], next))
+	}
+}
+
+func chainHandler(middlewares []SubscriberMiddleware, next HandlerFunc) HandlerFunc {
+	if len(middlewares) == 0 {
+		return next
+	}
+	return func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		return middlewares[0](ctx, msg, meta, chainHandler(middlewares[1:], next))
+	}
+}
+
+// PanicError is the error of a panicked handler or middleware
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Recover convert a panic of h into *PanicError, so that the message fails instead of crashing the consumer
+func Recover(h HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, msg proto.Message, meta Metadata) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				stack := debug.Stack()
+				log.Error("handler panic", zap.Reflect("panic", r), zap.String("topic", meta.Topic),
+					zap.String("message_id", meta.MessageID), zap.ByteString("stack", stack))
+				err = &PanicError{Value: r, Stack: stack}
+			}
+		}()
+		return h(ctx, msg, meta)
+	}
+}
+
+// Dispatch call fn with msg through middleware, fn is called at most once per message id of subscription name
+// if store set, see CallOnce. Panics are recovered as *PanicError, inside deduplication as well, so that a panicked
+// message is released for retry.
+func Dispatch(ctx context.Context, middleware SubscriberMiddleware, store DedupStore, name string, fn *Handler, msg proto.Message, meta Metadata) error {
+	call := func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		return CallOnce(ctx, store, name, meta, func(ctx context.Context) error {
+			return Recover(fn.Call)(ctx, msg, meta)
+		})
+	}
+	if middleware == nil {
+		return call(ctx, msg, meta)
+	}
+	return Recover(func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		return middleware(ctx, msg, meta, call)
+	})(ctx, msg, meta)
+}
+
+// PublishFunc is the publishing of a message with its options
+type PublishFunc func(ctx context.Context, msg *Message, opts *PublishOptions) error
+
+// PublisherMiddleware intercept publishings before sent, it may modify opts, e.g. stamp headers, and must call next to send
+type PublisherMiddleware func(ctx context.Context, msg *Message, opts *PublishOptions, next PublishFunc) error
+
+// PublishMiddleware append middlewares of a publisher or requester, the first one is the outermost
+func PublishMiddleware(middlewares ...PublisherMiddleware) Option {
+	return func(opts *Options) {
+		opts.PublishMiddlewares = append(opts.PublishMiddlewares, middlewares...)
+	}
+}
+
+// ChainPublisher create a single middleware out of middlewares, the first one is the outermost.
+// It returns nil if there is no middleware.
+func ChainPublisher(middlewares ...PublisherMiddleware) PublisherMiddleware {
+	switch len(middlewares) {
+	case 0:
+		return nil
+	case 1:
+		return middlewares[0]
+	}
+	return func(ctx context.Context, msg *Message, opts *PublishOptions, next PublishFunc) error {
+		return middlewares[0](ctx, msg, opts, chainPublish(middlewares[1:], next))
+	}
+}
+
+func chainPublish(middlewares []PublisherMiddleware, next PublishFunc) PublishFunc {
+	if len(middlewares) == 0 {
+		return next
+	}
+	return func(ctx context.Context, msg *Message, opts *PublishOptions) error {
+		return middlewares[0](ctx, msg, opts, chainPublish(middlewares[1:], next))
+	}
+}
+
+// InterceptPublish call publish through middleware, brokers call it between applying publish options and sending
+func InterceptPublish(ctx context.Context, middleware PublisherMiddleware, msg *Message, opts *PublishOptions, publish PublishFunc) error {
+	if middleware == nil {
+		return publish(ctx, msg, opts)
+	}
+	return middleware(ctx, msg, opts, publish)
+}
@@ -0,0 +1,115 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestChainSubscriber(t *testing.T) {
+	assert.Nil(t, ChainSubscriber())
+
+	var calls []string
+	trace := func(name string) SubscriberMiddleware {
+		return func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error {
+			calls = append(calls, name+" before")
+			err := next(ctx, msg, meta)
+			calls = append(calls, name+" after")
+			return err
+		}
+	}
+
+	chain := ChainSubscriber(trace("a"), trace("b"), trace("c"))
+	err := chain(context.Background(), &testProtoMessage{}, Metadata{}, func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		calls = append(calls, "handler")
+		return errTest
+	})
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, []string{"a before", "b before", "c before", "handler", "c after", "b after", "a after"}, calls)
+}
+
+func TestRecover(t *testing.T) {
+	err := Recover(func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		panic("boom")
+	})(context.Background(), &testProtoMessage{}, Metadata{})
+
+	var panicErr *PanicError
+	require.True(t, errors.As(err, &panicErr))
+	assert.Equal(t, "boom", panicErr.Value)
+	assert.NotEmpty(t, panicErr.Stack)
+}
+
+type releaseStore struct {
+	claimed, released []string
+}
+
+func (s *releaseStore) Claim(_ context.Context, key string) (bool, error) {
+	s.claimed = append(s.claimed, key)
+	return true, nil
+}
+
+func (s *releaseStore) Complete(_ context.Context, key string) error {
+	return nil
+}
+
+func (s *releaseStore) Release(_ context.Context, key string) error {
+	s.released = append(s.released, key)
+	return nil
+}
+
+func TestDispatch(t *testing.T) {
+	meta := Metadata{Topic: "test", MessageID: "1"}
+	fn, err := NewHandler(func(message *testProtoMessage) error {
+		panic("boom")
+	})
+	require.NoError(t, err)
+
+	// a panicked message is released for retry
+	store := &releaseStore{}
+	err = Dispatch(context.Background(), nil, store, "sub", fn, fn.NewMessage(), meta)
+	assert.IsType(t, &PanicError{}, err)
+	assert.Equal(t, []string{DedupKey("sub", "1")}, store.released)
+
+	// middleware see the error, and its own panic is recovered as well
+	var seen error
+	observe := func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error {
+		seen = next(ctx, msg, meta)
+		return seen
+	}
+	err = Dispatch(context.Background(), observe, nil, "sub", fn, fn.NewMessage(), meta)
+	assert.IsType(t, &PanicError{}, err)
+	assert.Equal(t, err, seen)
+
+	crash := func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error {
+		panic("middleware")
+	}
+	err = Dispatch(context.Background(), crash, nil, "sub", fn, fn.NewMessage(), meta)
+	assert.IsType(t, &PanicError{}, err)
+}
+
+func TestChainPublisher(t *testing.T) {
+	assert.Nil(t, ChainPublisher())
+
+	stamp := func(key string) PublisherMiddleware {
+		return func(ctx context.Context, msg *Message, opts *PublishOptions, next PublishFunc) error {
+			Header(key, len(opts.Headers))(opts)
+			return next(ctx, msg, opts)
+		}
+	}
+
+	var sent *PublishOptions
+	publish := func(ctx context.Context, msg *Message, opts *PublishOptions) error {
+		sent = opts
+		return errTest
+	}
+	err := InterceptPublish(context.Background(), ChainPublisher(stamp("a"), stamp("b")), NewMessage("test", &testProtoMessage{}), NewPublishOptions(false), publish)
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, map[string]interface{}{"a": 0, "b": 1}, sent.Headers)
+
+	sent = nil
+	assert.Equal(t, errTest, InterceptPublish(context.Background(), nil, NewMessage("test", &testProtoMessage{}), NewPublishOptions(false), publish))
+	assert.NotNil(t, sent)
+}
@@ -0,0 +1,7 @@
+package outbox
+
+import (
+	"github.com/Ankr-network/kit/mlog"
+)
+
+var log = mlog.Logger("outbox")
@@ -0,0 +1,121 @@
+package outbox
+
+import (
+	"context"
+	"database/sql"
+	"github.com/Ankr-network/kit/rdb"
+	"github.com/jmoiron/sqlx"
+	"go.uber.org/zap"
+	"time"
+)
+
+// CreateTableSQL is the DDL of the outbox table used by MySQLStore, %s is the table name
+const CreateTableSQL = "CREATE TABLE IF NOT EXISTS `%s` (\n" +
+	"  `id` BIGINT UNSIGNED NOT NULL AUTO_INCREMENT,\n" +
+	"  `topic` VARCHAR(255) NOT NULL,\n" +
+	"  `type` VARCHAR(255) NOT NULL,\n" +
+	"  `content_type` VARCHAR(64) NOT NULL,\n" +
+	"  `message_id` VARCHAR(64) NOT NULL,\n" +
+	"  `headers` JSON NULL,\n" +
+	"  `options` JSON NULL,\n" +
+	"  `payload` MEDIUMBLOB NOT NULL,\n" +
+	"  `created_at` DATETIME(6) NOT NULL,\n" +
+	"  `sent_at` DATETIME(6) NULL,\n" +
+	"  PRIMARY KEY (`id`),\n" +
+	"  KEY `idx_sent_at_id` (`sent_at`, `id`)\n" +
+	") ENGINE=InnoDB"
+
+type mysqlStore struct {
+	db    *sqlx.DB
+	table string
+}
+
+// NewMySQLStore create a Store on table of db, the table must be created by CreateTableSQL
+func NewMySQLStore(db *sqlx.DB, table string) Store {
+	return &mysqlStore{
+		db:    db,
+		table: table,
+	}
+}
+
+func (s *mysqlStore) Add(ctx context.Context, records ...*Record) error {
+	tx, ok := rdb.GetTxFromContext(ctx)
+	if !ok {
+		return ErrNoTx
+	}
+
+	query := "INSERT INTO `" + s.table + "` (topic, type, content_type, message_id, headers, options, payload, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+	for _, r := range records {
+		rdb.LogSQL(query, r.Topic, r.Type, r.ContentType, r.MessageID, r.Headers, r.Options, "<payload>", r.CreatedAt)
+		rs, err := tx.ExecContext(ctx, query, r.Topic, r.Type, r.ContentType, r.MessageID, r.Headers, r.Options, r.Payload, r.CreatedAt)
+		if err != nil {
+			log.Error("ExecContext error", zap.Error(err))
+			return err
+		}
+		if r.ID, err = rs.LastInsertId(); err != nil {
+			log.Error("LastInsertId error", zap.Error(err))
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *mysqlStore) Pending(ctx context.Context, limit int) ([]*Record, error) {
+	query := "SELECT id, topic, type, content_type, message_id, headers, options, payload, created_at, sent_at FROM `" + s.table + "` WHERE sent_at IS NULL ORDER BY id LIMIT ?"
+	rdb.LogSQL(query, limit)
+	var out []*Record
+	if err := s.db.SelectContext(ctx, &out, query, limit); err != nil {
+		log.Error("SelectContext error", zap.Error(err))
+		return nil, err
+	}
+	return out, nil
+}
+
+func (s *mysqlStore) MarkSent(ctx context.Context, ids ...int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("UPDATE `"+s.table+"` SET sent_at = ? WHERE id IN (?)", time.Now(), ids)
+	if err != nil {
+		return err
+	}
+	rdb.LogSQL(query, args...)
+	if _, err := s.db.ExecContext(ctx, query, args...); err != nil {
+		log.Error("ExecContext error", zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// Lock hold a MySQL named lock of the table on a connection until unlock, the lock is released by MySQL as well
+// if the relay crashed and its connection closed
+func (s *mysqlStore) Lock(ctx context.Context) (func(), error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		log.Error("Conn error", zap.Error(err))
+		return nil, err
+	}
+
+	name := "outbox:" + s.table
+	query := "SELECT GET_LOCK(?, 0)"
+	rdb.LogSQL(query, name)
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, query, name).Scan(&locked); err != nil {
+		log.Error("QueryRowContext error", zap.Error(err))
+		_ = conn.Close()
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		_ = conn.Close()
+		return nil, ErrLocked
+	}
+
+	return func() {
+		query := "SELECT RELEASE_LOCK(?)"
+		rdb.LogSQL(query, name)
+		if _, err := conn.ExecContext(context.Background(), query, name); err != nil {
+			log.Error("ExecContext error", zap.Error(err))
+		}
+		_ = conn.Close()
+	}, nil
+}
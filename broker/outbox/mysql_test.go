@@ -0,0 +1,61 @@
+//+build integration
+
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/rdb"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestMySQLStore(t *testing.T) {
+	repo := rdb.NewMySQLRepositoryWithConfig()
+	defer repo.Close()
+
+	const table = "outbox_test"
+	_, err := repo.Exec(fmt.Sprintf(CreateTableSQL, table))
+	require.NoError(t, err)
+	defer repo.Exec("DROP TABLE " + table)
+
+	store := NewMySQLStore(repo.DB, table)
+	p := NewOutboxPublisher(store)
+
+	// rollback discard the message
+	assert.Error(t, repo.WithWriteTx(context.Background(), func(ctx context.Context) error {
+		require.NoError(t, p.PublishMessageContext(ctx, broker.NewMessage("topic", &wrappers.StringValue{Value: "rollback"})))
+		return errTest
+	}))
+	require.NoError(t, repo.WithWriteTx(context.Background(), func(ctx context.Context) error {
+		return p.PublishMessageContext(ctx, broker.NewMessage("topic", &wrappers.StringValue{Value: "commit"}),
+			broker.Header("k", "v"), broker.CorrelationID("c1"))
+	}))
+
+	records, err := store.Pending(context.Background(), 10)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	msg, err := NewRelay(store, nil).newMessage(records[0])
+	require.NoError(t, err)
+	assert.Equal(t, "commit", msg.(*wrappers.StringValue).Value)
+	assert.Equal(t, broker.ContentTypeProtobuf, records[0].ContentType)
+	assert.Equal(t, Headers{"k": "v"}, records[0].Headers)
+	assert.Equal(t, Options{CorrelationID: "c1", Persistent: true}, records[0].Options)
+
+	require.NoError(t, store.MarkSent(context.Background(), records[0].ID))
+	records, err = store.Pending(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, records)
+
+	unlock, err := store.Lock(context.Background())
+	require.NoError(t, err)
+	_, err = NewMySQLStore(repo.DB, table).Lock(context.Background())
+	assert.Equal(t, ErrLocked, err)
+	unlock()
+	unlock, err = store.Lock(context.Background())
+	require.NoError(t, err)
+	unlock()
+}
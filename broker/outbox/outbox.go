@@ -0,0 +1,136 @@
+// Package outbox provides a transactional outbox for broker messages.
+//
+// OutboxPublisher writes messages into an outbox table within the rdb transaction of the context,
+// so they are committed or rolled back together with the business rows.
+// Relay publishes the committed messages through a broker.MultiTopicPublisher and marks them sent.
+// Delivery is at-least-once, a message may be published again if the relay crash before marking it sent,
+// so consumers should be idempotent or deduplicate by message id.
+package outbox
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"time"
+)
+
+var (
+	ErrNoTx                     = errors.New("outbox publish must be in a transaction, see rdb.ContextWithTx")
+	ErrMessageIsNotProtoMessage = errors.New("message must be proto.Message")
+	ErrUnknownMessageType       = errors.New("unknown message type")
+	ErrLocked                   = errors.New("outbox is locked by another relay")
+)
+
+// Record is a message in outbox
+type Record struct {
+	ID          int64      `db:"id"`
+	Topic       string     `db:"topic"`
+	Type        string     `db:"type"`         // proto full name of the message
+	ContentType string     `db:"content_type"` // content type of the codec encoding payload
+	MessageID   string     `db:"message_id"`
+	Headers     Headers    `db:"headers"`
+	Options     Options    `db:"options"`
+	Payload     []byte     `db:"payload"`
+	CreatedAt   time.Time  `db:"created_at"`
+	SentAt      *time.Time `db:"sent_at"`
+}
+
+// Headers is the publish headers of a record, stored as JSON
+type Headers map[string]interface{}
+
+func (h Headers) Value() (driver.Value, error) {
+	if h == nil {
+		return nil, nil
+	}
+	return json.Marshal(h)
+}
+
+func (h *Headers) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	default:
+		return fmt.Errorf("unsupported headers type %T", src)
+	}
+}
+
+// Options is the publish options of a record other than headers and message id, stored as JSON
+type Options struct {
+	CorrelationID string        `json:"correlation_id,omitempty"`
+	ReplyTo       string        `json:"reply_to,omitempty"`
+	Priority      uint8         `json:"priority,omitempty"`
+	Expiration    time.Duration `json:"expiration,omitempty"`
+	Persistent    bool          `json:"persistent"`
+	DeliverAt     *time.Time    `json:"deliver_at,omitempty"`
+	PartitionKey  string        `json:"partition_key,omitempty"`
+}
+
+func newOptions(opts *broker.PublishOptions) Options {
+	out := Options{
+		CorrelationID: opts.CorrelationID,
+		ReplyTo:       opts.ReplyTo,
+		Priority:      opts.Priority,
+		Expiration:    opts.Expiration,
+		Persistent:    opts.Persistent,
+		PartitionKey:  opts.PartitionKey,
+	}
+	if !opts.DeliverAt.IsZero() {
+		deliverAt := opts.DeliverAt
+		out.DeliverAt = &deliverAt
+	}
+	return out
+}
+
+// publishOptions restore the options as the record was published with
+func (o Options) publishOptions() []broker.PublishOption {
+	out := []broker.PublishOption{
+		broker.CorrelationID(o.CorrelationID),
+		broker.ReplyTo(o.ReplyTo),
+		broker.Priority(o.Priority),
+		broker.Expiration(o.Expiration),
+		broker.Persistent(o.Persistent),
+		broker.PartitionKey(o.PartitionKey),
+	}
+	if o.DeliverAt != nil {
+		out = append(out, broker.DeliverAt(*o.DeliverAt))
+	}
+	return out
+}
+
+func (o Options) Value() (driver.Value, error) {
+	return json.Marshal(o)
+}
+
+func (o *Options) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*o = Options{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, o)
+	case string:
+		return json.Unmarshal([]byte(v), o)
+	default:
+		return fmt.Errorf("unsupported options type %T", src)
+	}
+}
+
+// Store is the storage of outbox records
+type Store interface {
+	// Add insert records within the transaction of ctx, ErrNoTx if ctx without transaction
+	Add(ctx context.Context, records ...*Record) error
+	// Pending return at most limit unsent records ordered by id, see Relay for the ordering
+	Pending(ctx context.Context, limit int) ([]*Record, error)
+	// MarkSent mark records of ids sent
+	MarkSent(ctx context.Context, ids ...int64) error
+	// Lock acquire the relay lock of the outbox without waiting, return the func releasing it, or ErrLocked if held by another relay
+	Lock(ctx context.Context) (func(), error)
+}
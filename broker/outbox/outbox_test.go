@@ -0,0 +1,307 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/memory"
+	"github.com/Ankr-network/kit/rdb"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errTest = errors.New("test error")
+
+type memStore struct {
+	m       sync.Mutex
+	records []*Record
+	// uncommitted hold the ids of records whose transaction is not committed yet
+	uncommitted map[int64]bool
+	locked      bool
+}
+
+func (s *memStore) Add(ctx context.Context, records ...*Record) error {
+	if _, ok := rdb.GetTxFromContext(ctx); !ok {
+		return ErrNoTx
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, r := range records {
+		r.ID = int64(len(s.records) + 1)
+		s.records = append(s.records, r)
+	}
+	return nil
+}
+
+func (s *memStore) Pending(ctx context.Context, limit int) ([]*Record, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	var out []*Record
+	for _, r := range s.records {
+		if r.SentAt == nil && !s.uncommitted[r.ID] && len(out) < limit {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (s *memStore) MarkSent(ctx context.Context, ids ...int64) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, id := range ids {
+		now := s.records[id-1].CreatedAt
+		s.records[id-1].SentAt = &now
+	}
+	return nil
+}
+
+func (s *memStore) Lock(ctx context.Context) (func(), error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.locked {
+		return nil, ErrLocked
+	}
+	s.locked = true
+	return func() {
+		s.m.Lock()
+		defer s.m.Unlock()
+		s.locked = false
+	}, nil
+}
+
+// flakyPublisher fail the messages with value in fail once
+type flakyPublisher struct {
+	broker.MultiTopicPublisher
+	fail map[string]bool
+}
+
+func (p *flakyPublisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	value := msg.Value.(*wrappers.StringValue).Value
+	if p.fail[value] {
+		delete(p.fail, value)
+		return errTest
+	}
+	return p.MultiTopicPublisher.PublishMessageContext(ctx, msg, opts...)
+}
+
+type recorder struct {
+	m    sync.Mutex
+	msgs []string
+	ids  []string
+}
+
+func (r *recorder) handle(ctx context.Context, msg *wrappers.StringValue, meta broker.Metadata) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.msgs = append(r.msgs, msg.Value)
+	r.ids = append(r.ids, meta.MessageID)
+	return nil
+}
+
+func txContext() context.Context {
+	return rdb.ContextWithTx(context.Background(), &sqlx.Tx{})
+}
+
+func TestOutboxPublisherWithoutTx(t *testing.T) {
+	p := NewOutboxPublisher(&memStore{})
+	assert.Equal(t, ErrNoTx, p.PublishMessage(broker.NewMessage("topic", &wrappers.StringValue{})))
+	assert.Equal(t, ErrNoTx, p.TopicPublisher("topic").Publish(&wrappers.StringValue{}))
+	assert.Equal(t, ErrMessageIsNotProtoMessage, p.TopicPublisher("topic").Publish("text"))
+}
+
+func TestRelay(t *testing.T) {
+	b := memory.NewMemoryBroker()
+	a, o := &recorder{}, &recorder{}
+	_, err := b.RegisterSubscribeHandler("a", "a", a.handle)
+	require.NoError(t, err)
+	_, err = b.RegisterSubscribeHandler("b", "b", o.handle)
+	require.NoError(t, err)
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+
+	store := &memStore{}
+	p := NewOutboxPublisher(store)
+	ctx := txContext()
+	for _, v := range []string{"a1", "a2", "a3"} {
+		require.NoError(t, p.TopicPublisher("a").PublishContext(ctx, &wrappers.StringValue{Value: v}))
+	}
+	require.NoError(t, p.PublishMessageContext(ctx, broker.NewMessage("b", &wrappers.StringValue{Value: "b1"}), broker.MessageID("b1")))
+
+	relay := NewRelay(store, &flakyPublisher{
+		MultiTopicPublisher: mp,
+		fail:                map[string]bool{"a2": true},
+	}, WithGapTimeout(0))
+
+	// a2 failed, a3 is held back to keep the order of topic a, b is not affected
+	n, err := relay.RelayOnce(context.Background())
+	assert.Equal(t, errTest, err)
+	assert.Equal(t, 2, n)
+	b.Wait()
+	assert.Equal(t, []string{"a1"}, a.msgs)
+	assert.Equal(t, []string{"b1"}, o.msgs)
+	assert.Equal(t, []string{"b1"}, o.ids)
+
+	n, err = relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	b.Wait()
+	assert.Equal(t, []string{"a1", "a2", "a3"}, a.msgs)
+	assert.Len(t, a.ids[0], 36, "message id generated")
+
+	n, err = relay.RelayOnce(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRelayLocked(t *testing.T) {
+	store := &memStore{}
+	require.NoError(t, store.Add(txContext(), &Record{Topic: "a", Type: "unknown.Message"}))
+
+	b := memory.NewMemoryBroker()
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+
+	// another relay is relaying
+	unlock, err := store.Lock(context.Background())
+	require.NoError(t, err)
+	n, err := NewRelay(store, mp, WithGapTimeout(0)).RelayOnce(context.Background())
+	assert.Equal(t, ErrLocked, err)
+	assert.Equal(t, 0, n)
+
+	unlock()
+	_, err = NewRelay(store, mp, WithGapTimeout(0)).RelayOnce(context.Background())
+	assert.True(t, errors.Is(err, ErrUnknownMessageType))
+	_, err = store.Lock(context.Background())
+	assert.NoError(t, err, "released after the round")
+}
+
+func TestRelayCommitOrder(t *testing.T) {
+	b := memory.NewMemoryBroker()
+	a := &recorder{}
+	_, err := b.RegisterSubscribeHandler("a", "a", a.handle)
+	require.NoError(t, err)
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+
+	store := &memStore{uncommitted: map[int64]bool{}}
+	p := NewOutboxPublisher(store).TopicPublisher("a")
+	// publish v in a transaction, which is not committed yet if uncommitted
+	publish := func(v string, uncommitted bool) {
+		require.NoError(t, p.PublishContext(txContext(), &wrappers.StringValue{Value: v}))
+		store.uncommitted[int64(len(store.records))] = uncommitted
+	}
+	const timeout = 50 * time.Millisecond
+	r := NewRelay(store, mp, WithGapTimeout(timeout))
+	relay := func(expected int) {
+		n, err := r.RelayOnce(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expected, n)
+	}
+
+	// the records first seen are held back, the one below commits meanwhile
+	publish("1", true)
+	publish("2", false)
+	relay(0)
+	store.uncommitted[1] = false
+	relay(0)
+	time.Sleep(timeout)
+	relay(2)
+
+	// 4 is held back until 3 committed
+	publish("3", true)
+	publish("4", false)
+	relay(0)
+	store.uncommitted[3] = false
+	relay(2)
+
+	// 5 is given up after the gap timeout, it is relayed as soon as seen once committed
+	publish("5", true)
+	publish("6", false)
+	relay(0)
+	time.Sleep(timeout)
+	relay(1)
+	store.uncommitted[5] = false
+	relay(1)
+
+	b.Wait()
+	assert.Equal(t, []string{"1", "2", "3", "4", "6", "5"}, a.msgs)
+}
+
+// capturePublisher keep the messages and options published
+type capturePublisher struct {
+	broker.MultiTopicPublisher
+	msgs []*broker.Message
+	opts []*broker.PublishOptions
+}
+
+func (p *capturePublisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	p.msgs = append(p.msgs, msg)
+	p.opts = append(p.opts, broker.NewPublishOptions(false, opts...))
+	return nil
+}
+
+func TestRelayPublishOptions(t *testing.T) {
+	store := &memStore{}
+	p := NewOutboxPublisher(store, broker.UseCodec(broker.JSONCodec))
+	deliverAt := time.Now().Add(time.Hour)
+	require.NoError(t, p.PublishMessageContext(txContext(), broker.NewMessage("a", &wrappers.StringValue{Value: "a1"}),
+		broker.MessageID("a1"), broker.Header("k", "v"), broker.CorrelationID("c1"), broker.ReplyTo("reply"),
+		broker.Priority(3), broker.Persistent(false), broker.DeliverAt(deliverAt), broker.PartitionKey("p1")))
+	assert.Equal(t, broker.ContentTypeJSON, store.records[0].ContentType)
+	assert.JSONEq(t, `{"value":"a1"}`, string(store.records[0].Payload))
+
+	// stored as JSON
+	v, err := store.records[0].Options.Value()
+	require.NoError(t, err)
+	var options Options
+	require.NoError(t, options.Scan(v))
+	store.records[0].Options = options
+
+	c := &capturePublisher{}
+	n, err := NewRelay(store, c, WithGapTimeout(0)).RelayOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, c.msgs, 1)
+	assert.Equal(t, "a1", c.msgs[0].Value.(*wrappers.StringValue).Value)
+	assert.True(t, deliverAt.Equal(c.opts[0].DeliverAt))
+	c.opts[0].DeliverAt = deliverAt
+	assert.Equal(t, &broker.PublishOptions{
+		Headers:       map[string]interface{}{"k": "v"},
+		MessageID:     "a1",
+		CorrelationID: "c1",
+		ReplyTo:       "reply",
+		Priority:      3,
+		DeliverAt:     deliverAt,
+		PartitionKey:  "p1",
+	}, c.opts[0])
+}
+
+func TestRelayUnknownType(t *testing.T) {
+	store := &memStore{}
+	require.NoError(t, store.Add(txContext(), &Record{Topic: "a", Type: "unknown.Message"}))
+
+	b := memory.NewMemoryBroker()
+	mp, err := b.MultiTopicPublisher()
+	require.NoError(t, err)
+
+	_, err = NewRelay(store, mp, WithGapTimeout(0)).RelayOnce(context.Background())
+	assert.True(t, errors.Is(err, ErrUnknownMessageType))
+}
+
+func TestHeaders(t *testing.T) {
+	h := Headers{"tenant": "ankr"}
+	v, err := h.Value()
+	require.NoError(t, err)
+
+	var out Headers
+	require.NoError(t, out.Scan(v))
+	assert.Equal(t, h, out)
+
+	require.NoError(t, out.Scan(nil))
+	assert.Nil(t, out)
+}
@@ -0,0 +1,94 @@
+package outbox
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"time"
+)
+
+var (
+	_ broker.MultiTopicPublisher = (*OutboxPublisher)(nil)
+	_ broker.Publisher           = (*topicPublisher)(nil)
+)
+
+// OutboxPublisher write messages into outbox within the rdb transaction of the context,
+// messages are published by Relay after the transaction committed with the same broker.PublishOption,
+// a message id is generated if not set.
+// Messages are encoded by the codec of broker.UseCodec, default broker.ProtoCodec, Relay decodes them by
+// the content type and the relay publisher encodes them again, so configure both with the same codec.
+type OutboxPublisher struct {
+	store Store
+	codec broker.Codec
+}
+
+func NewOutboxPublisher(store Store, opts ...broker.Option) *OutboxPublisher {
+	options := &broker.Options{
+		Codec: broker.ProtoCodec,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &OutboxPublisher{
+		store: store,
+		codec: options.Codec,
+	}
+}
+
+// TopicPublisher return a broker.Publisher which write messages of topic into outbox
+func (p *OutboxPublisher) TopicPublisher(topic string) broker.Publisher {
+	return &topicPublisher{
+		outbox: p,
+		topic:  topic,
+	}
+}
+
+// PublishMessage always return ErrNoTx, use PublishMessageContext instead
+func (p *OutboxPublisher) PublishMessage(msg *broker.Message) error {
+	return p.PublishMessageContext(context.Background(), msg)
+}
+
+func (p *OutboxPublisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	options := broker.NewPublishOptions(true, opts...)
+
+	payload, err := p.codec.Marshal(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	messageID := options.MessageID
+	if messageID == "" {
+		messageID = uuid.New().String()
+	}
+
+	return p.store.Add(ctx, &Record{
+		Topic:       msg.Topic,
+		Type:        proto.MessageName(msg.Value),
+		ContentType: p.codec.ContentType(),
+		MessageID:   messageID,
+		Headers:     Headers(options.Headers),
+		Options:     newOptions(options),
+		Payload:     payload,
+		CreatedAt:   time.Now(),
+	})
+}
+
+type topicPublisher struct {
+	outbox *OutboxPublisher
+	topic  string
+}
+
+// Publish always return ErrNoTx, use PublishContext instead
+func (p *topicPublisher) Publish(m interface{}) error {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return ErrMessageIsNotProtoMessage
+	}
+	return p.PublishContext(context.Background(), msg)
+}
+
+func (p *topicPublisher) PublishContext(ctx context.Context, m proto.Message, opts ...broker.PublishOption) error {
+	return p.outbox.PublishMessageContext(ctx, broker.NewMessage(p.topic, m), opts...)
+}
@@ -0,0 +1,253 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap"
+	"reflect"
+	"time"
+)
+
+type RelayOptions struct {
+	BatchSize  int
+	Interval   time.Duration
+	GapTimeout time.Duration
+	Codec      broker.Codec
+}
+
+type RelayOption func(opts *RelayOptions)
+
+// WithBatchSize set the max number of records relayed per round, default 100
+func WithBatchSize(n int) RelayOption {
+	return func(opts *RelayOptions) {
+		opts.BatchSize = n
+	}
+}
+
+// WithInterval set how long the relay wait before polling again once outbox drained, default 1s
+func WithInterval(interval time.Duration) RelayOption {
+	return func(opts *RelayOptions) {
+		opts.Interval = interval
+	}
+}
+
+// WithGapTimeout set how long the relay hold back the records after a missing id, default 10s, see Relay
+func WithGapTimeout(timeout time.Duration) RelayOption {
+	return func(opts *RelayOptions) {
+		opts.GapTimeout = timeout
+	}
+}
+
+// WithCodec set the codec decoding records of its content type, the builtin codecs of broker are always known
+func WithCodec(c broker.Codec) RelayOption {
+	return func(opts *RelayOptions) {
+		opts.Codec = c
+	}
+}
+
+// Relay publish pending outbox records in id order and mark them sent.
+// Records of a topic are published one by one, a failed record block the later records of the same topic
+// until it is published. Each round holds the lock of the store, so relays of the same outbox table never
+// publish concurrently.
+//
+// Ids are allocated on insert rather than on commit, a missing id may be of a transaction not committed yet,
+// so the records after a missing id are held back until it is committed or the gap timeout passed, the id
+// is then given up, e.g. of a rolled back transaction. The records first seen are held back for the gap timeout
+// as well, since the relay cannot tell whether the ids below them are sent or not committed yet.
+// Records are relayed in commit order unless a transaction commits after the gap timeout, it is then relayed
+// as soon as seen, after the records of greater ids.
+type Relay struct {
+	store      Store
+	publisher  broker.MultiTopicPublisher
+	batchSize  int
+	interval   time.Duration
+	gapTimeout time.Duration
+	codec      broker.Codec
+
+	// the state below is only accessed within the lock of store
+	// next is the least id neither sent nor given up, 0 until records seen
+	next int64
+	// since is when next was seen first, the records are held back until gapTimeout passed since then
+	since time.Time
+	// sent is the ids at or above next which are sent
+	sent map[int64]bool
+	// missing is the ids at or above next which are not seen yet, and when they were missed first
+	missing map[int64]time.Time
+}
+
+func NewRelay(store Store, publisher broker.MultiTopicPublisher, opts ...RelayOption) *Relay {
+	options := &RelayOptions{
+		BatchSize:  100,
+		Interval:   time.Second,
+		GapTimeout: 10 * time.Second,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Relay{
+		store:      store,
+		publisher:  publisher,
+		batchSize:  options.BatchSize,
+		interval:   options.Interval,
+		gapTimeout: options.GapTimeout,
+		codec:      options.Codec,
+		sent:       map[int64]bool{},
+		missing:    map[int64]time.Time{},
+	}
+}
+
+// Run relay records until ctx done
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil && err != ErrLocked {
+			log.Error("relay outbox error", zap.Error(err))
+		}
+
+		// poll again immediately if a full batch relayed, there may be more
+		if err == nil && n == r.batchSize {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(r.interval):
+		}
+	}
+}
+
+// RelayOnce relay one batch of pending records, return the number of records published.
+// ErrLocked is returned if another relay is relaying the outbox. Records held back are not counted.
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	unlock, err := r.store.Lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	records, err := r.store.Pending(ctx, r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	var (
+		sent    []int64
+		blocked = map[string]bool{}
+		result  error
+	)
+	for _, record := range r.ready(records, now) {
+		if blocked[record.Topic] {
+			continue
+		}
+		if err := r.publish(ctx, record); err != nil {
+			log.Error("relay record error", zap.Error(err), zap.Int64("id", record.ID), zap.String("topic", record.Topic))
+			blocked[record.Topic] = true
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+		sent = append(sent, record.ID)
+	}
+
+	// records published but not marked are published again next round
+	if err := r.store.MarkSent(ctx, sent...); err != nil {
+		return 0, err
+	}
+	for _, id := range sent {
+		if id >= r.next {
+			r.sent[id] = true
+		}
+	}
+	r.advance(now)
+	return len(sent), result
+}
+
+// ready return the records which can be relayed in commit order, the records after a missing id are held back
+func (r *Relay) ready(records []*Record, now time.Time) []*Record {
+	if len(records) == 0 {
+		return nil
+	}
+	if r.next == 0 {
+		r.next, r.since = records[0].ID, now
+	}
+	if now.Sub(r.since) < r.gapTimeout {
+		// records below committed meanwhile were not sent either
+		if records[0].ID < r.next {
+			r.next = records[0].ID
+		}
+		return nil
+	}
+
+	var out []*Record
+	expected, held := r.next, false
+	for _, record := range records {
+		if record.ID < r.next {
+			log.Warn("relay record committed after gap timeout", zap.Int64("id", record.ID), zap.String("topic", record.Topic))
+			out = append(out, record)
+			continue
+		}
+		delete(r.missing, record.ID)
+		for ; expected < record.ID; expected++ {
+			if r.sent[expected] {
+				continue
+			}
+			missed, ok := r.missing[expected]
+			if !ok {
+				r.missing[expected], missed = now, now
+			}
+			if now.Sub(missed) < r.gapTimeout {
+				held = true
+			}
+		}
+		expected = record.ID + 1
+		if !held {
+			out = append(out, record)
+		}
+	}
+	return out
+}
+
+// advance move next over the ids sent or given up
+func (r *Relay) advance(now time.Time) {
+	for r.next > 0 {
+		if r.sent[r.next] {
+			delete(r.sent, r.next)
+		} else if missed, ok := r.missing[r.next]; ok && now.Sub(missed) >= r.gapTimeout {
+			log.Warn("give up missing outbox id", zap.Int64("id", r.next))
+			delete(r.missing, r.next)
+		} else {
+			return
+		}
+		r.next++
+	}
+}
+
+func (r *Relay) publish(ctx context.Context, record *Record) error {
+	msg, err := r.newMessage(record)
+	if err != nil {
+		return err
+	}
+	opts := append(record.Options.publishOptions(), broker.MessageID(record.MessageID), broker.Headers(record.Headers))
+	return r.publisher.PublishMessageContext(ctx, broker.NewMessage(record.Topic, msg), opts...)
+}
+
+func (r *Relay) newMessage(record *Record) (proto.Message, error) {
+	t := proto.MessageType(record.Type)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownMessageType, record.Type)
+	}
+	msg := reflect.New(t.Elem()).Interface().(proto.Message)
+	if err := broker.Decode(r.codec, record.ContentType, record.Payload, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,45 @@
+package broker
+
+import (
+	"errors"
+	"hash/fnv"
+)
+
+const (
+	// PartitionHeader carry the partition of a message published to a partitioned topic
+	PartitionHeader = "x-partition"
+	// PartitionKeyHeader carry the partition key of a message published to a partitioned topic
+	PartitionKeyHeader = "x-partition-key"
+)
+
+var (
+	ErrPartitionKeyRequired = errors.New("partitioned topic requires partition key")
+)
+
+// PartitionKey set the partition key of the message, it is required by partitioned topics
+func PartitionKey(key string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.PartitionKey = key
+	}
+}
+
+// Partition map key to one of partitions by jump consistent hash, so only 1/n of keys move when the n-th partition added
+func Partition(key string, partitions int) int {
+	if partitions <= 1 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return jumpHash(h.Sum64(), partitions)
+}
+
+// jumpHash is "A Fast, Minimal Memory, Consistent Hash Algorithm" by Lamping and Veach
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,38 @@
+package broker
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestPartition(t *testing.T) {
+	assert.Equal(t, 0, Partition("any", 0))
+	assert.Equal(t, 0, Partition("any", 1))
+	assert.Equal(t, Partition("account-1", 8), Partition("account-1", 8))
+
+	const keys = 10000
+	counts := make([]int, 8)
+	moved := 0
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("account-%d", i)
+		p := Partition(key, 8)
+		counts[p]++
+		if p != Partition(key, 9) {
+			moved++
+		}
+	}
+	// keys are spread evenly
+	for _, c := range counts {
+		assert.InDelta(t, keys/8, c, keys/8*0.1)
+	}
+	// about 1/9 keys move to the new partition
+	assert.InDelta(t, keys/9, moved, keys/9*0.1)
+}
+
+func TestJumpHash(t *testing.T) {
+	// the mapping must be stable across releases, a change moves keys to other partitions
+	assert.Equal(t, 0, jumpHash(0, 1))
+	assert.Equal(t, 6, jumpHash(1, 10))
+	assert.Equal(t, 2, jumpHash(0xDEADBEEF, 3))
+}
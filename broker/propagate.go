@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/auth"
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"go.uber.org/zap"
+)
+
+const (
+	// UIDHeader carry the user id of auth.GetUID, see UIDFromContext
+	UIDHeader = "x-uid"
+	// TenantHeader carry the tenant id of TenantFromContext
+	TenantHeader = "x-tenant-id"
+	// SchemaVersionHeader carry the schema version of the message, see SchemaVersion
+	SchemaVersionHeader = "x-schema-version"
+)
+
+// Propagator carry a context value across the broker in message headers
+type Propagator interface {
+	// Inject copy the value of ctx into the headers of opts
+	Inject(ctx context.Context, opts *PublishOptions)
+	// Extract restore the value from the headers of meta into ctx
+	Extract(ctx context.Context, meta Metadata) context.Context
+}
+
+// InjectContext is a PublisherMiddleware copy context values into headers, a header set explicitly is kept
+func InjectContext(propagators ...Propagator) PublisherMiddleware {
+	return func(ctx context.Context, msg *Message, opts *PublishOptions, next PublishFunc) error {
+		for _, p := range propagators {
+			p.Inject(ctx, opts)
+		}
+		return next(ctx, msg, opts)
+	}
+}
+
+// ExtractContext is a SubscriberMiddleware restore context values from headers into the handler context,
+// the consumer span started by TracePropagator is finished after handled
+func ExtractContext(propagators ...Propagator) SubscriberMiddleware {
+	return func(ctx context.Context, msg proto.Message, meta Metadata, next HandlerFunc) error {
+		parent := opentracing.SpanFromContext(ctx)
+		for _, p := range propagators {
+			ctx = p.Extract(ctx, meta)
+		}
+		if span := opentracing.SpanFromContext(ctx); span != nil && span != parent {
+			defer span.Finish()
+		}
+		return next(ctx, msg, meta)
+	}
+}
+
+// HeaderPropagator propagate a string value through header, get return false if ctx without the value
+func HeaderPropagator(header string, get func(ctx context.Context) (string, bool), set func(ctx context.Context, value string) context.Context) Propagator {
+	return &headerPropagator{
+		header: header,
+		get:    get,
+		set:    set,
+	}
+}
+
+type headerPropagator struct {
+	header string
+	get    func(ctx context.Context) (string, bool)
+	set    func(ctx context.Context, value string) context.Context
+}
+
+func (p *headerPropagator) Inject(ctx context.Context, opts *PublishOptions) {
+	if _, ok := opts.Headers[p.header]; ok {
+		return
+	}
+	if value, ok := p.get(ctx); ok {
+		Header(p.header, value)(opts)
+	}
+}
+
+func (p *headerPropagator) Extract(ctx context.Context, meta Metadata) context.Context {
+	value, ok := meta.Headers[p.header].(string)
+	if !ok || value == "" {
+		return ctx
+	}
+	return p.set(ctx, value)
+}
+
+type uidKey struct{}
+
+// NewUIDContext return a context carrying the user id propagated from a message. The id comes from a header which
+// nothing verified, so it is never put into the claim of auth, use auth.GetUID for verified users.
+func NewUIDContext(ctx context.Context, uid string) context.Context {
+	return context.WithValue(ctx, uidKey{}, uid)
+}
+
+// UIDFromContext return the user id propagated from the message being handled
+func UIDFromContext(ctx context.Context) (string, bool) {
+	uid, ok := ctx.Value(uidKey{}).(string)
+	return uid, ok && uid != ""
+}
+
+// UIDPropagator propagate the user id of auth.GetUID, or the one propagated to ctx already.
+// The handler context carry it for UIDFromContext only, see NewUIDContext.
+var UIDPropagator = HeaderPropagator(UIDHeader,
+	func(ctx context.Context) (string, bool) {
+		if uid, err := auth.GetUID(ctx); err == nil {
+			return uid, true
+		}
+		return UIDFromContext(ctx)
+	},
+	NewUIDContext,
+)
+
+type tenantKey struct{}
+
+// NewTenantContext return a context carrying tenant
+func NewTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext return the tenant of ctx
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok && tenant != ""
+}
+
+// TenantPropagator propagate the tenant of NewTenantContext
+var TenantPropagator = HeaderPropagator(TenantHeader, TenantFromContext, NewTenantContext)
+
+// TracePropagator propagate the opentracing span of the publisher, the handler context carry a span follows from it
+var TracePropagator Propagator = tracePropagator{}
+
+type tracePropagator struct{}
+
+func (tracePropagator) Inject(ctx context.Context, opts *PublishOptions) {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return
+	}
+	carrier := opentracing.TextMapCarrier{}
+	if err := span.Tracer().Inject(span.Context(), opentracing.TextMap, carrier); err != nil {
+		log.Error("inject trace span error", zap.Error(err))
+		return
+	}
+	for k, v := range carrier {
+		Header(k, v)(opts)
+	}
+}
+
+func (tracePropagator) Extract(ctx context.Context, meta Metadata) context.Context {
+	carrier := opentracing.TextMapCarrier{}
+	for k, v := range meta.Headers {
+		if s, ok := v.(string); ok {
+			carrier[k] = s
+		}
+	}
+	tracer := opentracing.GlobalTracer()
+	remote, err := tracer.Extract(opentracing.TextMap, carrier)
+	if err != nil {
+		if err != opentracing.ErrSpanContextNotFound {
+			log.Error("extract trace span error", zap.Error(err))
+		}
+		return ctx
+	}
+	span := tracer.StartSpan(fmt.Sprintf("consume %s", meta.Topic), opentracing.FollowsFrom(remote), ext.SpanKindConsumer)
+	return opentracing.ContextWithSpan(ctx, span)
+}
+
+// SchemaVersion is a PublisherMiddleware stamp version onto messages without SchemaVersionHeader, see SchemaRegistry for
+// versions checked per topic
+func SchemaVersion(version string) PublisherMiddleware {
+	return func(ctx context.Context, msg *Message, opts *PublishOptions, next PublishFunc) error {
+		if _, ok := opts.Headers[SchemaVersionHeader]; !ok {
+			Header(SchemaVersionHeader, version)(opts)
+		}
+		return next(ctx, msg, opts)
+	}
+}
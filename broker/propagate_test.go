@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/auth"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// propagate publish through InjectContext and handle the headers through ExtractContext
+func propagate(ctx context.Context, handle HandlerFunc, opts ...PublishOption) error {
+	propagators := []Propagator{UIDPropagator, TenantPropagator, TracePropagator}
+	publish := func(ctx context.Context, msg *Message, opts *PublishOptions) error {
+		return ExtractContext(propagators...)(context.Background(), msg.Value, Metadata{Topic: msg.Topic, Headers: opts.Headers}, handle)
+	}
+	return InterceptPublish(ctx, InjectContext(propagators...), NewMessage("test", &testProtoMessage{}), NewPublishOptions(false, opts...), publish)
+}
+
+func TestPropagateContext(t *testing.T) {
+	// the verified claim as auth.Verifier stores it
+	ctx := context.WithValue(context.Background(), "claim", jwt.MapClaims{"sub": "alice", "aud": "app"})
+	ctx = NewTenantContext(ctx, "ankr")
+
+	err := propagate(ctx, func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		assert.Equal(t, "alice", meta.Headers[UIDHeader])
+		uid, ok := UIDFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "alice", uid)
+		// a header is not a verified user
+		_, err := auth.GetUID(ctx)
+		assert.Equal(t, auth.ErrInvalidContext, err)
+
+		// propagated again to the next hop
+		opts := NewPublishOptions(false)
+		UIDPropagator.Inject(ctx, opts)
+		assert.Equal(t, "alice", opts.Headers[UIDHeader])
+
+		tenant, ok := TenantFromContext(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "ankr", tenant)
+		return nil
+	})
+	assert.NoError(t, err)
+
+	// explicit header is kept
+	err = propagate(ctx, func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		tenant, _ := TenantFromContext(ctx)
+		assert.Equal(t, "other", tenant)
+		return nil
+	}, Header(TenantHeader, "other"))
+	assert.NoError(t, err)
+
+	// nothing to propagate
+	err = propagate(context.Background(), func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		assert.Empty(t, meta.Headers)
+		_, ok := UIDFromContext(ctx)
+		assert.False(t, ok)
+		_, ok = TenantFromContext(ctx)
+		assert.False(t, ok)
+		assert.Nil(t, opentracing.SpanFromContext(ctx))
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestPropagateTrace(t *testing.T) {
+	tracer := mocktracer.New()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(opentracing.NoopTracer{})
+
+	parent := tracer.StartSpan("publish")
+	ctx := opentracing.ContextWithSpan(context.Background(), parent)
+	err := propagate(ctx, func(ctx context.Context, msg proto.Message, meta Metadata) error {
+		span := opentracing.SpanFromContext(ctx)
+		require.NotNil(t, span)
+		assert.Equal(t, parent.Context().(mocktracer.MockSpanContext).TraceID, span.Context().(mocktracer.MockSpanContext).TraceID)
+		return nil
+	})
+	require.NoError(t, err)
+	parent.Finish()
+
+	// the consumer span is finished after handled
+	spans := tracer.FinishedSpans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "consume test", spans[0].OperationName)
+	assert.Equal(t, parent.(*mocktracer.MockSpan).SpanContext.SpanID, spans[0].ParentID)
+}
+
+func TestSchemaVersion(t *testing.T) {
+	var sent *PublishOptions
+	publish := func(ctx context.Context, msg *Message, opts *PublishOptions) error {
+		sent = opts
+		return nil
+	}
+	msg := NewMessage("test", &testProtoMessage{})
+	require.NoError(t, InterceptPublish(context.Background(), SchemaVersion("v2"), msg, NewPublishOptions(false), publish))
+	assert.Equal(t, "v2", sent.Headers[SchemaVersionHeader])
+
+	require.NoError(t, InterceptPublish(context.Background(), SchemaVersion("v2"), msg, NewPublishOptions(false, Header(SchemaVersionHeader, "v1")), publish))
+	assert.Equal(t, "v1", sent.Headers[SchemaVersionHeader])
+}
@@ -0,0 +1,126 @@
+package broker
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrDelayedExpiration = errors.New("expiration is not supported by delayed message")
+)
+
+// PublishOptions are per message properties, brokers map them to their native message attributes
+type PublishOptions struct {
+	Headers       map[string]interface{}
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Priority      uint8
+	Expiration    time.Duration
+	Persistent    bool
+	// DeliverAt hold the message until the time, zero means deliver immediately
+	DeliverAt time.Time
+	// PartitionKey select the partition of a partitioned topic, messages of the same key are consumed in order
+	PartitionKey string
+	// Type is the proto full name of the message, it is set by publishers, see SchemaRegistry.CheckPublish
+	Type string
+}
+
+type PublishOption func(opts *PublishOptions)
+
+// Delay is how long the message should be held from now, 0 if it should be delivered immediately
+func (opts *PublishOptions) Delay() time.Duration {
+	if opts.DeliverAt.IsZero() {
+		return 0
+	}
+	if d := time.Until(opts.DeliverAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// NewPublishOptions apply opts on the defaults, persistent should be true for reliable publisher
+func NewPublishOptions(persistent bool, opts ...PublishOption) *PublishOptions {
+	out := &PublishOptions{
+		Persistent: persistent,
+	}
+	for _, o := range opts {
+		o(out)
+	}
+	return out
+}
+
+// Headers merge headers into message headers
+func Headers(headers map[string]interface{}) PublishOption {
+	return func(opts *PublishOptions) {
+		for k, v := range headers {
+			Header(k, v)(opts)
+		}
+	}
+}
+
+// Header set a single message header
+func Header(key string, value interface{}) PublishOption {
+	return func(opts *PublishOptions) {
+		if opts.Headers == nil {
+			opts.Headers = map[string]interface{}{}
+		}
+		opts.Headers[key] = value
+	}
+}
+
+func MessageID(id string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.MessageID = id
+	}
+}
+
+func CorrelationID(id string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.CorrelationID = id
+	}
+}
+
+// ReplyTo set the queue the consumer should reply to, see Requester
+func ReplyTo(queue string) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.ReplyTo = queue
+	}
+}
+
+// Priority set message priority, only take effect on priority queue
+func Priority(priority uint8) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.Priority = priority
+	}
+}
+
+// Expiration discard the message if it is not consumed within d
+func Expiration(d time.Duration) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.Expiration = d
+	}
+}
+
+// Persistent override the delivery mode, reliable publisher is persistent by default
+func Persistent(persistent bool) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.Persistent = persistent
+	}
+}
+
+// DeliverAt hold the message until t, a time in the past means deliver immediately.
+// Brokers may deliver a delayed message later than t but never earlier, the precision depends on broker.
+// Delayed message can not expire, publishing fails with ErrDelayedExpiration if Expiration set as well
+func DeliverAt(t time.Time) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.DeliverAt = t
+	}
+}
+
+// DeliverAfter hold the message for d since published, see DeliverAt
+func DeliverAfter(d time.Duration) PublishOption {
+	return func(opts *PublishOptions) {
+		opts.DeliverAt = time.Now().Add(d)
+	}
+}
@@ -0,0 +1,40 @@
+package broker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestNewPublishOptions(t *testing.T) {
+	opts := NewPublishOptions(true,
+		Headers(map[string]interface{}{"a": "1"}),
+		Header("b", int32(2)),
+		MessageID("id"),
+		CorrelationID("cid"),
+		Priority(3),
+		Expiration(time.Second),
+	)
+	assert.Equal(t, &PublishOptions{
+		Headers:       map[string]interface{}{"a": "1", "b": int32(2)},
+		MessageID:     "id",
+		CorrelationID: "cid",
+		Priority:      3,
+		Expiration:    time.Second,
+		Persistent:    true,
+	}, opts)
+
+	assert.False(t, NewPublishOptions(true, Persistent(false)).Persistent)
+	assert.Nil(t, NewPublishOptions(false).Headers)
+}
+
+func TestDeliverAt(t *testing.T) {
+	assert.Zero(t, NewPublishOptions(false).Delay())
+	assert.Zero(t, NewPublishOptions(false, DeliverAt(time.Now().Add(-time.Second))).Delay())
+
+	delay := NewPublishOptions(false, DeliverAfter(time.Minute)).Delay()
+	assert.True(t, delay > 59*time.Second && delay <= time.Minute, delay)
+
+	at := time.Now().Add(time.Hour)
+	assert.Equal(t, at, NewPublishOptions(false, DeliverAt(at)).DeliverAt)
+}
@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+const (
+	// FailureReasonHeader carry the error of the handler which dead-lettered the message
+	FailureReasonHeader = "x-failure-reason"
+	// FailedSubscriptionHeader carry the subscription which dead-lettered the message
+	FailedSubscriptionHeader = "x-failed-subscription"
+	// DeathHeader is the dead-letter history stamped by RabbitMQ, the most recent death first
+	DeathHeader = "x-death"
+)
+
+// Death is an entry of the x-death header, one per queue and reason a message has been dead-lettered from
+type Death struct {
+	Queue       string
+	Reason      string
+	Exchange    string
+	RoutingKeys []string
+	Count       int64
+	Time        time.Time
+}
+
+// DeadLetter describe why and where a quarantined message failed, see DeadLetterOf
+type DeadLetter struct {
+	// OriginalTopic is the topic the message was published to
+	OriginalTopic string
+	// Subscription is the subscription which failed the message
+	Subscription string
+	// Reason is the handler error, or the RabbitMQ reason (rejected, expired, maxlen) if not stamped
+	Reason string
+	Deaths []Death
+}
+
+// DeadLetterOf decode the dead-letter metadata of a message consumed by an error subscribe handler.
+// Headers stamped by the failed subscription take precedence over the x-death history.
+func DeadLetterOf(meta Metadata) *DeadLetter {
+	out := &DeadLetter{
+		Deaths: Deaths(meta.Headers),
+	}
+	if len(out.Deaths) > 0 {
+		// expirations of retry queues are not where the message failed
+		death := out.Deaths[0]
+		for _, d := range out.Deaths {
+			if d.Reason != "expired" {
+				death = d
+				break
+			}
+		}
+		out.Subscription = death.Queue
+		out.Reason = death.Reason
+		if len(death.RoutingKeys) > 0 {
+			out.OriginalTopic = death.RoutingKeys[0]
+		}
+	}
+
+	if v, ok := meta.Headers[OriginalTopicHeader].(string); ok {
+		out.OriginalTopic = v
+	}
+	if v, ok := meta.Headers[FailedSubscriptionHeader].(string); ok {
+		out.Subscription = v
+	}
+	if v, ok := meta.Headers[FailureReasonHeader].(string); ok {
+		out.Reason = v
+	}
+	if out.OriginalTopic == "" {
+		out.OriginalTopic = meta.Topic
+	}
+	return out
+}
+
+// DeadLetterHeaders return a copy of headers stamped with the failure of subscription on topic
+func DeadLetterHeaders(headers map[string]interface{}, topic, subscription string, err error) map[string]interface{} {
+	out := make(map[string]interface{}, len(headers)+3)
+	for k, v := range headers {
+		out[k] = v
+	}
+	if _, ok := out[OriginalTopicHeader]; !ok {
+		out[OriginalTopicHeader] = topic
+	}
+	out[FailedSubscriptionHeader] = subscription
+	if err != nil {
+		out[FailureReasonHeader] = err.Error()
+	}
+	return out
+}
+
+// Deaths decode the x-death header, nil if absent or malformed
+func Deaths(headers map[string]interface{}) []Death {
+	entries, ok := headers[DeathHeader].([]interface{})
+	if !ok {
+		return nil
+	}
+
+	out := make([]Death, 0, len(entries))
+	for _, entry := range entries {
+		table, ok := asTable(entry)
+		if !ok {
+			continue
+		}
+		death := Death{
+			Queue:    fmt.Sprint(table["queue"]),
+			Reason:   fmt.Sprint(table["reason"]),
+			Exchange: fmt.Sprint(table["exchange"]),
+		}
+		if keys, ok := table["routing-keys"].([]interface{}); ok {
+			for _, key := range keys {
+				death.RoutingKeys = append(death.RoutingKeys, fmt.Sprint(key))
+			}
+		}
+		switch v := table["count"].(type) {
+		case int64:
+			death.Count = v
+		case int32:
+			death.Count = int64(v)
+		case int:
+			death.Count = int64(v)
+		}
+		if v, ok := table["time"].(time.Time); ok {
+			death.Time = v
+		}
+		out = append(out, death)
+	}
+	return out
+}
+
+var tableType = reflect.TypeOf(map[string]interface{}{})
+
+// asTable convert the named map types of client libraries, e.g. amqp.Table, to a plain map
+func asTable(v interface{}) (map[string]interface{}, bool) {
+	if table, ok := v.(map[string]interface{}); ok {
+		return table, true
+	}
+	rv := reflect.ValueOf(v)
+	if !rv.IsValid() || !rv.Type().ConvertibleTo(tableType) {
+		return nil, false
+	}
+	return rv.Convert(tableType).Interface().(map[string]interface{}), true
+}
@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// table mimic amqp.Table, a named map type of the client library
+type table map[string]interface{}
+
+func TestDeaths(t *testing.T) {
+	now := time.Now()
+	headers := map[string]interface{}{
+		DeathHeader: []interface{}{
+			table{"queue": "user", "reason": "rejected", "exchange": "topic", "routing-keys": []interface{}{"user.created"}, "count": int64(2), "time": now},
+			map[string]interface{}{"queue": "user.retry.1000", "reason": "expired", "count": int32(1)},
+			"malformed",
+		},
+	}
+	assert.Equal(t, []Death{
+		{Queue: "user", Reason: "rejected", Exchange: "topic", RoutingKeys: []string{"user.created"}, Count: 2, Time: now},
+		{Queue: "user.retry.1000", Reason: "expired", Exchange: "<nil>", Count: 1},
+	}, Deaths(headers))
+	assert.Nil(t, Deaths(nil))
+}
+
+func TestDeadLetterOf(t *testing.T) {
+	deaths := []interface{}{
+		table{"queue": "user.retry.1000", "reason": "expired", "routing-keys": []interface{}{"user.retry.1000"}, "count": int64(1)},
+		table{"queue": "user", "reason": "rejected", "routing-keys": []interface{}{"user.created"}, "count": int64(1)},
+	}
+	dead := DeadLetterOf(Metadata{Topic: "error.user.created", Headers: map[string]interface{}{DeathHeader: deaths}})
+	assert.Equal(t, "user.created", dead.OriginalTopic)
+	assert.Equal(t, "user", dead.Subscription)
+	assert.Equal(t, "rejected", dead.Reason)
+	assert.Len(t, dead.Deaths, 2)
+
+	headers := DeadLetterHeaders(map[string]interface{}{DeathHeader: deaths}, "user.updated", "audit", errors.New("boom"))
+	dead = DeadLetterOf(Metadata{Topic: "error.user.updated", Headers: headers})
+	assert.Equal(t, "user.updated", dead.OriginalTopic)
+	assert.Equal(t, "audit", dead.Subscription)
+	assert.Equal(t, "boom", dead.Reason)
+
+	dead = DeadLetterOf(Metadata{Topic: "error.user.deleted"})
+	assert.Equal(t, "error.user.deleted", dead.OriginalTopic)
+	assert.Empty(t, dead.Reason)
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	origin := map[string]interface{}{OriginalTopicHeader: "user.created"}
+	headers := DeadLetterHeaders(origin, "user", "audit", nil)
+	assert.Equal(t, map[string]interface{}{OriginalTopicHeader: "user.created", FailedSubscriptionHeader: "audit"}, headers)
+	assert.Len(t, origin, 1)
+}
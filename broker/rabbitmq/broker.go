@@ -2,11 +2,16 @@
 package rabbitmq
 
 import (
+	"context"
 	"fmt"
+	"github.com/Ankr-network/kit/app"
 	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/spill"
+	"github.com/golang/protobuf/proto"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
 	"regexp"
+	"sync"
 	"time"
 )
 
@@ -15,9 +20,23 @@ var (
 )
 
 type Options struct {
-	DLX       string
-	ALT       string
-	NackDelay time.Duration
+	DLX             string
+	ALT             string
+	NackDelay       time.Duration
+	ShutdownTimeout time.Duration
+	PublishChannels int
+	DialOptions     []DialOption
+	Health          HealthReporter
+	HealthService   string
+	Topology        *Topology
+	Conflict        ConflictStrategy
+	Partitions      map[string]int
+	Metrics         broker.MetricsRecorder
+	// QueueStatInterval is how often the depth of subscribed queues is reported to Metrics
+	QueueStatInterval time.Duration
+	// SpillDir is the directory of the spill buffer of publishers, empty to disable it
+	SpillDir     string
+	SpillOptions []spill.Option
 }
 
 type Option func(opts *Options)
@@ -40,27 +59,126 @@ func WithNackDelay(delay time.Duration) Option {
 	}
 }
 
+// WithShutdownTimeout set how long the broker wait in-flight messages on application exit
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(cfg *Options) {
+		cfg.ShutdownTimeout = timeout
+	}
+}
+
+// WithPublishChannels set the number of long-lived channels each publisher pipelines publishings on
+func WithPublishChannels(n int) Option {
+	return func(cfg *Options) {
+		cfg.PublishChannels = n
+	}
+}
+
+// WithDialOptions set the reconnect options of the connections of the broker
+func WithDialOptions(opts ...DialOption) Option {
+	return func(cfg *Options) {
+		cfg.DialOptions = append(cfg.DialOptions, opts...)
+	}
+}
+
+// WithHealthReporter report the broker status as service to reporter whenever a connection state changed,
+// e.g. WithHealthReporter(rpcServer.Health, "rabbitmq")
+func WithHealthReporter(reporter HealthReporter, service string) Option {
+	return func(cfg *Options) {
+		cfg.Health = reporter
+		cfg.HealthService = service
+	}
+}
+
+// WithTopology apply topology along with the exchanges of the broker on start
+func WithTopology(topology *Topology) Option {
+	return func(cfg *Options) {
+		cfg.Topology = topology
+	}
+}
+
+// WithMetrics record publishings, deliveries and queue stats to recorder, see package broker/metrics
+func WithMetrics(recorder broker.MetricsRecorder) Option {
+	return func(cfg *Options) {
+		cfg.Metrics = recorder
+	}
+}
+
+// WithQueueStatInterval set how often the depth of subscribed queues is reported to metrics, default 30s
+func WithQueueStatInterval(interval time.Duration) Option {
+	return func(cfg *Options) {
+		cfg.QueueStatInterval = interval
+	}
+}
+
+// WithSpillBuffer spill publishings to a bounded log in dir while RabbitMQ is unavailable, they are replayed in order
+// once reconnected. Publishing fails fast with ErrCircuitOpen when the log is full, see spill.WithMaxSize.
+func WithSpillBuffer(dir string, opts ...spill.Option) Option {
+	return func(cfg *Options) {
+		cfg.SpillDir = dir
+		cfg.SpillOptions = opts
+	}
+}
+
+// WithConflictStrategy set how to resolve arguments conflicts of live exchanges and queues, default ConflictRecreateIfEmpty
+func WithConflictStrategy(strategy ConflictStrategy) Option {
+	return func(cfg *Options) {
+		cfg.Conflict = strategy
+	}
+}
+
 type rabbitBroker struct {
-	url       string
-	exchange  string
-	dlx       string
-	alt       string
-	nackDelay time.Duration
+	url             string
+	exchange        string
+	dlx             string
+	alt             string
+	nackDelay       time.Duration
+	publishChannels int
+	dialOptions     []DialOption
+	health          HealthReporter
+	healthService   string
+	topology        *Topology
+	conflict        ConflictStrategy
+	partitions      map[string]int
+	metrics         broker.MetricsRecorder
+	delayer         *delayer
+	spiller         *spiller
+	// ctx is the parent context of handlers, cancelled after the broker closed
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	m             sync.Mutex
+	closed        bool
+	subscriptions map[*rabbitSubscription]struct{}
+	publishers    map[*rabbitPublisher]struct{}
+	requesters    map[*rabbitRequester]struct{}
+
+	hm    sync.Mutex
+	conns map[*Connection]struct{}
 }
 
-func NewRabbitMQBrokerWithConfig() broker.Broker {
+func NewRabbitMQBrokerWithConfig(opts ...Option) broker.Broker {
+	cfg := MustLoadConfig()
 	return NewRabbitMQBroker(
-		MustLoadConfig().URL,
-		MustLoadConfig().Exchange,
-		WithALT(MustLoadConfig().ALT),
-		WithDLX(MustLoadConfig().DLX),
-		WithNackDelay(MustLoadConfig().NackDelay),
+		cfg.URL,
+		cfg.Exchange,
+		append([]Option{
+			WithALT(cfg.ALT),
+			WithDLX(cfg.DLX),
+			WithNackDelay(cfg.NackDelay),
+			WithShutdownTimeout(cfg.ShutdownTimeout),
+			WithPublishChannels(cfg.PublishChannels),
+			WithDialOptions(WithMaxReconnectAttempts(cfg.MaxReconnectAttempts)),
+		}, opts...)...,
 	)
 }
 
 func NewRabbitMQBroker(url, exchange string, opts ...Option) broker.Broker {
 	options := &Options{
-		NackDelay: 5 * time.Second,
+		NackDelay:         5 * time.Second,
+		ShutdownTimeout:   30 * time.Second,
+		PublishChannels:   4,
+		Metrics:           broker.NopMetrics,
+		QueueStatInterval: 30 * time.Second,
 	}
 	for _, o := range opts {
 		o(options)
@@ -76,9 +194,42 @@ func NewRabbitMQBroker(url, exchange string, opts ...Option) broker.Broker {
 		dlx:       options.DLX,
 		alt:       options.ALT,
 		nackDelay: options.NackDelay,
+
+		publishChannels: options.PublishChannels,
+		dialOptions:     options.DialOptions,
+		health:          options.Health,
+		healthService:   options.HealthService,
+		topology:        options.Topology,
+		conflict:        options.Conflict,
+		partitions:      options.Partitions,
+		metrics:         options.Metrics,
+		subscriptions:   map[*rabbitSubscription]struct{}{},
+		publishers:      map[*rabbitPublisher]struct{}{},
+		requesters:      map[*rabbitRequester]struct{}{},
+		conns:           map[*Connection]struct{}{},
 	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
+	out.delayer = newDelayer(out)
 
 	out.init()
+	if options.SpillDir != "" {
+		var err error
+		if out.spiller, err = newSpiller(out, options.SpillDir, options.SpillOptions...); err != nil {
+			log.Fatal("open spill buffer error", zap.String("dir", options.SpillDir), zap.Error(err))
+		}
+	}
+	out.reportHealth()
+	if options.Metrics != broker.NopMetrics {
+		go out.reportQueueStats(options.QueueStatInterval)
+	}
+
+	app.SubSync(app.ExitTopic, func(_ app.Event) {
+		ctx, cancel := context.WithTimeout(context.Background(), options.ShutdownTimeout)
+		defer cancel()
+		if err := out.Close(ctx); err != nil && err != broker.ErrClosed {
+			log.Error("close broker error", zap.Error(err))
+		}
+	})
 
 	return out
 }
@@ -90,21 +241,28 @@ func (r *rabbitBroker) init() {
 	}
 	defer conn.Close()
 
-	ch, err := conn.Channel()
+	changes, err := r.exchangeTopology().Merge(r.topology).Apply(conn, r.conflict)
 	if err != nil {
-		log.Fatal("conn.Channel error", zap.Error(err))
+		log.Fatal("apply topology error", zap.Error(err))
+	}
+	for _, c := range changes {
+		if c.Action == ActionCreate || c.Action == ActionConflict {
+			log.Info("topology changed", zap.Stringer("change", c))
+		}
 	}
-	defer ch.Close()
+}
 
+// exchangeTopology is the exchanges of the broker, DLX and ALT are optional
+func (r *rabbitBroker) exchangeTopology() *Topology {
+	out := &Topology{}
 	if r.dlx != "" {
-		mustTopicExchangeDeclare(r.dlx, nil, ch)
+		out.Exchanges = append(out.Exchanges, ExchangeSpec{Name: r.dlx, Durable: true})
 	}
-	var exchangeArgs amqp.Table
 	if r.alt != "" {
-		mustTopicExchangeDeclare(r.alt, nil, ch)
-		exchangeArgs = amqp.Table{"alternate-exchange": r.alt}
+		out.Exchanges = append(out.Exchanges, ExchangeSpec{Name: r.alt, Durable: true})
 	}
-	mustTopicExchangeDeclare(r.exchange, exchangeArgs, ch)
+	out.Exchanges = append(out.Exchanges, ExchangeSpec{Name: r.exchange, Durable: true, AlternateExchange: r.alt})
+	return out
 }
 
 func (r *rabbitBroker) TopicPublisher(topic string, opts ...broker.Option) (broker.Publisher, error) {
@@ -115,71 +273,250 @@ func (r *rabbitBroker) MultiTopicPublisher(opts ...broker.Option) (broker.MultiT
 	return r.createPublisher("", opts...)
 }
 
-func (r *rabbitBroker) RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) error {
+func (r *rabbitBroker) BatchPublisher(opts ...broker.Option) (broker.BatchPublisher, error) {
+	return r.createPublisher("", append(opts, broker.Reliable())...)
+}
+
+func (r *rabbitBroker) Requester(opts ...broker.Option) (broker.Requester, error) {
 	brokerOptions := &broker.Options{
-		Reliable: false,
-		MaxRetry: 0,
+		Codec: broker.ProtoCodec,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return nil, broker.ErrClosed
+	}
+
+	out, err := newRabbitRequester(r, brokerOptions)
+	if err != nil {
+		return nil, err
 	}
+	r.requesters[out] = struct{}{}
+
+	return out, nil
+}
 
+// RegisterResponder subscribe requests of topic, the reply is encoded as the request
+func (r *rabbitBroker) RegisterResponder(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	brokerOptions := &broker.Options{}
 	for _, o := range opts {
 		o(brokerOptions)
 	}
 
-	h, err := newHandler(handler, brokerOptions.Reliable, brokerOptions.MaxRetry, r.nackDelay)
+	var p *rabbitPublisher
+	fn, err := broker.NewResponder(handler, func(ctx context.Context, meta broker.Metadata, resp proto.Message, err error) error {
+		return p.reply(ctx, meta, broker.ReplyCodec(brokerOptions.Codec, meta), resp, err)
+	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if p, err = r.createPublisher("", opts...); err != nil {
+		return nil, err
 	}
+	return r.register(name, []string{topic}, fmt.Sprintf("error.%s", topic), broker.SingleRouter(fn), opts)
+}
 
-	s, err := newRabbitSubscriber(r, name, topic, brokerOptions.Reliable)
+func (r *rabbitBroker) RegisterSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	fn, err := broker.NewHandler(handler)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return r.register(name, []string{topic}, fmt.Sprintf("error.%s", topic), broker.SingleRouter(fn), opts)
+}
 
-	deliveries, err := s.Consume()
+func (r *rabbitBroker) RegisterRouter(name string, routes map[string]interface{}, opts ...broker.Option) (broker.Subscription, error) {
+	if len(routes) == 0 {
+		return nil, broker.ErrNoRoute
+	}
+	brokerOptions := &broker.Options{}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	router, err := broker.NewRouter(routes, brokerOptions.Fallback)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return r.register(name, router.Bindings(), fmt.Sprintf("error.%s", name), router, opts)
+}
+
+func (r *rabbitBroker) register(name string, topics []string, errTopic string, router *broker.Router, opts []broker.Option) (broker.Subscription, error) {
+	brokerOptions := &broker.Options{
+		Reliable:    false,
+		MaxRetry:    0,
+		Concurrency: 1,
+	}
+
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+
+	if brokerOptions.Concurrency < 1 {
+		brokerOptions.Concurrency = 1
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(r.nackDelay)
+	}
+	if err := brokerOptions.Schemas.CheckRouter(topics, router); err != nil {
+		return nil, err
+	}
+
+	if n, ok := r.partitions[topics[0]]; ok && len(topics) == 1 {
+		return r.registerPartitions(name, topics[0], n, router, brokerOptions)
+	}
+
+	h := newRouterHandler(name, router, brokerOptions)
+	h.metrics = r.metrics
+
+	s, err := newRabbitSubscriber(r, name, topics, errTopic, brokerOptions.Reliable, prefetch(brokerOptions, brokerOptions.Concurrency))
+	if err != nil {
+		return nil, err
+	}
+	if brokerOptions.Reliable {
+		h.retrier = newRetrier(s.conn, name)
+	}
+	if brokerOptions.Reliable && r.dlx != "" {
+		h.quarantiner = newQuarantiner(s.conn, r.dlx, errTopic, name)
 	}
 
-	go h.consume(deliveries)
+	return r.subscribe(s, h, brokerOptions.Concurrency)
+}
 
-	return nil
+// prefetch return the prefetch of a subscription handling concurrency messages at a time, default concurrency
+func prefetch(opts *broker.Options, concurrency int) int {
+	if opts.Prefetch == 0 {
+		return concurrency
+	}
+	return opts.Prefetch
 }
 
-func (r *rabbitBroker) RegisterErrSubscribeHandler(name, topic string, handler interface{}) error {
+// RegisterErrSubscribeHandler consume the messages dead-lettered with topic, see broker.DeadLetterOf for why they failed.
+// Messages are acked after handled, a failed one is retried with the backoff option until handled.
+func (r *rabbitBroker) RegisterErrSubscribeHandler(name, topic string, handler interface{}, opts ...broker.Option) (broker.Subscription, error) {
 	if r.dlx == "" {
-		return fmt.Errorf("broker without dead-letter exchange")
+		return nil, fmt.Errorf("broker without dead-letter exchange")
 	}
-	h, err := newErrHandler(handler)
-	if err != nil {
-		return err
+	brokerOptions := &broker.Options{
+		Concurrency: 1,
+	}
+	for _, o := range opts {
+		o(brokerOptions)
+	}
+	if brokerOptions.Concurrency < 1 {
+		brokerOptions.Concurrency = 1
+	}
+	if brokerOptions.Backoff == nil {
+		brokerOptions.Backoff = broker.FixedBackoff(r.nackDelay)
 	}
 
-	s, err := newErrRabbitSubscriber(r, name, topic)
+	h, err := newErrHandler(name, handler, brokerOptions)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	h.metrics = r.metrics
 
-	deliveries, err := s.Consume()
+	s, err := newErrRabbitSubscriber(r, name, topic, prefetch(brokerOptions, brokerOptions.Concurrency))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	h.retrier = newRetrier(s.conn, name)
+
+	return r.subscribe(s, h, brokerOptions.Concurrency)
+}
+
+func (r *rabbitBroker) Close(ctx context.Context) error {
+	r.m.Lock()
+	if r.closed {
+		r.m.Unlock()
+		return broker.ErrClosed
 	}
+	r.closed = true
+	subscriptions := make([]*rabbitSubscription, 0, len(r.subscriptions))
+	for s := range r.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	r.m.Unlock()
 
-	go h.consume(deliveries)
+	var (
+		wg     sync.WaitGroup
+		em     sync.Mutex
+		result error
+	)
+	for _, s := range subscriptions {
+		wg.Add(1)
+		go func(s *rabbitSubscription) {
+			defer wg.Done()
+			if err := s.Unsubscribe(ctx); err != nil {
+				em.Lock()
+				if result == nil {
+					result = err
+				}
+				em.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
 
-	return nil
+	// close publishers after subscriptions, in-flight handlers may still publish
+	r.m.Lock()
+	for p := range r.publishers {
+		if err := p.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	r.publishers = map[*rabbitPublisher]struct{}{}
+	for rr := range r.requesters {
+		if err := rr.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	r.requesters = map[*rabbitRequester]struct{}{}
+	r.m.Unlock()
+
+	if r.spiller != nil {
+		if err := r.spiller.close(); err != nil && result == nil {
+			result = err
+		}
+	}
+
+	r.cancel()
+
+	return result
+}
+
+func (r *rabbitBroker) removeSubscription(s *rabbitSubscription) {
+	r.m.Lock()
+	delete(r.subscriptions, s)
+	r.m.Unlock()
 }
 
 func (r *rabbitBroker) createPublisher(topic string, opts ...broker.Option) (*rabbitPublisher, error) {
 	brokerOptions := &broker.Options{
 		Reliable: false,
 		MaxRetry: 0,
+		Codec:    broker.ProtoCodec,
 	}
 
 	for _, o := range opts {
 		o(brokerOptions)
 	}
 
-	return newRabbitPublisher(r, topic, brokerOptions.Reliable)
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		return nil, broker.ErrClosed
+	}
+
+	out, err := newRabbitPublisher(r, topic, brokerOptions)
+	if err != nil {
+		return nil, err
+	}
+	r.publishers[out] = struct{}{}
+
+	return out, nil
 }
 
 // *** below are deprecated ***
@@ -198,8 +535,10 @@ func (r *rabbitBroker) Subscribe(name, topic string, reliable, requeue bool, han
 		if requeue {
 			maxRetry = 1
 		}
-		return r.RegisterSubscribeHandler(name, topic, handler, broker.Reliable(), broker.MaxRetry(maxRetry))
+		_, err := r.RegisterSubscribeHandler(name, topic, handler, broker.Reliable(), broker.MaxRetry(maxRetry))
+		return err
 	} else {
-		return r.RegisterSubscribeHandler(name, topic, handler)
+		_, err := r.RegisterSubscribeHandler(name, topic, handler)
+		return err
 	}
 }
@@ -1,6 +1,7 @@
 package rabbitmq
 
 import (
+	"github.com/Ankr-network/kit/broker"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
 	"sync"
@@ -14,14 +15,80 @@ const (
 	connectionReconnectDelay = 2
 )
 
-// Connection amqp.Connection wrapper
+// ConnectionState is the lifecycle state of a Connection
+type ConnectionState int32
+
+const (
+	// StateConnected connection is open
+	StateConnected ConnectionState = iota
+	// StateDisconnected connection lost, reconnect will start
+	StateDisconnected
+	// StateReconnecting waiting or dialing for the next reconnect attempt
+	StateReconnecting
+	// StateClosed closed by developer or reconnect attempts exhausted, it is the final state
+	StateClosed
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case StateConnected:
+		return "connected"
+	case StateDisconnected:
+		return "disconnected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+type DialOptions struct {
+	// ReconnectBackoff is the delay before each reconnect attempt
+	ReconnectBackoff broker.Backoff
+	// MaxReconnectAttempts is the limit of consecutive reconnect attempts, 0 means unlimited
+	MaxReconnectAttempts int
+}
+
+type DialOption func(opts *DialOptions)
+
+func WithReconnectBackoff(backoff broker.Backoff) DialOption {
+	return func(opts *DialOptions) {
+		opts.ReconnectBackoff = backoff
+	}
+}
+
+func WithMaxReconnectAttempts(n int) DialOption {
+	return func(opts *DialOptions) {
+		opts.MaxReconnectAttempts = n
+	}
+}
+
+// Connection amqp.Connection wrapper, it reconnects after connection lost.
+// During the outage Channel returns error immediately instead of blocking.
 type Connection struct {
 	*amqp.Connection
-	m sync.RWMutex
+	m       sync.RWMutex
+	url     string
+	options *DialOptions
+	state   int32
+	closing int32
+	done    chan struct{}
+
+	lm        sync.Mutex
+	listeners []chan ConnectionState
 }
 
 // Dial wrap amqp.Dial, dial and get a reconnect connection
-func Dial(url string) (*Connection, error) {
+func Dial(url string, opts ...DialOption) (*Connection, error) {
+	options := &DialOptions{
+		ReconnectBackoff: broker.Jitter(broker.ExponentialBackoff(connectionReconnectDelay*time.Second, time.Minute), 0.2),
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
 	conn, err := amqp.Dial(url)
 	if err != nil {
 		return nil, err
@@ -29,38 +96,131 @@ func Dial(url string) (*Connection, error) {
 
 	connection := &Connection{
 		Connection: conn,
+		url:        url,
+		options:    options,
+		state:      int32(StateConnected),
+		done:       make(chan struct{}),
 	}
 
-	go func() {
-		for {
-			reason, ok := <-connection.Connection.NotifyClose(make(chan *amqp.Error))
-			// exit this goroutine if closed by developer
-			if !ok {
-				log.Info("connection closed")
-				break
-			}
-			log.Info("connection closed", zap.Reflect("reason", reason))
+	go connection.watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
 
-			connection.m.Lock()
-			// reconnect if not closed by developer
-			for {
-				// wait 1s for reconnect
-				time.Sleep(connectionReconnectDelay * time.Second)
-
-				conn, err := amqp.Dial(url)
-				if err == nil {
-					connection.Connection = conn
-					log.Info("reconnect success")
-					connection.m.Unlock()
-					break
-				}
+	return connection, nil
+}
 
-				log.Error("reconnect error", zap.Error(err))
-			}
+func (c *Connection) watch(closeCh chan *amqp.Error) {
+	for {
+		reason, ok := <-closeCh
+		// exit this goroutine if closed by developer
+		if !ok || c.isClosing() {
+			log.Info("connection closed")
+			c.setState(StateClosed)
+			return
 		}
-	}()
+		log.Info("connection closed", zap.Reflect("reason", reason))
+		c.setState(StateDisconnected)
 
-	return connection, nil
+		if closeCh, ok = c.reconnect(); !ok {
+			c.setState(StateClosed)
+			return
+		}
+		c.setState(StateConnected)
+	}
+}
+
+// reconnect dial until success, the connection is swapped under write lock only after dialed
+func (c *Connection) reconnect() (chan *amqp.Error, bool) {
+	for attempt := 1; c.options.MaxReconnectAttempts == 0 || attempt <= c.options.MaxReconnectAttempts; attempt++ {
+		c.setState(StateReconnecting)
+		select {
+		case <-time.After(c.options.ReconnectBackoff(attempt)):
+		case <-c.done:
+			return nil, false
+		}
+
+		conn, err := amqp.Dial(c.url)
+		if err != nil {
+			log.Error("reconnect error", zap.Error(err), zap.Int("attempt", attempt))
+			continue
+		}
+		closeCh := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		c.m.Lock()
+		if c.isClosing() {
+			c.m.Unlock()
+			_ = conn.Close()
+			return nil, false
+		}
+		c.Connection = conn
+		c.m.Unlock()
+
+		log.Info("reconnect success", zap.Int("attempt", attempt))
+		return closeCh, true
+	}
+
+	log.Error("reconnect attempts exhausted, connection closed", zap.Int("attempts", c.options.MaxReconnectAttempts))
+	return nil, false
+}
+
+// Close close the connection and stop reconnecting
+func (c *Connection) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closing, 0, 1) {
+		return amqp.ErrClosed
+	}
+	close(c.done)
+
+	c.m.RLock()
+	defer c.m.RUnlock()
+	// the connection lost during reconnecting is already closed
+	if err := c.Connection.Close(); err != nil && err != amqp.ErrClosed {
+		return err
+	}
+	return nil
+}
+
+func (c *Connection) isClosing() bool {
+	return atomic.LoadInt32(&c.closing) == 1
+}
+
+// State return the current state
+func (c *Connection) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+// Healthy report whether the connection is open
+func (c *Connection) Healthy() bool {
+	return c.State() == StateConnected
+}
+
+// NotifyState register a listener of state changes, the channel is closed after StateClosed sent.
+// Like amqp notifications, the channel should be buffered and always drained, or the reconnecting blocks.
+func (c *Connection) NotifyState(ch chan ConnectionState) chan ConnectionState {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+
+	if c.State() == StateClosed {
+		close(ch)
+		return ch
+	}
+	c.listeners = append(c.listeners, ch)
+	return ch
+}
+
+func (c *Connection) setState(state ConnectionState) {
+	c.lm.Lock()
+	defer c.lm.Unlock()
+
+	if ConnectionState(atomic.SwapInt32(&c.state, int32(state))) == state {
+		return
+	}
+	for _, l := range c.listeners {
+		l <- state
+		if state == StateClosed {
+			close(l)
+		}
+	}
+	if state == StateClosed {
+		c.listeners = nil
+	}
 }
 
 // Channel wrap amqp.Connection.Channel, get a auto reconnect channel
@@ -81,7 +241,7 @@ func (c *Connection) Channel(reconnect bool) (*Channel, error) {
 			for {
 				reason, ok := <-resultChannel.Channel.NotifyClose(make(chan *amqp.Error))
 				// exit this goroutine if closed by developer
-				if !ok || resultChannel.IsClosed() {
+				if !ok || resultChannel.IsClosed() || c.State() == StateClosed {
 					log.Info("channel closed")
 					if err := resultChannel.Close(); err != nil { // close again, ensure closed flag set when connection closed
 						log.Error("Channel.Close error", zap.Error(err))
@@ -95,6 +255,12 @@ func (c *Connection) Channel(reconnect bool) (*Channel, error) {
 				for {
 					// wait 1s for connection reconnect
 					time.Sleep(channelReconnectDelay * time.Second)
+					if c.State() == StateClosed {
+						log.Info("channel closed with connection")
+						atomic.StoreInt32(&resultChannel.closed, 1)
+						resultChannel.m.Unlock()
+						return
+					}
 
 					c.m.RLock()
 					ch, err := c.Connection.Channel()
@@ -102,6 +268,9 @@ func (c *Connection) Channel(reconnect bool) (*Channel, error) {
 					if err == nil {
 						log.Info("channel recreate success")
 						resultChannel.Channel = ch
+						if err := resultChannel.applyQos(); err != nil {
+							log.Error("channel qos error", zap.Error(err))
+						}
 						resultChannel.m.Unlock()
 						break
 					}
@@ -117,8 +286,16 @@ func (c *Connection) Channel(reconnect bool) (*Channel, error) {
 // Channel amqp.Channel wrapper
 type Channel struct {
 	*amqp.Channel
-	closed int32
-	m      sync.RWMutex
+	closed    int32
+	m         sync.RWMutex
+	qos       *qos
+	cancelled sync.Map
+}
+
+type qos struct {
+	prefetchCount int
+	prefetchSize  int
+	global        bool
 }
 
 // IsClosed indicate closed by developer
@@ -137,16 +314,48 @@ func (ch *Channel) Close() error {
 	return ch.Channel.Close()
 }
 
-// Consume wrap amqp.Channel.Consume, the returned delivery will end only when channel closed by developer
+// Qos wrap amqp.Channel.Qos, the qos is reapplied when the channel recreated
+func (ch *Channel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.qos = &qos{
+		prefetchCount: prefetchCount,
+		prefetchSize:  prefetchSize,
+		global:        global,
+	}
+	return ch.applyQos()
+}
+
+func (ch *Channel) applyQos() error {
+	if ch.qos == nil {
+		return nil
+	}
+	return ch.Channel.Qos(ch.qos.prefetchCount, ch.qos.prefetchSize, ch.qos.global)
+}
+
+// Cancel wrap amqp.Channel.Cancel, the delivery returned by Consume for consumer will end once cancelled
+func (ch *Channel) Cancel(consumer string, noWait bool) error {
+	ch.cancelled.Store(consumer, struct{}{})
+	return ch.Channel.Cancel(consumer, noWait)
+}
+
+func (ch *Channel) isCancelled(consumer string) bool {
+	_, ok := ch.cancelled.Load(consumer)
+	return ok
+}
+
+// Consume wrap amqp.Channel.Consume, the returned delivery will end only when channel closed or consumer cancelled by developer
 func (ch *Channel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
 	deliveries := make(chan amqp.Delivery)
 
 	go func() {
+		defer close(deliveries)
 		for {
 			ch.m.RLock()
 			d, err := ch.Channel.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
 			ch.m.RUnlock()
 			if err != nil {
+				if ch.IsClosed() || ch.isCancelled(consumer) {
+					break
+				}
 				log.Error("consume error", zap.Error(err))
 				time.Sleep(consumeRetryDelay * time.Second)
 				continue
@@ -156,6 +365,10 @@ func (ch *Channel) Consume(queue, consumer string, autoAck, exclusive, noLocal,
 				deliveries <- msg
 			}
 
+			if ch.isCancelled(consumer) {
+				break
+			}
+
 			// sleep before IsClose call. closed flag may not set before sleep.
 			time.Sleep(consumeRetryDelay * time.Second)
 
@@ -0,0 +1,119 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+const (
+	// delayQueueHeader route a delayed message to its delay queue through the delay exchange
+	delayQueueHeader = "x-delay-queue"
+	// minDelayStep is the precision of short delays
+	minDelayStep = time.Second
+)
+
+// delayBucket round d up to the delay of a delay queue, it keeps 2 significant digits in milliseconds but
+// at least minDelayStep precision, so a message is never delivered early and at most about 10% or 1s late,
+// while the number of delay queues stays bounded, 90 per order of magnitude.
+func delayBucket(d time.Duration) time.Duration {
+	return roundBucket(d, minDelayStep)
+}
+
+// roundBucket round d up to 2 significant digits in milliseconds, but at least minStep precision
+func roundBucket(d, minStep time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	step := minStep
+	for step*100 <= d {
+		step *= 10
+	}
+	return (d + step - 1) / step * step
+}
+
+func delayExchangeName(exchange string) string {
+	return fmt.Sprintf("%s.delay", exchange)
+}
+
+func delayQueueName(exchange string, delay time.Duration) string {
+	return fmt.Sprintf("%s.delay.%d", exchange, delay/time.Millisecond)
+}
+
+// delayer hold delayed messages in TTL queues without consumer, which dead-letter them back into the exchange
+// with the original routing key once expired. Messages reach the delay queues through a headers exchange so that
+// their routing keys remain the topics.
+//
+// Messages of the same delay queue are delivered in publishing order, while a message with a shorter delay
+// may overtake a message with a longer one published earlier. Delay queues expire messages only at head,
+// that is why every queue has a fixed TTL instead of per-message expiration.
+type delayer struct {
+	broker *rabbitBroker
+
+	m        sync.Mutex
+	declared map[string]bool
+}
+
+func newDelayer(broker *rabbitBroker) *delayer {
+	return &delayer{
+		broker:   broker,
+		declared: map[string]bool{},
+	}
+}
+
+// topology is the delay exchange and the delay queue of delay
+func (d *delayer) topology(delay time.Duration) *Topology {
+	exchange := delayExchangeName(d.broker.exchange)
+	queue := delayQueueName(d.broker.exchange, delay)
+	return d.broker.exchangeTopology().Merge(&Topology{
+		Exchanges: []ExchangeSpec{{Name: exchange, Kind: amqp.ExchangeHeaders, Durable: true}},
+		Queues: []QueueSpec{{
+			Name:               queue,
+			Durable:            true,
+			DeadLetterExchange: d.broker.exchange,
+			MessageTTL:         delay,
+		}},
+		Bindings: []BindingSpec{{
+			Queue:    queue,
+			Exchange: exchange,
+			Args:     amqp.Table{"x-match": "all", delayQueueHeader: queue},
+		}},
+	})
+}
+
+// declare the delay queue of delay once, return the queue name
+func (d *delayer) declare(conn *Connection, delay time.Duration) (string, error) {
+	name := delayQueueName(d.broker.exchange, delay)
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.declared[name] {
+		return name, nil
+	}
+
+	conn.m.RLock()
+	_, err := d.topology(delay).Apply(conn.Connection, d.broker.conflict)
+	conn.m.RUnlock()
+	if err != nil {
+		return "", err
+	}
+	d.declared[name] = true
+	return name, nil
+}
+
+// delay prepare publishing to be held for delay, return the exchange to publish to
+func (d *delayer) delay(conn *Connection, publishing *amqp.Publishing, delay time.Duration) (string, error) {
+	queue, err := d.declare(conn, delayBucket(delay))
+	if err != nil {
+		return "", err
+	}
+
+	headers := amqp.Table{}
+	for k, v := range publishing.Headers {
+		headers[k] = v
+	}
+	headers[delayQueueHeader] = queue
+	publishing.Headers = headers
+	return delayExchangeName(d.broker.exchange), nil
+}
@@ -0,0 +1,61 @@
+package rabbitmq
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestDelayBucket(t *testing.T) {
+	cases := []struct {
+		delay  time.Duration
+		bucket time.Duration
+	}{
+		{0, 0},
+		{time.Millisecond, time.Second},
+		{time.Second, time.Second},
+		{1500 * time.Millisecond, 2 * time.Second},
+		{99 * time.Second, 99 * time.Second},
+		{100 * time.Second, 100 * time.Second},
+		{101 * time.Second, 110 * time.Second},
+		{time.Hour + time.Second, 3700 * time.Second},
+		{24 * time.Hour, 87000 * time.Second},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.bucket, delayBucket(c.delay), c.delay.String())
+	}
+}
+
+// a delayed message is never delivered early, and at most 1s or 10% late
+func TestDelayBucketPrecision(t *testing.T) {
+	buckets := map[time.Duration]struct{}{}
+	for d := time.Millisecond; d < 1000*time.Second; d += 997 * time.Millisecond {
+		bucket := delayBucket(d)
+		assert.True(t, bucket >= d, "early %v for %v", bucket, d)
+		late := bucket - d
+		assert.True(t, late < time.Second || late*10 <= d, "late %v for %v", late, d)
+		buckets[bucket] = struct{}{}
+	}
+	// 100 one-second buckets below 100s, and 90 ten-second buckets below 1000s
+	assert.Len(t, buckets, 190)
+}
+
+func TestDelayTopology(t *testing.T) {
+	b := &rabbitBroker{exchange: "kit", dlx: "kit.dlx"}
+	d := newDelayer(b)
+
+	topology := d.topology(5 * time.Second)
+	require.NoError(t, topology.Validate())
+	assert.Equal(t, "kit.delay.5000", delayQueueName("kit", 5*time.Second))
+
+	queue := topology.Queues[0]
+	assert.Equal(t, "kit.delay.5000", queue.Name)
+	assert.Equal(t, "kit", queue.DeadLetterExchange)
+	assert.Empty(t, queue.DeadLetterRoutingKey, "the routing key must remain the topic")
+	assert.Equal(t, 5*time.Second, queue.MessageTTL)
+
+	binding := topology.Bindings[0]
+	assert.Equal(t, "kit.delay", binding.Exchange)
+	assert.Equal(t, "kit.delay.5000", binding.Args[delayQueueHeader])
+}
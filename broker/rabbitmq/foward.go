@@ -1,97 +1,59 @@
 package rabbitmq
 
 import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
 	"github.com/streadway/amqp"
-	"go.uber.org/zap"
 	"strings"
 )
 
 type (
 	RouteKeyConverter func(key string) string
-	MsgConverter      func(msg amqp.Delivery) amqp.Publishing
+	// DeliveryRouteKeyConverter route a delivery by its headers as well as its routing key
+	DeliveryRouteKeyConverter func(msg amqp.Delivery) string
+	MsgConverter              func(msg amqp.Delivery) amqp.Publishing
 )
 
-func RetryError(srcUrl, dstUrl, errQ, dstEx string, nums int) {
-	Forward(srcUrl, dstUrl, errQ, dstEx, nums, ErrRouteKeyConvert, SameMsgConvert)
+// RetryError replay at most nums messages from error queue errQ to exchange dstEx with the original topics,
+// the retry count and failure headers are stripped so that they are handled as fresh messages
+func RetryError(srcUrl, dstUrl, errQ, dstEx string, nums int) (*ReplayReport, error) {
+	return NewReplayer(srcUrl, dstUrl,
+		WithLimit(nums),
+		WithDeliveryRouteKeyConverter(ErrDeliveryRouteKeyConvert),
+		WithMsgConverter(ErrMsgConvert),
+	).Replay(context.Background(), errQ, dstEx)
 }
 
-func Copy(srcUrl, dstUrl, srcQ, dstEx string, nums int) {
-	Forward(srcUrl, dstUrl, srcQ, dstEx, nums, SameRouteKeyConvert, SameMsgConvert)
+// Copy forward at most nums messages from queue srcQ to exchange dstEx
+func Copy(srcUrl, dstUrl, srcQ, dstEx string, nums int) (*ReplayReport, error) {
+	return Forward(srcUrl, dstUrl, srcQ, dstEx, nums, SameRouteKeyConvert, SameMsgConvert)
 }
 
-func Forward(srcUrl, dstUrl string, srcQ, dstEx string, nums int, routeKeyConvert RouteKeyConverter, msgConvert MsgConverter) {
-	source, err := amqp.Dial(srcUrl)
-	if err != nil {
-		log.Fatal("connection.open source error", zap.Error(err))
-	}
-	defer source.Close()
-
-	chs, err := source.Channel()
-	if err != nil {
-		log.Fatal("channel.open source error", zap.Error(err))
-	}
-
-	shovel, err := chs.Consume(srcQ, "shovel", false, false, false, false, nil)
-	if err != nil {
-		log.Fatal("basic.consume source error", zap.Error(err))
-	}
-
-	// Setup the destination of the store and forward
-	destination, err := amqp.Dial(dstUrl)
-	if err != nil {
-		log.Fatal("connection.open destination error", zap.Error(err))
-	}
-	defer destination.Close()
-
-	chd, err := destination.Channel()
-	if err != nil {
-		log.Fatal("channel.open destination error", zap.Error(err))
-	}
-
-	// Buffer of 1 for our single outstanding publishing
-	confirms := chd.NotifyPublish(make(chan amqp.Confirmation, 1))
-
-	if err := chd.Confirm(false); err != nil {
-		log.Fatal("confirm.select destination error", zap.Error(err))
-	}
-
-	// Now pump the messages, one by one, a smarter implementation
-	// would batch the deliveries and use multiple ack/nacks
-	counts := 0
-	for {
-		if counts == nums {
-			log.Info("finished forward message", zap.Int("counts", counts))
-			break
-		}
-
-		msg, ok := <-shovel
-		if !ok {
-			log.Info("source channel closed, see the reconnect example for handling this")
-		}
-		counts++
-
-		err = chd.Publish(dstEx, routeKeyConvert(msg.RoutingKey), false, false, msgConvert(msg))
-
-		if err != nil {
-			msg.Nack(false, false)
-			log.Fatal("basic.publish destination error", zap.Error(err))
-		}
-
-		log.Info("forward", zap.Int("counts", counts), zap.String("route_key", msg.RoutingKey), zap.Uint64("delivery_tag", msg.DeliveryTag))
-
-		// only ack the source delivery when the destination acks the publishing
-		if confirmed := <-confirms; confirmed.Ack {
-			msg.Ack(false)
-		} else {
-			msg.Nack(false, false)
-		}
-	}
+// Forward forward at most nums messages from queue srcQ to exchange dstEx, it stops early when srcQ drained.
+// See Replayer for filtering and dry-run.
+func Forward(srcUrl, dstUrl string, srcQ, dstEx string, nums int, routeKeyConvert RouteKeyConverter, msgConvert MsgConverter) (*ReplayReport, error) {
+	return NewReplayer(srcUrl, dstUrl,
+		WithLimit(nums),
+		WithRouteKeyConverter(routeKeyConvert),
+		WithMsgConverter(msgConvert),
+	).Replay(context.Background(), srcQ, dstEx)
 }
 
+// ErrRouteKeyConvert strip the error. prefix of the routing key of an error topic, see ErrDeliveryRouteKeyConvert
 func ErrRouteKeyConvert(key string) string {
 	return strings.TrimPrefix(key, "error.")
 }
 
+// ErrDeliveryRouteKeyConvert route a dead-lettered delivery to the topic it was published to, which is recorded in
+// broker.OriginalTopicHeader or x-death. The error topic of a router subscription is error.<name>, not the topic,
+// so the routing key is only trimmed by ErrRouteKeyConvert if none is recorded.
+func ErrDeliveryRouteKeyConvert(msg amqp.Delivery) string {
+	if topic := broker.DeadLetterOf(newMetadata(msg)).OriginalTopic; topic != msg.RoutingKey {
+		return topic
+	}
+	return ErrRouteKeyConvert(msg.RoutingKey)
+}
+
 func SameRouteKeyConvert(key string) string {
 	return key
 }
@@ -119,3 +81,17 @@ func SameMsgConvert(msg amqp.Delivery) amqp.Publishing {
 		Body: msg.Body,
 	}
 }
+
+// ErrMsgConvert copy a dead-lettered delivery without its retry count and failure headers
+func ErrMsgConvert(msg amqp.Delivery) amqp.Publishing {
+	publishing := SameMsgConvert(msg)
+	publishing.Headers = amqp.Table{}
+	for k, v := range msg.Headers {
+		switch k {
+		case broker.RetryCountHeader, broker.FailureReasonHeader, broker.FailedSubscriptionHeader:
+		default:
+			publishing.Headers[k] = v
+		}
+	}
+	return publishing
+}
@@ -1,135 +1,195 @@
 package rabbitmq
 
 import (
+	"context"
 	"errors"
+	"github.com/Ankr-network/kit/broker"
 	"github.com/golang/protobuf/proto"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
-	"reflect"
+	"math"
 	"time"
 )
 
 var (
-	protoMessageType            = reflect.TypeOf((*proto.Message)(nil)).Elem()
-	errorType                   = reflect.TypeOf((*error)(nil)).Elem()
-	errTypeIsNotPtr             = errors.New("type must be pointer")
-	errTypeIsNotProtoMessage    = errors.New("type must be proto.Message")
-	errTypeIsNotError           = errors.New("type must be error")
 	ErrMessageIsNotProtoMessage = errors.New("message must be proto.Message")
-	ErrInvalidHandler           = errors.New("invalid handler, must be func and have single proto.Message implement and return single error")
-	ErrMaxRetryTooMuch          = errors.New("currently only support maxRetry is 1")
+	ErrInvalidHandler           = broker.ErrInvalidHandler
+	// Deprecated: maxRetry is no longer limited, retries are delayed through retry queues
+	ErrMaxRetryTooMuch = errors.New("currently only support maxRetry is 1")
 )
 
 type handler struct {
-	methodValue reflect.Value
-	msgType     reflect.Type
-	reliable    bool
-	maxRetry    int
-	nackDelay   time.Duration
+	name       string
+	router     *broker.Router
+	middleware broker.SubscriberMiddleware
+	dedup      broker.DedupStore
+	codec      broker.Codec
+	schemas    *broker.SchemaRegistry
+	reliable   bool
+	maxRetry   int
+	backoff    broker.Backoff
+	timeout    time.Duration
+	retrier    *retrier
+	// quarantiner stamp the failure reason onto dead-lettered messages, nil to nack them natively
+	quarantiner *quarantiner
+	metrics     broker.MetricsRecorder
 }
 
-func newErrHandler(h interface{}) (*handler, error) {
-	return newHandler(h, false, 0, 0)
+// newErrHandler is a reliable handler of an error queue, failed messages are retried until handled since there is
+// nowhere else to dead-letter them
+func newErrHandler(name string, h interface{}, opts *broker.Options) (*handler, error) {
+	out, err := newHandler(name, h, opts)
+	if err != nil {
+		return nil, err
+	}
+	out.reliable = true
+	out.maxRetry = math.MaxInt32
+	return out, nil
 }
 
-func newHandler(h interface{}, reliable bool, maxRetry int, nacDelay time.Duration) (*handler, error) {
-	if maxRetry > 1 {
-		return nil, ErrMaxRetryTooMuch
-	}
-	ht := reflect.TypeOf(h)
-	if ht.Kind() != reflect.Func {
-		return nil, ErrInvalidHandler
+func newHandler(name string, h interface{}, opts *broker.Options) (*handler, error) {
+	fn, err := broker.NewHandler(h)
+	if err != nil {
+		return nil, err
 	}
+	return newRouterHandler(name, broker.SingleRouter(fn), opts), nil
+}
 
-	if ht.NumIn() != 1 {
-		return nil, ErrInvalidHandler
+func newRouterHandler(name string, router *broker.Router, opts *broker.Options) *handler {
+	return &handler{
+		name:       name,
+		router:     router,
+		middleware: broker.ChainSubscriber(opts.Middlewares...),
+		dedup:      opts.Dedup,
+		codec:      opts.Codec,
+		schemas:    opts.Schemas,
+		reliable:   opts.Reliable,
+		maxRetry:   opts.MaxRetry,
+		backoff:    opts.Backoff,
+		timeout:    opts.Timeout,
+		metrics:    broker.NopMetrics,
 	}
+}
 
-	if ht.NumOut() != 1 {
-		return nil, ErrInvalidHandler
-	}
+func (h *handler) call(ctx context.Context, fn *broker.Handler, msg proto.Message, meta broker.Metadata) error {
+	ctx, cancel := broker.NewHandleContext(ctx, meta, h.timeout)
+	defer cancel()
+	return broker.Dispatch(ctx, h.middleware, h.dedup, h.name, fn, msg, meta)
+}
 
-	mt := ht.In(0)
-	if err := checkIsProtoMessage(mt); err != nil {
-		return nil, ErrInvalidHandler
-	}
+func (h *handler) consume(ctx context.Context, deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		meta := newMetadata(d)
+		if d.Redelivered {
+			h.metrics.Redelivered(h.name, meta.Topic)
+		}
+		fn, err := h.router.Route(meta.Topic)
+		if err != nil {
+			log.Error("route message error, reject it", zap.Error(err), zap.String("topic", meta.Topic), zap.String("queue", h.name))
+			h.deadLetter(d, err)
+			h.metrics.Handled(h.name, meta.Topic, broker.HandleNoRoute, 0)
+			continue
+		}
 
-	et := ht.Out(0)
-	if err := checkIsError(et); err != nil {
-		return nil, ErrInvalidHandler
-	}
+		if err := h.schemas.CheckType(meta, fn); err != nil {
+			// a message of another type would be decoded into garbage or fail, dead-letter it without retry
+			log.Error("message type mismatch, reject it", zap.Error(err), zap.String("routing_key", d.RoutingKey),
+				zap.String("message_id", d.MessageId))
+			h.deadLetter(d, err)
+			h.metrics.Handled(h.name, meta.Topic, broker.HandleDecodeFailed, 0)
+			continue
+		}
 
-	return &handler{
-		methodValue: reflect.ValueOf(h),
-		msgType:     mt,
-		reliable:    reliable,
-		maxRetry:    maxRetry,
-		nackDelay:   nacDelay,
-	}, nil
-}
+		msg := fn.NewMessage()
+		if err := broker.Decode(h.codec, d.ContentType, d.Body, msg); err != nil {
+			// undecodable message can never succeed, dead-letter it without retry
+			log.Error("decode message error, reject it", zap.Error(err), zap.String("routing_key", d.RoutingKey),
+				zap.String("message_id", d.MessageId), zap.ByteString("body", d.Body))
+			h.deadLetter(d, err)
+			h.metrics.Handled(h.name, meta.Topic, broker.HandleDecodeFailed, 0)
+			continue
+		}
 
-func (h *handler) newMessage() proto.Message {
-	return reflect.New(h.msgType.Elem()).Interface().(proto.Message)
+		start := time.Now()
+		err = h.call(ctx, fn, msg, meta)
+		duration := time.Since(start)
+
+		outcome := broker.HandleAcked
+		switch {
+		case err != nil && h.reliable:
+			outcome = h.retry(d, err)
+		case err != nil:
+			outcome = broker.HandleNacked
+		case h.reliable:
+			if err := d.Ack(false); err != nil {
+				log.Error("Ack error", zap.Error(err))
+			}
+		}
+		h.metrics.Handled(h.name, meta.Topic, outcome, duration)
+	}
 }
 
-func (h *handler) call(msg proto.Message) error {
-	in := []reflect.Value{reflect.ValueOf(msg)}
-	out := h.methodValue.Call(in)
-	if out[0].IsNil() {
-		return nil
+// retry republish d to a delayed retry queue, or dead-letter it with cause once maxRetry exhausted
+func (h *handler) retry(d amqp.Delivery, cause error) broker.HandleOutcome {
+	attempt := broker.RetryCount(d.Headers) + 1
+	if errors.Is(cause, broker.ErrInProgress) {
+		// another consumer hold the claim, the redelivery is not an attempt
+		return h.delay(d, attempt-1, h.backoff(attempt))
 	}
-	return out[0].Interface().(error)
+	if attempt > h.maxRetry {
+		h.deadLetter(d, cause)
+		return broker.HandleNacked
+	}
+	return h.delay(d, attempt, h.backoff(attempt))
 }
 
-func (h *handler) consume(deliveries <-chan amqp.Delivery) {
-	for d := range deliveries {
-		msg := h.newMessage()
-		if err := proto.Unmarshal(d.Body, msg); err != nil {
-			log.Error("proto.Unmarshal error", zap.Error(err), zap.ByteString("body", d.Body))
-			if err := d.Nack(false, false); err != nil {
-				log.Error("Nack error", zap.Error(err))
-			}
-			continue
+// delay redeliver d through the retry queue of delay with retry count attempt, it is requeued if that failed
+func (h *handler) delay(d amqp.Delivery, attempt int, delay time.Duration) broker.HandleOutcome {
+	if err := h.retrier.retry(d, attempt, delay); err != nil {
+		log.Error("retry error, requeue message", zap.Error(err), zap.Int("attempt", attempt))
+		if err := d.Nack(false, true); err != nil {
+			log.Error("Nack error", zap.Error(err))
 		}
+		return broker.HandleRequeued
+	}
 
-		if err := h.call(msg); err != nil {
-			if h.reliable {
-				time.Sleep(h.nackDelay)
-
-				if d.Redelivered {
-					if err := d.Nack(false, false); err != nil {
-						log.Error("Nack error", zap.Error(err))
-					}
-				} else {
-					if err := d.Nack(false, h.maxRetry > 0); err != nil {
-						log.Error("Nack error", zap.Error(err))
-					}
-				}
-			}
-		} else {
-			if h.reliable {
-				if err := d.Ack(false); err != nil {
-					log.Error("Ack error", zap.Error(err))
-				}
-			}
-		}
+	if err := d.Ack(false); err != nil {
+		log.Error("Ack error", zap.Error(err))
 	}
+	return broker.HandleRetried
 }
 
-func checkIsProtoMessage(t reflect.Type) error {
-	if t.Kind() != reflect.Ptr {
-		return errTypeIsNotPtr
+// deadLetter quarantine d with cause in headers, fallback to a nack which dead-letter it with x-death only
+func (h *handler) deadLetter(d amqp.Delivery, cause error) {
+	if h.quarantiner != nil {
+		err := h.quarantiner.quarantine(d, cause)
+		if err == nil {
+			if err := d.Ack(false); err != nil {
+				log.Error("Ack error", zap.Error(err))
+			}
+			return
+		}
+		log.Error("quarantine error, nack message", zap.Error(err), zap.String("message_id", d.MessageId))
 	}
-
-	if !t.Implements(protoMessageType) {
-		return errTypeIsNotProtoMessage
+	if err := d.Nack(false, false); err != nil {
+		log.Error("Nack error", zap.Error(err))
 	}
-	return nil
 }
 
-func checkIsError(t reflect.Type) error {
-	if !t.Implements(errorType) {
-		return errTypeIsNotError
+func newMetadata(d amqp.Delivery) broker.Metadata {
+	topic := d.RoutingKey
+	if original, ok := d.Headers[broker.OriginalTopicHeader].(string); ok {
+		topic = original
+	}
+	return broker.Metadata{
+		Topic:         topic,
+		MessageID:     d.MessageId,
+		CorrelationID: d.CorrelationId,
+		ReplyTo:       d.ReplyTo,
+		ContentType:   d.ContentType,
+		Type:          d.Type,
+		Headers:       d.Headers,
+		Timestamp:     d.Timestamp,
+		Redelivered:   d.Redelivered,
 	}
-	return nil
 }
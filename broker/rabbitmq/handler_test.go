@@ -1,9 +1,12 @@
 package rabbitmq
 
 import (
+	"context"
 	"errors"
-	"reflect"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
 	"testing"
+	"time"
 )
 
 var (
@@ -26,64 +29,102 @@ func (t *testProtoMessage) ProtoMessage() {
 	panic("implement me")
 }
 
-type testErr struct {
-	error
-}
-
 func (h *testSubscriber) handle(message *testProtoMessage) error {
 	return errTest
 }
 
-func TestCheckIsProtoMessage(t *testing.T) {
-	a := testProtoMessage{}
-	err := checkIsProtoMessage(reflect.TypeOf(a))
-	if err == nil {
-		t.Error("expect err")
+func TestNewHandler(t *testing.T) {
+	s := testSubscriber{}
+	h, err := newHandler("test", s.handle, &broker.Options{})
+	if err != nil {
+		t.Error(err)
+	}
+	fn, err := h.router.Route("any")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if err != errTypeIsNotPtr {
-		t.Errorf("expect %v but %v", errTypeIsNotPtr, err)
+	m := fn.NewMessage()
+	if m.String() != "testProtoMessage" {
+		t.Errorf("expect %q, but %q", "testProtoMessage", m.String())
 	}
 
-	err = checkIsProtoMessage(reflect.TypeOf(&struct{}{}))
-	if err == nil {
-		t.Error("expect err")
+	if err := h.call(context.Background(), fn, m, broker.Metadata{}); err != errTest {
+		t.Errorf("expect %v but %v", errTest, err)
 	}
-	if err != errTypeIsNotProtoMessage {
-		t.Errorf("expect %v but %v", errTypeIsNotProtoMessage, err)
+}
+
+func TestNewMetadata(t *testing.T) {
+	meta := newMetadata(amqp.Delivery{RoutingKey: "user.created", MessageId: "1"})
+	if meta.Topic != "user.created" || meta.MessageID != "1" {
+		t.Errorf("unexpected metadata %+v", meta)
 	}
 
-	if err := checkIsProtoMessage(reflect.TypeOf(&testProtoMessage{})); err != nil {
-		t.Error(err)
+	meta = newMetadata(amqp.Delivery{
+		RoutingKey: "queue",
+		Headers:    amqp.Table{broker.OriginalTopicHeader: "user.created", broker.RetryCountHeader: int32(2)},
+	})
+	if meta.Topic != "user.created" {
+		t.Errorf("expect %q but %q", "user.created", meta.Topic)
+	}
+	if broker.RetryCount(meta.Headers) != 2 {
+		t.Errorf("expect retry count 2 but %d", broker.RetryCount(meta.Headers))
+	}
+}
+
+func TestRetryQueueName(t *testing.T) {
+	if name := retryQueueName("order", 1500*time.Millisecond); name != "order.retry.1500" {
+		t.Errorf("expect %q but %q", "order.retry.1500", name)
 	}
 }
 
-func TestCheckIsError(t *testing.T) {
-	a := struct{}{}
-	err := checkIsError(reflect.TypeOf(a))
-	if err == nil {
-		t.Error("expect err")
+func TestRetryBucket(t *testing.T) {
+	buckets := map[time.Duration]struct{}{}
+	backoff := broker.Jitter(broker.ExponentialBackoff(time.Millisecond, time.Hour), 0.5)
+	for i := 0; i < 10000; i++ {
+		d := backoff(i%40 + 1)
+		bucket := retryBucket(d)
+		if bucket < d || (bucket-d > minRetryStep && (bucket-d)*10 > d) {
+			t.Fatalf("bucket %v of %v", bucket, d)
+		}
+		buckets[bucket] = struct{}{}
 	}
-	if err != errTypeIsNotError {
-		t.Errorf("expect %v but %v", errTypeIsNotError, err)
+	// 90 per order of magnitude from 10ms to 1h
+	if len(buckets) > 100+90*5 {
+		t.Errorf("expect bounded retry queues but %d", len(buckets))
 	}
 
-	if err := checkIsError(reflect.TypeOf(testErr{})); err != nil {
-		t.Error(err)
+	args := retryQueueArgs("order", 1500*time.Millisecond)
+	if args["x-message-ttl"] != int64(1500) || args["x-expires"] != int64(1500+retryQueueIdle/time.Millisecond) {
+		t.Errorf("unexpected args %v", args)
 	}
 }
 
-func TestNewHandler(t *testing.T) {
+func TestNewErrHandler(t *testing.T) {
 	s := testSubscriber{}
-	h, err := newHandler(s.handle, false, 0, 0)
+	h, err := newErrHandler("dead", s.handle, &broker.Options{})
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	m := h.newMessage()
-	if m.String() != "testProtoMessage" {
-		t.Errorf("expect %q, but %q", "testProtoMessage", m.String())
+	if !h.reliable || h.maxRetry <= 0 {
+		t.Errorf("expect error handler retried until handled, but reliable %v max retry %d", h.reliable, h.maxRetry)
 	}
 
-	if err := h.call(m); err != errTest {
-		t.Errorf("expect %v but %v", errTest, err)
+	// without quarantiner the message is nacked and dead-lettered natively
+	ack := &testAcknowledger{}
+	h.deadLetter(amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}, errTest)
+	if len(ack.nacked) != 1 || len(ack.acked) != 0 {
+		t.Errorf("expect nacked, but acked %v nacked %v", ack.acked, ack.nacked)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	for _, c := range []struct{ prefetch, concurrency, expected int }{
+		{0, 4, 4},
+		{10, 4, 10},
+		{-1, 4, -1},
+	} {
+		if n := prefetch(&broker.Options{Prefetch: c.prefetch}, c.concurrency); n != c.expected {
+			t.Errorf("prefetch %d of concurrency %d: %d, expected %d", c.prefetch, c.concurrency, n, c.expected)
+		}
 	}
 }
@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"go.uber.org/zap"
+	healthPB "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+var _ broker.HealthChecker = (*rabbitBroker)(nil)
+
+// HealthReporter receive the serving status of the broker, it is implemented by *health.Server of grpc, see rpc.Server
+type HealthReporter interface {
+	SetServingStatus(service string, servingStatus healthPB.HealthCheckResponse_ServingStatus)
+}
+
+// dial open a connection of the broker, its state is tracked for health
+func (r *rabbitBroker) dial() (*Connection, error) {
+	conn, err := Dial(r.url, r.dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	r.hm.Lock()
+	r.conns[conn] = struct{}{}
+	r.hm.Unlock()
+
+	states := conn.NotifyState(make(chan ConnectionState, 4))
+	go func() {
+		for state := range states {
+			log.Info("connection state changed", zap.Stringer("state", state))
+			r.reportHealth()
+		}
+		// a connection closed by developer is not tracked anymore, one closed by exhausted reconnect keeps unhealthy
+		if conn.isClosing() {
+			r.hm.Lock()
+			delete(r.conns, conn)
+			r.hm.Unlock()
+		}
+		r.reportHealth()
+	}()
+
+	return conn, nil
+}
+
+// Healthy report whether all connections of the broker are open
+func (r *rabbitBroker) Healthy() bool {
+	r.hm.Lock()
+	defer r.hm.Unlock()
+
+	for conn := range r.conns {
+		if !conn.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *rabbitBroker) reportHealth() {
+	if r.health == nil {
+		return
+	}
+
+	status := healthPB.HealthCheckResponse_SERVING
+	if !r.Healthy() {
+		status = healthPB.HealthCheckResponse_NOT_SERVING
+	}
+	r.health.SetServingStatus(r.healthService, status)
+}
@@ -0,0 +1,68 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"time"
+)
+
+// reportQueueStats report the depth and consumers of the subscribed queues to metrics every interval until closed.
+// Stats are read by passive declares on a connection of its own, so a missing queue never breaks consumers.
+func (r *rabbitBroker) reportQueueStats(interval time.Duration) {
+	conn, err := r.dial()
+	if err != nil {
+		log.Error("dial for queue stats error", zap.Error(err))
+		return
+	}
+	defer func() {
+		if err := conn.Close(); err != nil {
+			log.Error("conn.Close error", zap.Error(err))
+		}
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+			if conn.Healthy() {
+				r.statQueues(conn)
+			}
+		}
+	}
+}
+
+func (r *rabbitBroker) statQueues(conn *Connection) {
+	for _, name := range r.subscribedQueues() {
+		var queue amqp.Queue
+		conn.m.RLock()
+		err := withChannel(conn.Connection, func(ch *amqp.Channel) (err error) {
+			queue, err = ch.QueueDeclarePassive(name, false, false, false, false, nil)
+			return err
+		})
+		conn.m.RUnlock()
+		if err != nil {
+			log.Error("stat queue error", zap.Error(err), zap.String("queue", name))
+			continue
+		}
+		r.metrics.QueueStat(name, queue.Messages, queue.Consumers)
+	}
+}
+
+func (r *rabbitBroker) subscribedQueues() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	seen := map[string]bool{}
+	var out []string
+	for s := range r.subscriptions {
+		name := s.subscriber.name
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
+}
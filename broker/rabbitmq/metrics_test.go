@@ -0,0 +1,93 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/metrics"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAcknowledger record acks and nacks of deliveries
+type testAcknowledger struct {
+	m        sync.Mutex
+	acked    []uint64
+	nacked   []uint64
+	requeued []uint64
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	} else {
+		a.nacked = append(a.nacked, tag)
+	}
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func TestHandlerMetrics(t *testing.T) {
+	h, err := newHandler("test", func(msg *wrappers.StringValue) error {
+		if msg.Value == "fail" {
+			return errTest
+		}
+		return nil
+	}, &broker.Options{Reliable: true, Codec: broker.ProtoCodec})
+	require.NoError(t, err)
+	recorder := metrics.NewMemoryRecorder()
+	h.metrics = recorder
+
+	ack := &testAcknowledger{}
+	body := func(value string) []byte {
+		data, err := proto.Marshal(&wrappers.StringValue{Value: value})
+		require.NoError(t, err)
+		return data
+	}
+	deliveries := make(chan amqp.Delivery, 3)
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, RoutingKey: "test", Body: body("ok"), Redelivered: true}
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, RoutingKey: "test", Body: body("fail")}
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 3, RoutingKey: "test", Body: []byte("bad"), ContentType: broker.ContentTypeJSON}
+	close(deliveries)
+	h.consume(context.Background(), deliveries)
+
+	assert.Equal(t, []uint64{1}, ack.acked)
+	assert.Equal(t, []uint64{2, 3}, ack.nacked)
+	assert.Equal(t, 1, recorder.HandleCount("test", broker.HandleAcked))
+	assert.Equal(t, 1, recorder.HandleCount("test", broker.HandleNacked))
+	assert.Equal(t, 1, recorder.HandleCount("test", broker.HandleDecodeFailed))
+	assert.Equal(t, 1, recorder.RedeliveryCount("test"))
+	assert.Len(t, recorder.HandleDurations("test"), 2)
+}
+
+func TestPublishFutureObserve(t *testing.T) {
+	recorder := metrics.NewMemoryRecorder()
+	future := newPublishFuture("1")
+	start := time.Now()
+	future.observe = func(err error) {
+		recorder.Published("test", broker.PublishStatusOf(err), time.Since(start))
+	}
+
+	pc, ch := newTestPublishChannel(future)
+	pc.handleReturn(ch, amqp.Return{MessageId: "1"})
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+
+	assert.Equal(t, 1, recorder.PublishCount("test", broker.PublishReturned))
+}
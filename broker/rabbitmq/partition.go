@@ -0,0 +1,139 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+)
+
+// WithPartitionedTopic partition topic into n queues per subscription, messages are published with broker.PartitionKey
+// and routed to the partition of the key, each partition is consumed by a single ordered consumer.
+// Publishers and subscribers of the topic must agree on n.
+func WithPartitionedTopic(topic string, n int) Option {
+	return func(cfg *Options) {
+		if cfg.Partitions == nil {
+			cfg.Partitions = map[string]int{}
+		}
+		cfg.Partitions[topic] = n
+	}
+}
+
+func partitionExchangeName(name string) string {
+	return fmt.Sprintf("%s.partition", name)
+}
+
+func partitionQueueName(name string, partition int) string {
+	return fmt.Sprintf("%s.p%d", name, partition)
+}
+
+// partition stamp the partition of the key onto publishing if topic is partitioned
+func (r *rabbitBroker) partition(topic string, publishing *amqp.Publishing, options *broker.PublishOptions) error {
+	n, ok := r.partitions[topic]
+	if !ok {
+		return nil
+	}
+	if options.PartitionKey == "" {
+		return broker.ErrPartitionKeyRequired
+	}
+
+	headers := amqp.Table{}
+	for k, v := range publishing.Headers {
+		headers[k] = v
+	}
+	headers[broker.PartitionKeyHeader] = options.PartitionKey
+	headers[broker.PartitionHeader] = strconv.Itoa(broker.Partition(options.PartitionKey, n))
+	publishing.Headers = headers
+	return nil
+}
+
+// partitionTopology route the messages of topic to the partition queue through a headers exchange of the subscription.
+// The queue has a single active consumer, other instances take over only if it is gone, so a partition is never
+// consumed concurrently.
+func (rs *rabbitSubscriber) partitionTopology(queue QueueSpec) *Topology {
+	exchange := partitionExchangeName(rs.partitionOf)
+	if queue.Args == nil {
+		queue.Args = amqp.Table{}
+	}
+	queue.Args["x-single-active-consumer"] = true
+
+	return rs.broker.exchangeTopology().Merge(&Topology{
+		Exchanges: []ExchangeSpec{{Name: exchange, Kind: amqp.ExchangeHeaders, Durable: true, Internal: true}},
+		Queues:    []QueueSpec{queue},
+		Bindings: []BindingSpec{
+			{DestinationExchange: exchange, Exchange: rs.broker.exchange, Key: rs.topics[0]},
+			{
+				Queue:    rs.name,
+				Exchange: exchange,
+				Args:     amqp.Table{"x-match": "all", broker.PartitionHeader: strconv.Itoa(rs.partition)},
+			},
+		},
+	})
+}
+
+// registerPartitions subscribe every partition of topic with a single consumer, so messages of a partition key are
+// handled in publishing order. Retried messages are delayed in retry queues and lose their order.
+func (r *rabbitBroker) registerPartitions(name, topic string, n int, router *broker.Router, opts *broker.Options) (broker.Subscription, error) {
+	if opts.Concurrency > 1 {
+		log.Warn("concurrency of partitioned subscription is the number of partitions")
+	}
+
+	out := &partitionedSubscription{}
+	for i := 0; i < n; i++ {
+		queue := partitionQueueName(name, i)
+		h := newRouterHandler(queue, router, opts)
+		h.metrics = r.metrics
+		errTopic := fmt.Sprintf("error.%s", topic)
+		s, err := newPartitionSubscriber(r, name, i, topic, errTopic, opts.Reliable, prefetch(opts, 1))
+		if err == nil {
+			if opts.Reliable {
+				h.retrier = newRetrier(s.conn, queue)
+			}
+			if opts.Reliable && r.dlx != "" {
+				h.quarantiner = newQuarantiner(s.conn, r.dlx, errTopic, queue)
+			}
+			var sub *rabbitSubscription
+			if sub, err = r.subscribe(s, h, 1); err == nil {
+				out.subscriptions = append(out.subscriptions, sub)
+				continue
+			}
+		}
+
+		if unsubscribeErr := out.Unsubscribe(context.Background()); unsubscribeErr != nil {
+			log.Error("unsubscribe partitions error", zap.Error(unsubscribeErr))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// partitionedSubscription is the subscriptions of all partitions
+type partitionedSubscription struct {
+	subscriptions []*rabbitSubscription
+}
+
+func (ps *partitionedSubscription) Unsubscribe(ctx context.Context) error {
+	var (
+		wg     sync.WaitGroup
+		em     sync.Mutex
+		result error
+	)
+	for _, s := range ps.subscriptions {
+		wg.Add(1)
+		go func(s *rabbitSubscription) {
+			defer wg.Done()
+			if err := s.Unsubscribe(ctx); err != nil {
+				em.Lock()
+				if result == nil {
+					result = err
+				}
+				em.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return result
+}
@@ -0,0 +1,55 @@
+package rabbitmq
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+)
+
+func TestPartitionPublishing(t *testing.T) {
+	options := &Options{}
+	WithPartitionedTopic("account.events", 4)(options)
+	r := &rabbitBroker{exchange: "kit", partitions: options.Partitions}
+
+	publishing := amqp.Publishing{Headers: amqp.Table{"a": "1"}}
+	require.NoError(t, r.partition("other", &publishing, broker.NewPublishOptions(false)))
+	assert.Equal(t, amqp.Table{"a": "1"}, publishing.Headers)
+
+	assert.Equal(t, broker.ErrPartitionKeyRequired, r.partition("account.events", &publishing, broker.NewPublishOptions(false)))
+
+	require.NoError(t, r.partition("account.events", &publishing, broker.NewPublishOptions(false, broker.PartitionKey("alice"))))
+	assert.Equal(t, amqp.Table{
+		"a":                       "1",
+		broker.PartitionKeyHeader: "alice",
+		broker.PartitionHeader:    strconv.Itoa(broker.Partition("alice", 4)),
+	}, publishing.Headers)
+}
+
+func TestPartitionTopology(t *testing.T) {
+	r := &rabbitBroker{exchange: "kit", dlx: "kit.dlx"}
+	s := &rabbitSubscriber{
+		broker:      r,
+		name:        partitionQueueName("ledger", 2),
+		topics:      []string{"account.events"},
+		errTopic:    "error.account.events",
+		reliable:    true,
+		partitionOf: "ledger",
+		partition:   2,
+	}
+
+	topology := s.topology()
+	require.NoError(t, topology.Validate())
+
+	queue := topology.Queues[0]
+	assert.Equal(t, "ledger.p2", queue.Name)
+	assert.Equal(t, "kit.dlx", queue.DeadLetterExchange)
+	assert.Equal(t, true, queue.Args["x-single-active-consumer"])
+
+	assert.Equal(t, []BindingSpec{
+		{DestinationExchange: "ledger.partition", Exchange: "kit", Key: "account.events"},
+		{Queue: "ledger.p2", Exchange: "ledger.partition", Args: amqp.Table{"x-match": "all", broker.PartitionHeader: "2"}},
+	}, topology.Bindings)
+}
@@ -0,0 +1,274 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+)
+
+// publishFuture is the pending result of a publishing, done is closed once err decided
+type publishFuture struct {
+	messageID string
+	returned  bool
+	err       error
+	done      chan struct{}
+	// observe is called with err once decided, if set
+	observe func(err error)
+}
+
+func newPublishFuture(messageID string) *publishFuture {
+	return &publishFuture{
+		messageID: messageID,
+		done:      make(chan struct{}),
+	}
+}
+
+func (f *publishFuture) resolve(err error) {
+	f.err = err
+	close(f.done)
+	if f.observe != nil {
+		f.observe(err)
+	}
+}
+
+// publishChannel is a long-lived channel for publishing, it is reopened lazily after closed.
+// In confirm mode, publishings on it are pipelined and their confirms are correlated by delivery tag,
+// returns are correlated by message id because RabbitMQ send basic.return before basic.ack of the same message
+type publishChannel struct {
+	conn    *Connection
+	confirm bool
+
+	m       sync.Mutex
+	ch      *amqp.Channel
+	nextTag uint64
+	pending map[uint64]*publishFuture
+}
+
+func newPublishChannel(conn *Connection, confirm bool) *publishChannel {
+	return &publishChannel{
+		conn:    conn,
+		confirm: confirm,
+	}
+}
+
+// publish send publishing on the channel, the returned future is resolved when confirmed if in confirm mode,
+// otherwise immediately after sent
+func (pc *publishChannel) publish(exchange, key string, mandatory bool, publishing amqp.Publishing) *publishFuture {
+	future := newPublishFuture(publishing.MessageId)
+	pc.send(future, exchange, key, mandatory, publishing)
+	return future
+}
+
+// send is publish with the future created by caller
+func (pc *publishChannel) send(future *publishFuture, exchange, key string, mandatory bool, publishing amqp.Publishing) {
+	pc.m.Lock()
+	if pc.ch == nil {
+		if err := pc.open(); err != nil {
+			pc.m.Unlock()
+			future.resolve(err)
+			return
+		}
+	}
+
+	if pc.confirm {
+		pc.nextTag++
+		pc.pending[pc.nextTag] = future
+	}
+
+	if err := pc.ch.Publish(exchange, key, mandatory, false, publishing); err != nil {
+		// tags are out of sync after a failed publish, drop the channel and open a new one next time
+		ch := pc.detach(err)
+		if !pc.confirm {
+			future.resolve(err)
+		}
+		pc.m.Unlock()
+		closeChannel(ch)
+		return
+	}
+	pc.m.Unlock()
+
+	if !pc.confirm {
+		future.resolve(nil)
+	}
+}
+
+// open must be called with pc.m held
+func (pc *publishChannel) open() error {
+	channel, err := pc.conn.Channel(false)
+	if err != nil {
+		return err
+	}
+	ch := channel.Channel
+
+	if pc.confirm {
+		if err := ch.Confirm(false); err != nil {
+			_ = ch.Close()
+			return err
+		}
+		confirmCh := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+		returnCh := ch.NotifyReturn(make(chan amqp.Return, 64))
+		go pc.listen(ch, confirmCh, returnCh)
+	}
+	closeCh := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go pc.watch(ch, closeCh)
+
+	pc.ch = ch
+	pc.nextTag = 0
+	pc.pending = map[uint64]*publishFuture{}
+	return nil
+}
+
+// detach must be called with pc.m held, it fail all pending publishings and return the channel to close.
+// The channel must be closed without pc.m held, closing wait the reader which may be blocked by confirm listener.
+func (pc *publishChannel) detach(reason error) *amqp.Channel {
+	ch := pc.ch
+	for tag, f := range pc.pending {
+		f.resolve(reason)
+		delete(pc.pending, tag)
+	}
+	pc.ch = nil
+	return ch
+}
+
+func closeChannel(ch *amqp.Channel) {
+	if ch == nil {
+		return
+	}
+	if err := ch.Close(); err != nil && err != amqp.ErrClosed {
+		log.Error("publish channel close error", zap.Error(err))
+	}
+}
+
+func (pc *publishChannel) watch(ch *amqp.Channel, closeCh chan *amqp.Error) {
+	reason, ok := <-closeCh
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	if pc.ch != ch {
+		return
+	}
+	if ok {
+		log.Info("publish channel closed", zap.Reflect("reason", reason))
+		pc.detach(reason)
+	} else {
+		pc.detach(amqp.ErrClosed)
+	}
+}
+
+func (pc *publishChannel) listen(ch *amqp.Channel, confirmCh chan amqp.Confirmation, returnCh chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returnCh:
+			if !ok {
+				return
+			}
+			pc.handleReturn(ch, r)
+		case c, ok := <-confirmCh:
+			if !ok {
+				return
+			}
+			// the return of a message is dispatched before its confirm, handle the buffered ones first
+			pc.drainReturns(ch, returnCh)
+			pc.handleConfirm(ch, c)
+		}
+	}
+}
+
+func (pc *publishChannel) drainReturns(ch *amqp.Channel, returnCh chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returnCh:
+			if !ok {
+				return
+			}
+			pc.handleReturn(ch, r)
+		default:
+			return
+		}
+	}
+}
+
+func (pc *publishChannel) handleReturn(ch *amqp.Channel, r amqp.Return) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	if pc.ch != ch {
+		return
+	}
+
+	// mark the oldest pending publishing with the message id
+	var (
+		oldest uint64
+		future *publishFuture
+	)
+	for tag, f := range pc.pending {
+		if f.messageID == r.MessageId && !f.returned && (future == nil || tag < oldest) {
+			oldest, future = tag, f
+		}
+	}
+	if future == nil {
+		log.Error("message return without pending publishing", zap.Reflect("return", r))
+		return
+	}
+	log.Error("message return", zap.Reflect("return", r))
+	future.returned = true
+}
+
+func (pc *publishChannel) handleConfirm(ch *amqp.Channel, c amqp.Confirmation) {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+	if pc.ch != ch {
+		return
+	}
+
+	future, ok := pc.pending[c.DeliveryTag]
+	if !ok {
+		return
+	}
+	delete(pc.pending, c.DeliveryTag)
+
+	switch {
+	case future.returned:
+		future.resolve(ErrPublishMessageMiss)
+	case !c.Ack:
+		future.resolve(ErrPublishMessageNotAck)
+	default:
+		future.resolve(nil)
+	}
+}
+
+func (pc *publishChannel) close() {
+	pc.m.Lock()
+	ch := pc.detach(amqp.ErrClosed)
+	pc.m.Unlock()
+	closeChannel(ch)
+}
+
+// publishPool is a fixed set of long-lived publish channels used in round robin
+type publishPool struct {
+	channels []*publishChannel
+	next     uint32
+}
+
+func newPublishPool(conn *Connection, confirm bool, size int) *publishPool {
+	if size < 1 {
+		size = 1
+	}
+	out := &publishPool{
+		channels: make([]*publishChannel, size),
+	}
+	for i := range out.channels {
+		out.channels[i] = newPublishChannel(conn, confirm)
+	}
+	return out
+}
+
+func (p *publishPool) get() *publishChannel {
+	n := atomic.AddUint32(&p.next, 1)
+	return p.channels[int(n)%len(p.channels)]
+}
+
+func (p *publishPool) close() {
+	for _, c := range p.channels {
+		c.close()
+	}
+}
@@ -0,0 +1,80 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+	"testing"
+)
+
+func newTestPublishChannel(futures ...*publishFuture) (*publishChannel, *amqp.Channel) {
+	ch := &amqp.Channel{}
+	pc := newPublishChannel(nil, true)
+	pc.ch = ch
+	pc.pending = map[uint64]*publishFuture{}
+	for _, f := range futures {
+		pc.nextTag++
+		pc.pending[pc.nextTag] = f
+	}
+	return pc, ch
+}
+
+func TestPublishChannelConfirm(t *testing.T) {
+	acked, nacked, returned := newPublishFuture("1"), newPublishFuture("2"), newPublishFuture("3")
+	pc, ch := newTestPublishChannel(acked, nacked, returned)
+
+	pc.handleReturn(ch, amqp.Return{MessageId: "3"})
+	// confirms may arrive in any order
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 3, Ack: true})
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 2, Ack: false})
+
+	for _, c := range []struct {
+		future *publishFuture
+		err    error
+	}{
+		{acked, nil},
+		{nacked, ErrPublishMessageNotAck},
+		{returned, ErrPublishMessageMiss},
+	} {
+		select {
+		case <-c.future.done:
+		default:
+			t.Fatalf("expect future %s resolved", c.future.messageID)
+		}
+		if c.future.err != c.err {
+			t.Errorf("expect %v but %v", c.err, c.future.err)
+		}
+	}
+	if len(pc.pending) != 0 {
+		t.Errorf("expect no pending but %d", len(pc.pending))
+	}
+}
+
+func TestPublishChannelReturnSameMessageID(t *testing.T) {
+	first, second := newPublishFuture("same"), newPublishFuture("same")
+	pc, ch := newTestPublishChannel(first, second)
+
+	pc.handleReturn(ch, amqp.Return{MessageId: "same"})
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 2, Ack: true})
+
+	if first.err != ErrPublishMessageMiss {
+		t.Errorf("expect %v but %v", ErrPublishMessageMiss, first.err)
+	}
+	if second.err != nil {
+		t.Errorf("expect nil but %v", second.err)
+	}
+}
+
+func TestPublishChannelDetach(t *testing.T) {
+	pending := newPublishFuture("1")
+	pc, ch := newTestPublishChannel(pending)
+
+	if got := pc.detach(amqp.ErrClosed); got != ch {
+		t.Error("expect detached channel returned")
+	}
+	if pending.err != amqp.ErrClosed {
+		t.Errorf("expect %v but %v", amqp.ErrClosed, pending.err)
+	}
+	// confirms of the detached channel are ignored
+	pc.handleConfirm(ch, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+}
@@ -1,31 +1,41 @@
 package rabbitmq
 
 import (
-	"errors"
+	"context"
 	"go.uber.org/zap"
+	"strconv"
+	"time"
 
 	"github.com/Ankr-network/kit/broker"
 	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 )
 
 var (
-	ErrPublishMessageNotAck = errors.New("message not ack by broker")
-	ErrPublishMessageMiss   = errors.New("message cannot route to any queue")
+	ErrPublishMessageNotAck = broker.ErrPublishMessageNotAck
+	ErrPublishMessageMiss   = broker.ErrPublishMessageMiss
 )
 
 type rabbitPublisher struct {
-	broker   *rabbitBroker
-	reliable bool
-	topic    string
-	conn     *Connection
+	broker     *rabbitBroker
+	reliable   bool
+	codec      broker.Codec
+	middleware broker.PublisherMiddleware
+	schemas    *broker.SchemaRegistry
+	topic      string
+	conn       *Connection
+	pool       *publishPool
 }
 
-func newRabbitPublisher(broker *rabbitBroker, topic string, reliable bool) (*rabbitPublisher, error) {
+func newRabbitPublisher(b *rabbitBroker, topic string, opts *broker.Options) (*rabbitPublisher, error) {
 	out := &rabbitPublisher{
-		broker:   broker,
-		reliable: reliable,
-		topic:    topic,
+		broker:     b,
+		reliable:   opts.Reliable,
+		codec:      opts.Codec,
+		middleware: broker.ChainPublisher(opts.PublishMiddlewares...),
+		schemas:    opts.Schemas,
+		topic:      topic,
 	}
 
 	if err := out.init(); err != nil {
@@ -36,17 +46,19 @@ func newRabbitPublisher(broker *rabbitBroker, topic string, reliable bool) (*rab
 }
 
 func (rp *rabbitPublisher) init() error {
-	conn, err := Dial(rp.broker.url)
+	conn, err := rp.broker.dial()
 	if err != nil {
 		return err
 	}
 
 	rp.conn = conn
+	rp.pool = newPublishPool(conn, rp.reliable, rp.broker.publishChannels)
 
 	return nil
 }
 
 func (rp *rabbitPublisher) Close() error {
+	rp.pool.close()
 	return rp.conn.Close()
 }
 
@@ -55,73 +67,174 @@ func (rp *rabbitPublisher) Publish(m interface{}) error {
 	if !ok {
 		return ErrMessageIsNotProtoMessage
 	}
-	return rp.PublishMessage(&broker.Message{
+	return rp.PublishContext(context.Background(), msg)
+}
+
+func (rp *rabbitPublisher) PublishContext(ctx context.Context, m proto.Message, opts ...broker.PublishOption) error {
+	return rp.PublishMessageContext(ctx, &broker.Message{
 		Topic: rp.topic,
-		Value: msg,
-	})
+		Value: m,
+	}, opts...)
 }
 
 func (rp *rabbitPublisher) PublishMessage(msg *broker.Message) error {
-	if err := rp.doPublish(msg.Topic, msg.Value); err != nil {
+	return rp.PublishMessageContext(context.Background(), msg)
+}
+
+func (rp *rabbitPublisher) PublishMessageContext(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) error {
+	options := broker.NewPublishOptions(rp.reliable, opts...)
+	err := broker.InterceptPublish(ctx, rp.middleware, msg, options, func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+		return rp.doPublish(ctx, msg.Topic, msg.Value, options)
+	})
+	if err != nil {
 		log.Error("publish message error", zap.Error(err), zap.String("topic", msg.Topic), zap.Reflect("value", msg.Value))
 		return err
 	}
 	return nil
 }
 
-func (rp *rabbitPublisher) doPublish(topic string, msg proto.Message) error {
-	body, err := proto.Marshal(msg)
+func (rp *rabbitPublisher) doPublish(ctx context.Context, topic string, msg proto.Message, options *broker.PublishOptions) error {
+	future, err := rp.doPublishAsync(ctx, topic, msg, options)
 	if err != nil {
 		return err
 	}
-	publishing := amqp.Publishing{
-		ContentType: "application/protobuf",
-		Body:        body,
+	select {
+	case <-future.done:
+		return future.err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
+
+// doPublishAsync send msg and return the future of its confirm, the outcome is recorded to metrics
+func (rp *rabbitPublisher) doPublishAsync(ctx context.Context, topic string, msg proto.Message, options *broker.PublishOptions) (_ *publishFuture, err error) {
+	defer func() {
+		if err != nil {
+			rp.broker.metrics.Published(topic, broker.PublishFailed, 0)
+		}
+	}()
 
-	// ever single channel for publish
-	rp.conn.m.RLock()
-	ch, err := rp.conn.Channel(false)
-	rp.conn.m.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := rp.schemas.CheckPublish(topic, msg, options); err != nil {
+		return nil, err
+	}
+
+	body, err := rp.codec.Marshal(msg)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	publishing := newPublishing(options)
+	publishing.ContentType = rp.codec.ContentType()
+	publishing.Body = body
+	if err := rp.broker.partition(topic, &publishing, options); err != nil {
+		return nil, err
 	}
-	defer ch.Close()
 
-	if rp.reliable {
-		if err := ch.Confirm(false); err != nil {
-			return err
+	exchange := rp.broker.exchange
+	if delay := options.Delay(); delay > 0 {
+		if options.Expiration > 0 {
+			return nil, broker.ErrDelayedExpiration
 		}
+		if exchange, err = rp.broker.delayer.delay(rp.conn, &publishing, delay); err != nil {
+			return nil, err
+		}
+	}
+
+	return rp.publish(exchange, topic, publishing)
+}
+
+func (rp *rabbitPublisher) PublishAsync(ctx context.Context, msg *broker.Message, opts ...broker.PublishOption) broker.PublishFuture {
+	options := broker.NewPublishOptions(rp.reliable, opts...)
+	var future *publishFuture
+	err := broker.InterceptPublish(ctx, rp.middleware, msg, options, func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) (err error) {
+		future, err = rp.doPublishAsync(ctx, msg.Topic, msg.Value, options)
+		return err
+	})
+	if err != nil {
+		log.Error("publish message error", zap.Error(err), zap.String("topic", msg.Topic), zap.Reflect("value", msg.Value))
+		return broker.CompletedFuture(broker.NewPublishResult(msg, options.MessageID, err))
+	}
+	return &asyncFuture{
+		publishFuture: future,
+		msg:           msg,
+	}
+}
 
-		confirmCh := ch.NotifyPublish(make(chan amqp.Confirmation, 1))
-		returnCh := ch.NotifyReturn(make(chan amqp.Return, 1))
+func (rp *rabbitPublisher) PublishBatch(ctx context.Context, msgs []*broker.Message, opts ...broker.PublishOption) <-chan broker.PublishResult {
+	return broker.PublishBatch(ctx, msgs, func(ctx context.Context, msg *broker.Message) broker.PublishFuture {
+		return rp.PublishAsync(ctx, msg, opts...)
+	})
+}
 
-		go func() {
-			r, ok := <-returnCh
-			if ok {
-				log.Error("message return", zap.Reflect("return", r))
-			}
-		}()
+// asyncFuture adapt publishFuture to broker.PublishFuture
+type asyncFuture struct {
+	*publishFuture
+	msg *broker.Message
+}
 
-		publishing.DeliveryMode = amqp.Persistent
+func (f *asyncFuture) Done() <-chan struct{} {
+	return f.done
+}
 
-		if err := ch.Publish(rp.broker.exchange, topic, true, false, publishing); err != nil {
-			return err
-		}
+func (f *asyncFuture) Result() broker.PublishResult {
+	<-f.done
+	return broker.NewPublishResult(f.msg, f.messageID, f.err)
+}
 
-		select {
-		case <-returnCh:
-			return ErrPublishMessageMiss
-		case c := <-confirmCh:
-			if !c.Ack {
-				return ErrPublishMessageNotAck
-			}
-		}
-	} else {
-		if err := ch.Publish(rp.broker.exchange, topic, false, false, publishing); err != nil {
-			return err
+// publish send publishing through a pooled channel, reliable publishing is mandatory and confirmed.
+// A delayed publishing is confirmed once it is held in the delay queue, it is not checked whether the topic is routable.
+// While the circuit of the spill buffer is open, publishing is spilled instead and the future is resolved once on disk.
+// A publishing failed by the channel, e.g. the first one after the connection dropped, is spilled as well.
+func (rp *rabbitPublisher) publish(exchange, topic string, publishing amqp.Publishing) (*publishFuture, error) {
+	if rp.reliable && publishing.MessageId == "" {
+		// returns are correlated by message id
+		publishing.MessageId = uuid.New().String()
+	}
+
+	s := rp.broker.spiller
+	if s != nil && s.open(rp.conn) {
+		return s.spill(exchange, topic, rp.reliable, publishing)
+	}
+
+	future := newPublishFuture(publishing.MessageId)
+	start := time.Now()
+	future.observe = func(err error) {
+		rp.broker.metrics.Published(topic, broker.PublishStatusOf(err), time.Since(start))
+	}
+	if s == nil {
+		rp.pool.get().send(future, exchange, topic, rp.reliable, publishing)
+		return future, nil
+	}
+
+	sent := newPublishFuture(publishing.MessageId)
+	sent.observe = func(err error) {
+		if spillable(err) && s.fallback(exchange, topic, rp.reliable, publishing, err) {
+			future.observe = nil
+			err = nil
 		}
+		future.resolve(err)
 	}
+	rp.pool.get().send(sent, exchange, topic, rp.reliable, publishing)
+	return future, nil
+}
 
-	return nil
+func newPublishing(options *broker.PublishOptions) amqp.Publishing {
+	out := amqp.Publishing{
+		Headers:       amqp.Table(options.Headers),
+		MessageId:     options.MessageID,
+		CorrelationId: options.CorrelationID,
+		ReplyTo:       options.ReplyTo,
+		Type:          options.Type,
+		Priority:      options.Priority,
+		Timestamp:     time.Now(),
+	}
+	if options.Persistent {
+		out.DeliveryMode = amqp.Persistent
+	}
+	if options.Expiration > 0 {
+		out.Expiration = strconv.FormatInt(int64(options.Expiration/time.Millisecond), 10)
+	}
+	return out
 }
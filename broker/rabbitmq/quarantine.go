@@ -0,0 +1,110 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// quarantiner dead-letter a failed delivery by publishing it to the DLX itself instead of a nack,
+// which can't carry the handler error, so the failure reason is kept in headers
+type quarantiner struct {
+	exchange     string
+	topic        string
+	subscription string
+	channel      *publishChannel
+}
+
+func newQuarantiner(conn *Connection, exchange, topic, subscription string) *quarantiner {
+	return &quarantiner{
+		exchange:     exchange,
+		topic:        topic,
+		subscription: subscription,
+		channel:      newPublishChannel(conn, true),
+	}
+}
+
+func (q *quarantiner) quarantine(d amqp.Delivery, cause error) error {
+	publishing := SameMsgConvert(d)
+	publishing.Headers = amqp.Table(broker.DeadLetterHeaders(d.Headers, d.RoutingKey, q.subscription, cause))
+	publishing.DeliveryMode = amqp.Persistent
+
+	future := q.channel.publish(q.exchange, q.topic, false, publishing)
+	<-future.done
+	return future.err
+}
+
+// QuarantinedMessage is a dead-lettered delivery with its decoded dead-letter metadata
+type QuarantinedMessage struct {
+	Delivery   amqp.Delivery
+	DeadLetter *broker.DeadLetter
+}
+
+// Inspect peek at most limit messages accepted by filters in the error queue, 0 means all of them.
+// Messages are left in the queue, use Replayer or RetryError to release them.
+func Inspect(ctx context.Context, url, queue string, limit int, filters ...ReplayFilter) ([]QuarantinedMessage, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	defer ch.Close()
+
+	q, err := ch.QueueDeclarePassive(queue, true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// deliveries kept unacked until the end, so they are not taken again
+	var held []amqp.Delivery
+	defer func() {
+		for _, d := range held {
+			if err := d.Nack(false, true); err != nil {
+				log.Error("Nack error", zap.Error(err), zap.Uint64("delivery_tag", d.DeliveryTag))
+			}
+		}
+	}()
+
+	var out []QuarantinedMessage
+	for remain := q.Messages; remain > 0; remain-- {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return out, err
+		}
+
+		d, ok, err := ch.Get(queue, false)
+		if err != nil {
+			return out, err
+		}
+		if !ok {
+			break
+		}
+		held = append(held, d)
+
+		if !acceptAll(filters, d) {
+			continue
+		}
+		out = append(out, QuarantinedMessage{
+			Delivery:   d,
+			DeadLetter: broker.DeadLetterOf(newMetadata(d)),
+		})
+	}
+	return out, nil
+}
+
+func acceptAll(filters []ReplayFilter, d amqp.Delivery) bool {
+	for _, f := range filters {
+		if !f(d) {
+			return false
+		}
+	}
+	return true
+}
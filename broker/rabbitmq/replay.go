@@ -0,0 +1,224 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+)
+
+// ReplayFilter decide whether a delivery should be replayed
+type ReplayFilter func(d amqp.Delivery) bool
+
+// RoutingKeyFilter accept deliveries whose routing key match any of patterns, patterns use the topic exchange wildcards
+func RoutingKeyFilter(patterns ...string) ReplayFilter {
+	return func(d amqp.Delivery) bool {
+		for _, p := range patterns {
+			if broker.MatchTopic(p, d.RoutingKey) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// HeaderFilter accept deliveries whose header key satisfies predicate, the value is nil if header absent
+func HeaderFilter(key string, predicate func(value interface{}) bool) ReplayFilter {
+	return func(d amqp.Delivery) bool {
+		return predicate(d.Headers[key])
+	}
+}
+
+// HeaderEquals accept deliveries whose header key formatted by fmt.Sprint equals value
+func HeaderEquals(key, value string) ReplayFilter {
+	return HeaderFilter(key, func(v interface{}) bool {
+		return v != nil && fmt.Sprint(v) == value
+	})
+}
+
+type ReplayOptions struct {
+	Filters           []ReplayFilter
+	DryRun            bool
+	Limit             int
+	RouteKeyConverter DeliveryRouteKeyConverter
+	MsgConverter      MsgConverter
+}
+
+type ReplayOption func(opts *ReplayOptions)
+
+// WithFilter add a filter, a delivery is replayed only if all filters accept it
+func WithFilter(filter ReplayFilter) ReplayOption {
+	return func(opts *ReplayOptions) {
+		opts.Filters = append(opts.Filters, filter)
+	}
+}
+
+// WithDryRun report what would be replayed, all deliveries are left in the source queue
+func WithDryRun() ReplayOption {
+	return func(opts *ReplayOptions) {
+		opts.DryRun = true
+	}
+}
+
+// WithLimit stop after limit deliveries forwarded, 0 means until the queue drained
+func WithLimit(limit int) ReplayOption {
+	return func(opts *ReplayOptions) {
+		opts.Limit = limit
+	}
+}
+
+func WithRouteKeyConverter(converter RouteKeyConverter) ReplayOption {
+	return WithDeliveryRouteKeyConverter(func(msg amqp.Delivery) string {
+		return converter(msg.RoutingKey)
+	})
+}
+
+func WithDeliveryRouteKeyConverter(converter DeliveryRouteKeyConverter) ReplayOption {
+	return func(opts *ReplayOptions) {
+		opts.RouteKeyConverter = converter
+	}
+}
+
+func WithMsgConverter(converter MsgConverter) ReplayOption {
+	return func(opts *ReplayOptions) {
+		opts.MsgConverter = converter
+	}
+}
+
+// ReplayReport is the result of a replay, in dry-run mode Forwarded is the number of deliveries would be forwarded
+type ReplayReport struct {
+	Forwarded int
+	Skipped   int
+	Failed    int
+}
+
+// Replayer move messages from a queue to an exchange, typically from an error queue back to the topic exchange
+type Replayer struct {
+	srcUrl  string
+	dstUrl  string
+	options *ReplayOptions
+}
+
+func NewReplayer(srcUrl, dstUrl string, opts ...ReplayOption) *Replayer {
+	options := &ReplayOptions{
+		RouteKeyConverter: func(msg amqp.Delivery) string {
+			return msg.RoutingKey
+		},
+		MsgConverter: SameMsgConvert,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	return &Replayer{
+		srcUrl:  srcUrl,
+		dstUrl:  dstUrl,
+		options: options,
+	}
+}
+
+// Replay forward the messages in srcQ to dstEx until the messages present at start are all taken, the limit reached or ctx done.
+// A message is acked only after its publishing confirmed, skipped and failed messages are requeued when replay finished.
+// The report is returned along with the error.
+func (r *Replayer) Replay(ctx context.Context, srcQ, dstEx string) (*ReplayReport, error) {
+	report := &ReplayReport{}
+
+	source, err := amqp.Dial(r.srcUrl)
+	if err != nil {
+		return report, err
+	}
+	defer source.Close()
+
+	chs, err := source.Channel()
+	if err != nil {
+		return report, err
+	}
+	defer chs.Close()
+
+	// messages published during replay, e.g. failed again, are left to the next replay
+	q, err := chs.QueueDeclarePassive(srcQ, true, false, false, false, nil)
+	if err != nil {
+		return report, err
+	}
+	remain := q.Messages
+
+	var pc *publishChannel
+	if !r.options.DryRun {
+		destination, err := Dial(r.dstUrl)
+		if err != nil {
+			return report, err
+		}
+		defer destination.Close()
+
+		pc = newPublishChannel(destination, true)
+		defer pc.close()
+	}
+
+	// deliveries kept unacked until the end, so they are not taken again
+	var held []amqp.Delivery
+	defer func() {
+		for _, d := range held {
+			if err := d.Nack(false, true); err != nil {
+				log.Error("Nack error", zap.Error(err), zap.Uint64("delivery_tag", d.DeliveryTag))
+			}
+		}
+	}()
+
+	for ; remain > 0; remain-- {
+		if r.options.Limit > 0 && report.Forwarded >= r.options.Limit {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		d, ok, err := chs.Get(srcQ, false)
+		if err != nil {
+			return report, err
+		}
+		if !ok {
+			break
+		}
+
+		if !r.accept(d) {
+			report.Skipped++
+			held = append(held, d)
+			continue
+		}
+
+		if r.options.DryRun {
+			report.Forwarded++
+			held = append(held, d)
+			continue
+		}
+
+		key := r.options.RouteKeyConverter(d)
+		future := pc.publish(dstEx, key, true, r.options.MsgConverter(d))
+		select {
+		case <-future.done:
+		case <-ctx.Done():
+			held = append(held, d)
+			return report, ctx.Err()
+		}
+		if future.err != nil {
+			log.Error("replay message error", zap.Error(future.err), zap.String("route_key", d.RoutingKey), zap.String("message_id", d.MessageId))
+			report.Failed++
+			held = append(held, d)
+			continue
+		}
+
+		if err := d.Ack(false); err != nil {
+			return report, err
+		}
+		report.Forwarded++
+		log.Info("forward", zap.Int("counts", report.Forwarded), zap.String("route_key", d.RoutingKey), zap.String("to", key))
+	}
+
+	log.Info("finished replay", zap.String("queue", srcQ), zap.Reflect("report", report))
+	return report, nil
+}
+
+func (r *Replayer) accept(d amqp.Delivery) bool {
+	return acceptAll(r.options.Filters, d)
+}
@@ -0,0 +1,72 @@
+package rabbitmq
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestReplayFilter(t *testing.T) {
+	d := amqp.Delivery{
+		RoutingKey: "error.user.created",
+		Headers:    amqp.Table{"x-retry-count": int32(3)},
+	}
+
+	for _, c := range []struct {
+		name   string
+		filter ReplayFilter
+		expect bool
+	}{
+		{"routing key", RoutingKeyFilter("error.user.*"), true},
+		{"routing key any", RoutingKeyFilter("error.order.#", "error.#"), true},
+		{"routing key miss", RoutingKeyFilter("error.order.#"), false},
+		{"header equals", HeaderEquals("x-retry-count", "3"), true},
+		{"header absent", HeaderEquals("x-missing", ""), false},
+		{"header predicate", HeaderFilter("x-retry-count", func(v interface{}) bool {
+			n, ok := v.(int32)
+			return ok && n > 5
+		}), false},
+	} {
+		if got := c.filter(d); got != c.expect {
+			t.Errorf("%s: expect %v but %v", c.name, c.expect, got)
+		}
+	}
+
+	r := NewReplayer("", "", WithFilter(RoutingKeyFilter("error.#")), WithFilter(HeaderEquals("x-retry-count", "1")))
+	if r.accept(d) {
+		t.Error("expect all filters required")
+	}
+}
+
+func TestErrConvert(t *testing.T) {
+	// quarantined by a router subscription, the error topic is named after the subscription
+	d := amqp.Delivery{
+		RoutingKey: "error.audit",
+		MessageId:  "1",
+		Headers: amqp.Table{
+			broker.OriginalTopicHeader:      "user.created",
+			broker.RetryCountHeader:         int32(3),
+			broker.FailureReasonHeader:      "boom",
+			broker.FailedSubscriptionHeader: "audit",
+			"x-tenant":                      "ankr",
+		},
+	}
+	assert.Equal(t, "user.created", ErrDeliveryRouteKeyConvert(d))
+	publishing := ErrMsgConvert(d)
+	assert.Equal(t, amqp.Table{broker.OriginalTopicHeader: "user.created", "x-tenant": "ankr"}, publishing.Headers)
+	assert.Equal(t, "1", publishing.MessageId)
+	assert.Len(t, d.Headers, 5, "delivery headers are untouched")
+
+	// dead-lettered by a nack, the original routing key is in x-death
+	d = amqp.Delivery{
+		RoutingKey: "error.audit",
+		Headers: amqp.Table{broker.DeathHeader: []interface{}{
+			amqp.Table{"queue": "audit", "reason": "rejected", "routing-keys": []interface{}{"user.updated"}},
+		}},
+	}
+	assert.Equal(t, "user.updated", ErrDeliveryRouteKeyConvert(d))
+
+	// nothing recorded
+	assert.Equal(t, "user.deleted", ErrDeliveryRouteKeyConvert(amqp.Delivery{RoutingKey: "error.user.deleted"}))
+}
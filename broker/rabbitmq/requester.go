@@ -0,0 +1,245 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"sync"
+)
+
+type replyResult struct {
+	delivery amqp.Delivery
+	err      error
+}
+
+// rabbitRequester own an exclusive, auto-delete and server-named reply queue on its own connection.
+// The queue is redeclared after reconnected, the requests pending on the lost queue fail with broker.ErrReplyQueueLost.
+type rabbitRequester struct {
+	broker     *rabbitBroker
+	codec      broker.Codec
+	middleware broker.PublisherMiddleware
+	schemas    *broker.SchemaRegistry
+	conn       *Connection
+	channel    *publishChannel
+
+	m       sync.Mutex
+	closed  bool
+	queue   string
+	ch      *amqp.Channel
+	pending map[string]chan replyResult
+}
+
+func newRabbitRequester(b *rabbitBroker, opts *broker.Options) (*rabbitRequester, error) {
+	conn, err := b.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &rabbitRequester{
+		broker:     b,
+		codec:      opts.Codec,
+		middleware: broker.ChainPublisher(opts.PublishMiddlewares...),
+		schemas:    opts.Schemas,
+		conn:       conn,
+		channel:    newPublishChannel(conn, true),
+		pending:    map[string]chan replyResult{},
+	}
+	if err := out.declare(); err != nil {
+		if err := conn.Close(); err != nil {
+			log.Error("conn.Close error", zap.Error(err))
+		}
+		return nil, err
+	}
+	go out.watch(conn.NotifyState(make(chan ConnectionState, 4)))
+
+	return out, nil
+}
+
+// declare the reply queue and consume it with auto ack, replies are never redelivered
+func (rr *rabbitRequester) declare() error {
+	channel, err := rr.conn.Channel(false)
+	if err != nil {
+		return err
+	}
+	ch := channel.Channel
+
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return err
+	}
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		_ = ch.Close()
+		return err
+	}
+
+	rr.m.Lock()
+	rr.queue = q.Name
+	rr.ch = ch
+	rr.m.Unlock()
+
+	go rr.receive(deliveries)
+	return nil
+}
+
+func (rr *rabbitRequester) watch(states chan ConnectionState) {
+	for state := range states {
+		switch state {
+		case StateDisconnected:
+			rr.fail(broker.ErrReplyQueueLost)
+		case StateConnected:
+			if err := rr.declare(); err != nil {
+				log.Error("redeclare reply queue error", zap.Error(err))
+			}
+		}
+	}
+}
+
+// fail all pending requests, their replies are lost along with the reply queue
+func (rr *rabbitRequester) fail(reason error) {
+	rr.m.Lock()
+	defer rr.m.Unlock()
+	rr.queue = ""
+	rr.ch = nil
+	for id, replyCh := range rr.pending {
+		replyCh <- replyResult{err: reason}
+		delete(rr.pending, id)
+	}
+}
+
+func (rr *rabbitRequester) receive(deliveries <-chan amqp.Delivery) {
+	for d := range deliveries {
+		rr.m.Lock()
+		replyCh, ok := rr.pending[d.CorrelationId]
+		delete(rr.pending, d.CorrelationId)
+		rr.m.Unlock()
+		if !ok {
+			log.Info("drop orphaned reply", zap.String("correlation_id", d.CorrelationId))
+			continue
+		}
+		replyCh <- replyResult{delivery: d}
+	}
+}
+
+func (rr *rabbitRequester) Request(ctx context.Context, topic string, req, resp proto.Message, opts ...broker.PublishOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	correlationID := uuid.New().String()
+	replyCh := make(chan replyResult, 1)
+	rr.m.Lock()
+	if rr.closed {
+		rr.m.Unlock()
+		return broker.ErrClosed
+	}
+	queue := rr.queue
+	if queue == "" {
+		rr.m.Unlock()
+		return broker.ErrReplyQueueLost
+	}
+	rr.pending[correlationID] = replyCh
+	rr.m.Unlock()
+	defer func() {
+		rr.m.Lock()
+		delete(rr.pending, correlationID)
+		rr.m.Unlock()
+	}()
+
+	err := broker.InterceptPublish(ctx, rr.middleware, broker.NewMessage(topic, req), broker.NewPublishOptions(true, opts...),
+		func(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+			options.CorrelationID = correlationID
+			options.ReplyTo = queue
+			return rr.publish(ctx, msg, options)
+		})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case reply := <-replyCh:
+		if reply.err != nil {
+			return reply.err
+		}
+		if err := broker.ReplyError(reply.delivery.Headers); err != nil {
+			return err
+		}
+		return broker.Decode(rr.codec, reply.delivery.ContentType, reply.delivery.Body, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publish the request mandatory, a request without responder fails with ErrPublishMessageMiss instead of waiting the timeout
+func (rr *rabbitRequester) publish(ctx context.Context, msg *broker.Message, options *broker.PublishOptions) error {
+	if err := rr.schemas.CheckPublish(msg.Topic, msg.Value, options); err != nil {
+		return err
+	}
+	body, err := rr.codec.Marshal(msg.Value)
+	if err != nil {
+		return err
+	}
+
+	options.Expiration = broker.RequestExpiration(ctx)
+	publishing := newPublishing(options)
+	publishing.ContentType = rr.codec.ContentType()
+	publishing.Body = body
+	if publishing.MessageId == "" {
+		publishing.MessageId = uuid.New().String()
+	}
+
+	future := rr.channel.publish(rr.broker.exchange, msg.Topic, true, publishing)
+	select {
+	case <-future.done:
+		return future.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close fail the pending requests with broker.ErrClosed instead of leaving them to their timeouts
+func (rr *rabbitRequester) Close() error {
+	rr.m.Lock()
+	rr.closed = true
+	rr.m.Unlock()
+	rr.fail(broker.ErrClosed)
+
+	rr.channel.close()
+	return rr.conn.Close()
+}
+
+// reply publish the result of a responder to the reply queue of the request through the default exchange.
+// It is not mandatory, the requester may have gone.
+func (rp *rabbitPublisher) reply(ctx context.Context, meta broker.Metadata, codec broker.Codec, resp proto.Message, err error) error {
+	if meta.ReplyTo == "" {
+		log.Error("request without reply queue, drop the reply", zap.String("topic", meta.Topic), zap.String("message_id", meta.MessageID))
+		return nil
+	}
+
+	publishing := newPublishing(&broker.PublishOptions{
+		Headers:       broker.ReplyHeaders(err),
+		CorrelationID: meta.CorrelationID,
+	})
+	publishing.ContentType = codec.ContentType()
+	if err == nil && resp != nil {
+		body, marshalErr := codec.Marshal(resp)
+		if marshalErr != nil {
+			return fmt.Errorf("marshal reply error: %w", marshalErr)
+		}
+		publishing.Body = body
+		publishing.Type = proto.MessageName(resp)
+	}
+
+	future := rp.pool.get().publish("", meta.ReplyTo, false, publishing)
+	select {
+	case <-future.done:
+		return future.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,35 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRequesterClose(t *testing.T) {
+	// the connection is closed already, Close only fail the requests
+	conn := &Connection{closing: 1, done: make(chan struct{})}
+	rr := &rabbitRequester{
+		conn:    conn,
+		channel: newPublishChannel(conn, true),
+		queue:   "amq.gen-reply",
+		pending: map[string]chan replyResult{},
+	}
+	replyCh := make(chan replyResult, 1)
+	rr.pending["1"] = replyCh
+
+	_ = rr.Close()
+	select {
+	case reply := <-replyCh:
+		assert.Equal(t, broker.ErrClosed, reply.err)
+	case <-time.After(time.Second):
+		t.Fatal("pending request is not failed")
+	}
+	assert.Empty(t, rr.pending)
+
+	err := rr.Request(context.Background(), "test", &wrappers.StringValue{}, &wrappers.StringValue{})
+	assert.Equal(t, broker.ErrClosed, err)
+}
@@ -0,0 +1,93 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+const (
+	// minRetryStep is the precision of short retry delays
+	minRetryStep = 10 * time.Millisecond
+	// retryQueueIdle is how long a retry queue is kept unused after its messages expired
+	retryQueueIdle = 30 * time.Minute
+)
+
+// retryBucket round d up to the delay of a retry queue like delayBucket but at minRetryStep precision, so jittered
+// or exponential backoffs share a bounded number of retry queues
+func retryBucket(d time.Duration) time.Duration {
+	return roundBucket(d, minRetryStep)
+}
+
+// retrier delay a failed delivery by publishing it into a TTL retry queue,
+// which dead-letter the message back to the original queue through the default exchange once expired.
+// Retry queues expire after retryQueueIdle unused, publishing doesn't count as use so they are redeclared
+// every half of it while in use.
+type retrier struct {
+	conn    *Connection
+	queue   string
+	channel *publishChannel
+
+	m sync.Mutex
+	// declared is when each retry queue was declared last
+	declared map[string]time.Time
+}
+
+func newRetrier(conn *Connection, queue string) *retrier {
+	return &retrier{
+		conn:     conn,
+		queue:    queue,
+		channel:  newPublishChannel(conn, true),
+		declared: map[string]time.Time{},
+	}
+}
+
+func retryQueueName(queue string, delay time.Duration) string {
+	return fmt.Sprintf("%s.retry.%d", queue, delay/time.Millisecond)
+}
+
+func (r *retrier) retry(d amqp.Delivery, attempt int, delay time.Duration) error {
+	delay = retryBucket(delay)
+	name := retryQueueName(r.queue, delay)
+	if err := r.declare(name, delay); err != nil {
+		return err
+	}
+
+	publishing := SameMsgConvert(d)
+	publishing.Headers = amqp.Table{}
+	for k, v := range d.Headers {
+		publishing.Headers[k] = v
+	}
+	publishing.Headers[broker.RetryCountHeader] = int32(attempt)
+	if _, ok := publishing.Headers[broker.OriginalTopicHeader]; !ok {
+		publishing.Headers[broker.OriginalTopicHeader] = d.RoutingKey
+	}
+	publishing.DeliveryMode = amqp.Persistent
+
+	future := r.channel.publish("", name, false, publishing)
+	<-future.done
+	return future.err
+}
+
+func (r *retrier) declare(name string, delay time.Duration) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if last, ok := r.declared[name]; ok && time.Since(last) < retryQueueIdle/2 {
+		return nil
+	}
+
+	ch, err := r.conn.Channel(false)
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	if err := retryQueueDeclare(name, r.queue, delay, ch.Channel); err != nil {
+		return err
+	}
+	r.declared[name] = time.Now()
+	return nil
+}
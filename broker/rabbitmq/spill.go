@@ -0,0 +1,263 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/spill"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSpillNacks is how many times a spilled publishing nacked by RabbitMQ is replayed before it is dropped
+const maxSpillNacks = 3
+
+var (
+	// ErrCircuitOpen is returned immediately instead of publishing while RabbitMQ is unavailable and the spill buffer is full
+	ErrCircuitOpen = errors.New("rabbitmq unavailable and spill buffer full")
+)
+
+func init() {
+	// types of amqp.Table values which gob doesn't know
+	gob.Register(amqp.Table{})
+	gob.Register([]interface{}{})
+	gob.Register(time.Time{})
+	gob.Register(amqp.Decimal{})
+}
+
+// spillRecord is a publishing held in the spill buffer
+type spillRecord struct {
+	Exchange   string
+	Key        string
+	Mandatory  bool
+	Publishing amqp.Publishing
+}
+
+func encodeSpillRecord(record *spillRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSpillRecord(data []byte) (*spillRecord, error) {
+	out := &spillRecord{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// spiller is the circuit breaker of publishers. While the connection of a publisher is not connected, publishings
+// are appended to the spill buffer and replayed in order on a connection of its own once that is connected.
+// Publishings failed by the channel before the disconnection noticed are appended as well, see fallback.
+// The circuit stays open until the buffer drained so publishings are kept in order, and it fails fast with
+// ErrCircuitOpen when the buffer is full.
+type spiller struct {
+	broker  *rabbitBroker
+	buffer  *spill.Log
+	conn    *Connection
+	channel *publishChannel
+	// full is 1 after an append rejected, to log once per outage
+	full int32
+	// nacks is how many times the head record nacked, only accessed by run
+	nacks int
+
+	wake    chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func newSpiller(b *rabbitBroker, dir string, opts ...spill.Option) (*spiller, error) {
+	buffer, err := spill.Open(dir, opts...)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := b.dial()
+	if err != nil {
+		_ = buffer.Close()
+		return nil, err
+	}
+
+	out := &spiller{
+		broker:  b,
+		buffer:  buffer,
+		conn:    conn,
+		channel: newPublishChannel(conn, true),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if n := buffer.Len(); n > 0 {
+		log.Info("replay spilled publishings of last run", zap.Int("count", n))
+	}
+	go out.run()
+	return out, nil
+}
+
+// open report whether publishings over conn should be spilled
+func (s *spiller) open(conn *Connection) bool {
+	return !conn.Healthy() || s.buffer.Len() > 0
+}
+
+// spill append publishing to the buffer, the returned future is resolved once the publishing is on disk
+func (s *spiller) spill(exchange, key string, mandatory bool, publishing amqp.Publishing) (*publishFuture, error) {
+	data, err := encodeSpillRecord(&spillRecord{
+		Exchange:   exchange,
+		Key:        key,
+		Mandatory:  mandatory,
+		Publishing: publishing,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.buffer.Append(data); err != nil {
+		if err != spill.ErrFull {
+			return nil, err
+		}
+		if atomic.CompareAndSwapInt32(&s.full, 0, 1) {
+			log.Error("spill buffer full, reject publishings", zap.Int("count", s.buffer.Len()), zap.Int64("size", s.buffer.Size()))
+		}
+		return nil, ErrCircuitOpen
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	future := newPublishFuture(publishing.MessageId)
+	future.resolve(nil)
+	return future, nil
+}
+
+// spillable report whether a publishing failed with err should be spilled, errors of the channel or connection are,
+// while a publishing nacked or returned by RabbitMQ would fail again
+func spillable(err error) bool {
+	return err != nil && err != ErrPublishMessageMiss && err != ErrPublishMessageNotAck
+}
+
+// fallback spill a publishing failed with cause, report whether it is spilled. The publishing may be received
+// by RabbitMQ already if its confirm is lost, so it may be published twice.
+func (s *spiller) fallback(exchange, key string, mandatory bool, publishing amqp.Publishing, cause error) bool {
+	if _, err := s.spill(exchange, key, mandatory, publishing); err != nil {
+		log.Error("spill failed publishing error", zap.Error(err), zap.NamedError("cause", cause),
+			zap.String("topic", key), zap.String("message_id", publishing.MessageId))
+		return false
+	}
+	log.Info("spill failed publishing", zap.Error(cause), zap.String("topic", key),
+		zap.String("message_id", publishing.MessageId))
+	return true
+}
+
+// run drain the buffer whenever it grows or the connection reconnected, until the connection closed
+func (s *spiller) run() {
+	defer close(s.stopped)
+	states := s.conn.NotifyState(make(chan ConnectionState, 4))
+
+	var retry <-chan time.Time
+	for {
+		retry = nil
+		if s.conn.Healthy() {
+			if err := s.drain(); err != nil {
+				log.Error("replay spilled publishing error", zap.Error(err), zap.Int("count", s.buffer.Len()))
+				retry = time.After(s.broker.nackDelay)
+			}
+		}
+
+		select {
+		case _, ok := <-states:
+			if !ok {
+				return
+			}
+		case <-s.wake:
+		case <-retry:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// drain publish records in order until the buffer empty, a record is removed after confirmed or dropped, see settle
+func (s *spiller) drain() error {
+	for {
+		data, err := s.buffer.Peek()
+		if err == spill.ErrEmpty {
+			atomic.StoreInt32(&s.full, 0)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		record, err := decodeSpillRecord(data)
+		if err != nil {
+			log.Error("drop undecodable spilled publishing", zap.Error(err))
+			if err := s.buffer.Ack(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		start := time.Now()
+		future := s.channel.publish(record.Exchange, record.Key, record.Mandatory, record.Publishing)
+		select {
+		case <-future.done:
+		case <-s.done:
+			return nil
+		}
+		if err := s.settle(record, future.err); err != nil {
+			return err
+		}
+		s.broker.metrics.Published(record.Key, broker.PublishStatusOf(future.err), time.Since(start))
+
+		if err := s.buffer.Ack(); err != nil {
+			return err
+		}
+	}
+}
+
+// settle decide whether the replayed head record is removed, err is returned if it should be replayed again.
+// Unroutable records are dropped as a direct publishing would fail, records nacked by RabbitMQ are dropped
+// after maxSpillNacks, so a single record doesn't block the records behind it and keep the circuit open.
+func (s *spiller) settle(record *spillRecord, err error) error {
+	switch err {
+	case nil:
+	case ErrPublishMessageMiss:
+		log.Error("drop unroutable spilled publishing", zap.String("topic", record.Key),
+			zap.String("message_id", record.Publishing.MessageId))
+	case ErrPublishMessageNotAck:
+		if s.nacks++; s.nacks < maxSpillNacks {
+			return err
+		}
+		log.Error("drop nacked spilled publishing", zap.String("topic", record.Key),
+			zap.String("message_id", record.Publishing.MessageId), zap.Int("attempts", s.nacks))
+	default:
+		return err
+	}
+	s.nacks = 0
+	return nil
+}
+
+// close stop replaying, the records left are replayed by the next broker on the same directory
+func (s *spiller) close() error {
+	var result error
+	s.once.Do(func() {
+		close(s.done)
+		<-s.stopped
+		s.channel.close()
+		if err := s.conn.Close(); err != nil {
+			result = err
+		}
+		if err := s.buffer.Close(); err != nil && result == nil {
+			result = err
+		}
+	})
+	return result
+}
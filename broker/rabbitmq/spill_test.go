@@ -0,0 +1,168 @@
+package rabbitmq
+
+import (
+	"github.com/Ankr-network/kit/broker"
+	"github.com/Ankr-network/kit/broker/spill"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestSpiller(t *testing.T, opts ...spill.Option) *spiller {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	buffer, err := spill.Open(dir, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = buffer.Close()
+		_ = os.RemoveAll(dir)
+	})
+	return &spiller{
+		buffer: buffer,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+func TestSpillRecord(t *testing.T) {
+	record := &spillRecord{
+		Exchange:  "ex",
+		Key:       "user.created",
+		Mandatory: true,
+		Publishing: amqp.Publishing{
+			Headers: amqp.Table{
+				"tenant":        "t1",
+				"x-retry-count": int32(2),
+				"x-death":       []interface{}{amqp.Table{"count": int64(1), "time": time.Unix(1600000000, 0)}},
+			},
+			ContentType:  "application/protobuf",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    "1",
+			Body:         []byte("body"),
+		},
+	}
+	data, err := encodeSpillRecord(record)
+	require.NoError(t, err)
+	decoded, err := decodeSpillRecord(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, record.Exchange, decoded.Exchange)
+	assert.Equal(t, record.Key, decoded.Key)
+	assert.True(t, decoded.Mandatory)
+	assert.Equal(t, record.Publishing.Body, decoded.Publishing.Body)
+	assert.Equal(t, int32(2), decoded.Publishing.Headers["x-retry-count"])
+	deaths := decoded.Publishing.Headers["x-death"].([]interface{})
+	assert.Equal(t, int64(1), deaths[0].(amqp.Table)["count"])
+	assert.True(t, time.Unix(1600000000, 0).Equal(deaths[0].(amqp.Table)["time"].(time.Time)))
+}
+
+func TestSpillerCircuit(t *testing.T) {
+	s := newTestSpiller(t, spill.WithMaxSize(4096))
+	connected := &Connection{state: int32(StateConnected)}
+	disconnected := &Connection{state: int32(StateReconnecting)}
+
+	assert.False(t, s.open(connected))
+	assert.True(t, s.open(disconnected))
+
+	var spilled []string
+	for i := 0; ; i++ {
+		id := string(rune('a' + i))
+		future, err := s.spill("ex", "user.created", true, amqp.Publishing{MessageId: id})
+		if err != nil {
+			// fail fast once full
+			assert.Equal(t, ErrCircuitOpen, err)
+			break
+		}
+		<-future.done
+		assert.NoError(t, future.err)
+		spilled = append(spilled, id)
+	}
+	require.NotEmpty(t, spilled)
+	assert.Len(t, s.wake, 1)
+
+	// the circuit stays open until drained, so publishings keep their order
+	assert.True(t, s.open(connected))
+	for _, id := range spilled {
+		data, err := s.buffer.Peek()
+		require.NoError(t, err)
+		record, err := decodeSpillRecord(data)
+		require.NoError(t, err)
+		assert.Equal(t, id, record.Publishing.MessageId)
+		require.NoError(t, s.buffer.Ack())
+	}
+	assert.False(t, s.open(connected))
+}
+
+// newDroppedConnection return a connection whose underlying connection dropped but not noticed yet, it is still connected
+func newDroppedConnection(t *testing.T) *Connection {
+	client, server := net.Pipe()
+	require.NoError(t, server.Close())
+	dropped, err := amqp.Open(client, amqp.Config{})
+	require.Error(t, err)
+	require.Eventually(t, dropped.IsClosed, time.Second, time.Millisecond)
+	return &Connection{
+		Connection: dropped,
+		state:      int32(StateConnected),
+		done:       make(chan struct{}),
+	}
+}
+
+func TestSpillFailedPublishing(t *testing.T) {
+	s := newTestSpiller(t, spill.WithMaxSize(4096))
+	conn := newDroppedConnection(t)
+	rp := &rabbitPublisher{
+		broker:   &rabbitBroker{spiller: s, metrics: broker.NopMetrics},
+		reliable: true,
+		conn:     conn,
+		pool:     newPublishPool(conn, true, 1),
+	}
+	require.False(t, s.open(conn))
+
+	// the first publishing after the connection dropped fails on the channel, and is spilled
+	future, err := rp.publish("ex", "user.created", amqp.Publishing{Body: []byte("first")})
+	require.NoError(t, err)
+	<-future.done
+	assert.NoError(t, future.err)
+	assert.Equal(t, 1, s.buffer.Len())
+	assert.True(t, s.open(conn), "later publishings are spilled after it to keep the order")
+
+	data, err := s.buffer.Peek()
+	require.NoError(t, err)
+	record, err := decodeSpillRecord(data)
+	require.NoError(t, err)
+	assert.Equal(t, "user.created", record.Key)
+	assert.Equal(t, "first", string(record.Publishing.Body))
+	assert.Equal(t, future.messageID, record.Publishing.MessageId)
+	require.NoError(t, s.buffer.Ack())
+
+	// the breaker doesn't allow spilling once the buffer is full, the publishing fails with its own error
+	rp.broker.spiller = newTestSpiller(t, spill.WithMaxSize(1))
+	future, err = rp.publish("ex", "user.created", amqp.Publishing{Body: []byte("second")})
+	require.NoError(t, err)
+	<-future.done
+	assert.Equal(t, amqp.ErrClosed, future.err)
+}
+
+func TestSpillSettle(t *testing.T) {
+	s := newTestSpiller(t)
+	record := &spillRecord{Key: "user.created", Publishing: amqp.Publishing{MessageId: "a"}}
+
+	assert.NoError(t, s.settle(record, ErrPublishMessageMiss))
+	assert.Equal(t, amqp.ErrClosed, s.settle(record, amqp.ErrClosed))
+
+	// nacked records are replayed until maxSpillNacks, channel errors meanwhile don't count
+	for i := 1; i < maxSpillNacks; i++ {
+		assert.Equal(t, ErrPublishMessageNotAck, s.settle(record, ErrPublishMessageNotAck))
+		assert.Equal(t, amqp.ErrClosed, s.settle(record, amqp.ErrClosed))
+	}
+	assert.NoError(t, s.settle(record, ErrPublishMessageNotAck))
+
+	// counted again for the next record
+	assert.Equal(t, ErrPublishMessageNotAck, s.settle(record, ErrPublishMessageNotAck))
+	assert.NoError(t, s.settle(record, nil))
+	assert.Equal(t, ErrPublishMessageNotAck, s.settle(record, ErrPublishMessageNotAck))
+}
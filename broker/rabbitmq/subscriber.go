@@ -1,26 +1,38 @@
 package rabbitmq
 
 import (
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/streadway/amqp"
 	"go.uber.org/zap"
+	"time"
 )
 
 type rabbitSubscriber struct {
 	broker   *rabbitBroker
 	name     string
-	topic    string
+	topics   []string
+	errTopic string
 	reliable bool
+	prefetch int
+	tag      string
 	conn     *Connection
 	channel  *Channel
 	isErrSub bool
+	// partitionOf is the subscription name of the partition queue, empty if not partitioned
+	partitionOf string
+	partition   int
 }
 
-func newRabbitSubscriber(broker *rabbitBroker, name, topic string, reliable bool) (*rabbitSubscriber, error) {
+// newRabbitSubscriber bind queue name to topics, failed messages are dead-lettered with errTopic if reliable
+func newRabbitSubscriber(broker *rabbitBroker, name string, topics []string, errTopic string, reliable bool, prefetch int) (*rabbitSubscriber, error) {
 	out := &rabbitSubscriber{
 		broker:   broker,
 		name:     name,
-		topic:    topic,
+		topics:   topics,
+		errTopic: errTopic,
 		reliable: reliable,
+		prefetch: prefetch,
 		isErrSub: false,
 	}
 	if err := out.init(); err != nil {
@@ -30,12 +42,33 @@ func newRabbitSubscriber(broker *rabbitBroker, name, topic string, reliable bool
 	return out, nil
 }
 
-func newErrRabbitSubscriber(broker *rabbitBroker, name, errTopic string) (*rabbitSubscriber, error) {
+// newPartitionSubscriber bind the partition queue of subscription name to the partition of topic
+func newPartitionSubscriber(broker *rabbitBroker, name string, partition int, topic, errTopic string, reliable bool, prefetch int) (*rabbitSubscriber, error) {
+	out := &rabbitSubscriber{
+		broker:      broker,
+		name:        partitionQueueName(name, partition),
+		topics:      []string{topic},
+		errTopic:    errTopic,
+		reliable:    reliable,
+		prefetch:    prefetch,
+		partitionOf: name,
+		partition:   partition,
+	}
+	if err := out.init(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// newErrRabbitSubscriber bind queue name to errTopic of the DLX, messages are acked manually like a reliable subscriber
+func newErrRabbitSubscriber(broker *rabbitBroker, name, errTopic string, prefetch int) (*rabbitSubscriber, error) {
 	out := &rabbitSubscriber{
 		broker:   broker,
 		name:     name,
-		topic:    errTopic,
+		topics:   []string{errTopic},
 		reliable: true,
+		prefetch: prefetch,
 		isErrSub: true,
 	}
 	if err := out.init(); err != nil {
@@ -46,13 +79,11 @@ func newErrRabbitSubscriber(broker *rabbitBroker, name, errTopic string) (*rabbi
 }
 
 func (rs *rabbitSubscriber) init() error {
-	conn, err := Dial(rs.broker.url)
+	conn, err := rs.broker.dial()
 	if err != nil {
 		return err
 	}
-	conn.m.RLock()
 	ch, err := conn.Channel(true)
-	conn.m.RUnlock()
 	if err != nil {
 		if err := conn.Close(); err != nil {
 			log.Error("conn.Close error", zap.Error(err))
@@ -60,53 +91,80 @@ func (rs *rabbitSubscriber) init() error {
 		return err
 	}
 
-	var dlx string
-	if rs.reliable && !rs.isErrSub {
-		dlx = rs.broker.dlx
-	}
-
-	if err := queueDeclare(rs.name, rs.topic, dlx, rs.reliable, conn.Connection); err != nil {
-		if err := conn.Close(); err != nil {
-			log.Error("conn.Close error", zap.Error(err))
+	if rs.prefetch > 0 {
+		ch.m.RLock()
+		err := ch.Qos(rs.prefetch, 0, false)
+		ch.m.RUnlock()
+		if err != nil {
+			if err := conn.Close(); err != nil {
+				log.Error("conn.Close error", zap.Error(err))
+			}
+			return err
 		}
-		return err
 	}
 
-	var exchange string
-	if rs.isErrSub {
-		exchange = rs.broker.dlx
-	} else {
-		exchange = rs.broker.exchange
-	}
-
-	ch.m.RLock()
-	if err := queueBind(rs.name, rs.topic, exchange, ch.Channel); err != nil {
-		ch.m.RUnlock()
+	if _, err := rs.topology().Apply(conn.Connection, rs.broker.conflict); err != nil {
 		if err := conn.Close(); err != nil {
 			log.Error("conn.Close error", zap.Error(err))
 		}
 		return err
 	}
-	ch.m.RUnlock()
 
 	rs.conn = conn
 	rs.channel = ch
+	rs.tag = fmt.Sprintf("%s-%s", rs.name, uuid.New().String())
 
 	return nil
 }
 
+// topology is the queue of the subscriber and its binding, unreliable queue drops messages after 20s
+func (rs *rabbitSubscriber) topology() *Topology {
+	queue := QueueSpec{
+		Name:    rs.name,
+		Durable: true,
+	}
+	exchange := rs.broker.exchange
+	switch {
+	case rs.isErrSub:
+		exchange = rs.broker.dlx
+	case !rs.reliable:
+		queue.MessageTTL = 20 * time.Second
+	case rs.broker.dlx != "":
+		queue.DeadLetterExchange = rs.broker.dlx
+		queue.DeadLetterRoutingKey = rs.errTopic
+	}
+	if rs.partitionOf != "" {
+		return rs.partitionTopology(queue)
+	}
+
+	bindings := make([]BindingSpec, len(rs.topics))
+	for i, topic := range rs.topics {
+		bindings[i] = BindingSpec{
+			Queue:    rs.name,
+			Exchange: exchange,
+			Key:      topic,
+		}
+	}
+	return rs.broker.exchangeTopology().Merge(&Topology{
+		Queues:   []QueueSpec{queue},
+		Bindings: bindings,
+	})
+}
+
 func (rs *rabbitSubscriber) Close() error {
 	return rs.conn.Close()
 }
 
 func (rs *rabbitSubscriber) Consume() (<-chan amqp.Delivery, error) {
-	autoAck := true
-	if rs.reliable && !rs.isErrSub {
-		autoAck = false
-	}
 	rs.channel.m.RLock()
-	deliveries, err := rs.channel.Consume(rs.name, "", autoAck, false, false, false, nil)
+	deliveries, err := rs.channel.Consume(rs.name, rs.tag, !rs.reliable, false, false, false, nil)
 	rs.channel.m.RUnlock()
 	return deliveries, err
+}
 
+// Cancel stop the server delivering messages, the deliveries end after the buffered ones drained
+func (rs *rabbitSubscriber) Cancel() error {
+	rs.channel.m.RLock()
+	defer rs.channel.m.RUnlock()
+	return rs.channel.Cancel(rs.tag, false)
 }
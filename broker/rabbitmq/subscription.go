@@ -0,0 +1,89 @@
+package rabbitmq
+
+import (
+	"context"
+	"github.com/Ankr-network/kit/broker"
+	"go.uber.org/zap"
+	"sync"
+)
+
+type rabbitSubscription struct {
+	broker     *rabbitBroker
+	subscriber *rabbitSubscriber
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+	once       sync.Once
+}
+
+func (r *rabbitBroker) subscribe(s *rabbitSubscriber, h *handler, concurrency int) (*rabbitSubscription, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.closed {
+		if err := s.Close(); err != nil {
+			log.Error("subscriber.Close error", zap.Error(err))
+		}
+		return nil, broker.ErrClosed
+	}
+
+	deliveries, err := s.Consume()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+	out := &rabbitSubscription{
+		broker:     r,
+		subscriber: s,
+		cancel:     cancel,
+	}
+
+	// workers share the delivery channel, each delivery is acked by the worker handling it
+	out.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer out.wg.Done()
+			h.consume(ctx, deliveries)
+		}()
+	}
+
+	r.subscriptions[out] = struct{}{}
+
+	return out, nil
+}
+
+func (rs *rabbitSubscription) Unsubscribe(ctx context.Context) error {
+	var err error
+	rs.once.Do(func() {
+		err = rs.unsubscribe(ctx)
+	})
+	return err
+}
+
+func (rs *rabbitSubscription) unsubscribe(ctx context.Context) error {
+	defer rs.broker.removeSubscription(rs)
+
+	if err := rs.subscriber.Cancel(); err != nil {
+		log.Error("cancel consumer error", zap.Error(err), zap.String("queue", rs.subscriber.name))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		rs.wg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Error("in-flight messages not finished before unsubscribe deadline", zap.String("queue", rs.subscriber.name))
+		err = ctx.Err()
+	}
+
+	// cancel contexts of the handlers still running, their unacked messages are requeued by connection close
+	rs.cancel()
+	if closeErr := rs.subscriber.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,456 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"github.com/streadway/amqp"
+	"go.uber.org/zap"
+	"math"
+	"strings"
+	"time"
+)
+
+// ConflictStrategy decide what Topology.Apply does when a live exchange or queue is declared with different arguments.
+// Exchanges are never recreated, deleting an exchange drops all its bindings including those of queues
+// outside the topology, a conflicted exchange fails with the recreate strategies and must be resolved manually.
+type ConflictStrategy int
+
+const (
+	// ConflictRecreateIfEmpty delete and declare again only if the queue is empty, fail otherwise
+	ConflictRecreateIfEmpty ConflictStrategy = iota
+	// ConflictFail return error before any change applied
+	ConflictFail
+	// ConflictIgnore keep the live object as it is
+	ConflictIgnore
+	// ConflictRecreate delete and declare again the queue, messages in the queue are lost
+	ConflictRecreate
+)
+
+func (s ConflictStrategy) String() string {
+	switch s {
+	case ConflictRecreateIfEmpty:
+		return "recreate-if-empty"
+	case ConflictFail:
+		return "fail"
+	case ConflictIgnore:
+		return "ignore"
+	case ConflictRecreate:
+		return "recreate"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	ErrTopologyConflict = errors.New("topology conflict")
+)
+
+// ExchangeSpec is a desired exchange
+type ExchangeSpec struct {
+	Name string
+	// Kind is the exchange type, default topic
+	Kind       string
+	Durable    bool
+	AutoDelete bool
+	Internal   bool
+	// AlternateExchange receive messages cannot route to any queue
+	AlternateExchange string
+	Args              amqp.Table
+}
+
+func (e *ExchangeSpec) kind() string {
+	if e.Kind == "" {
+		return amqp.ExchangeTopic
+	}
+	return e.Kind
+}
+
+func (e *ExchangeSpec) args() amqp.Table {
+	out := amqp.Table{}
+	for k, v := range e.Args {
+		out[k] = v
+	}
+	if e.AlternateExchange != "" {
+		out["alternate-exchange"] = e.AlternateExchange
+	}
+	return out
+}
+
+func (e *ExchangeSpec) declare(ch *amqp.Channel) error {
+	return ch.ExchangeDeclare(e.Name, e.kind(), e.Durable, e.AutoDelete, e.Internal, false, e.args())
+}
+
+// QueueSpec is a desired queue
+type QueueSpec struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	// DeadLetterExchange receive rejected and expired messages, "" is the default exchange if DeadLetterRoutingKey set
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	MessageTTL           time.Duration
+	Args                 amqp.Table
+}
+
+func (q *QueueSpec) deadLettered() bool {
+	return q.DeadLetterExchange != "" || q.DeadLetterRoutingKey != ""
+}
+
+func (q *QueueSpec) args() amqp.Table {
+	out := amqp.Table{}
+	for k, v := range q.Args {
+		out[k] = v
+	}
+	if q.deadLettered() {
+		out["x-dead-letter-exchange"] = q.DeadLetterExchange
+	}
+	if q.DeadLetterRoutingKey != "" {
+		out["x-dead-letter-routing-key"] = q.DeadLetterRoutingKey
+	}
+	if q.MessageTTL > 0 {
+		// encode as the previous queueDeclare did, a different integer type may be taken as a different argument
+		if ttl := int64(q.MessageTTL / time.Millisecond); ttl <= math.MaxInt32 {
+			out["x-message-ttl"] = int32(ttl)
+		} else {
+			out["x-message-ttl"] = ttl
+		}
+	}
+	return out
+}
+
+func (q *QueueSpec) declare(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, q.args())
+	return err
+}
+
+// BindingSpec bind Queue to Exchange with Key, or bind DestinationExchange to Exchange instead of a queue
+type BindingSpec struct {
+	Queue               string
+	DestinationExchange string
+	Exchange            string
+	Key                 string
+	Args                amqp.Table
+}
+
+func (b *BindingSpec) bind(ch *amqp.Channel) error {
+	if b.DestinationExchange != "" {
+		return ch.ExchangeBind(b.DestinationExchange, b.Key, b.Exchange, false, b.Args)
+	}
+	return ch.QueueBind(b.Queue, b.Key, b.Exchange, false, b.Args)
+}
+
+// Topology is a declarative set of exchanges, queues and bindings
+type Topology struct {
+	Exchanges []ExchangeSpec
+	Queues    []QueueSpec
+	Bindings  []BindingSpec
+}
+
+// Merge return a topology of both, specs of o come later
+func (t *Topology) Merge(o *Topology) *Topology {
+	if o == nil {
+		return t
+	}
+	return &Topology{
+		Exchanges: append(append([]ExchangeSpec(nil), t.Exchanges...), o.Exchanges...),
+		Queues:    append(append([]QueueSpec(nil), t.Queues...), o.Queues...),
+		Bindings:  append(append([]BindingSpec(nil), t.Bindings...), o.Bindings...),
+	}
+}
+
+// ValidationError list the problems of a topology
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid topology: " + strings.Join(e, "; ")
+}
+
+var exchangeKinds = map[string]bool{
+	amqp.ExchangeDirect:  true,
+	amqp.ExchangeFanout:  true,
+	amqp.ExchangeTopic:   true,
+	amqp.ExchangeHeaders: true,
+}
+
+// Validate check names are unique and every referenced exchange or queue is in the topology, the error is a ValidationError
+func (t *Topology) Validate() error {
+	var problems ValidationError
+
+	exchanges := map[string]bool{}
+	for _, e := range t.Exchanges {
+		switch {
+		case e.Name == "" || strings.HasPrefix(e.Name, "amq."):
+			problems = append(problems, fmt.Sprintf("invalid exchange name %q", e.Name))
+		case exchanges[e.Name]:
+			problems = append(problems, fmt.Sprintf("duplicate exchange %q", e.Name))
+		}
+		exchanges[e.Name] = true
+		if !exchangeKinds[e.kind()] && !strings.HasPrefix(e.kind(), "x-") {
+			problems = append(problems, fmt.Sprintf("exchange %q of unknown kind %q", e.Name, e.kind()))
+		}
+	}
+	for _, e := range t.Exchanges {
+		if e.AlternateExchange != "" && !exchanges[e.AlternateExchange] {
+			problems = append(problems, fmt.Sprintf("exchange %q with undeclared alternate exchange %q", e.Name, e.AlternateExchange))
+		}
+	}
+
+	queues := map[string]bool{}
+	for _, q := range t.Queues {
+		switch {
+		case q.Name == "" || strings.HasPrefix(q.Name, "amq."):
+			problems = append(problems, fmt.Sprintf("invalid queue name %q", q.Name))
+		case queues[q.Name]:
+			problems = append(problems, fmt.Sprintf("duplicate queue %q", q.Name))
+		}
+		queues[q.Name] = true
+		if q.DeadLetterExchange != "" && !exchanges[q.DeadLetterExchange] {
+			problems = append(problems, fmt.Sprintf("queue %q with undeclared dead letter exchange %q", q.Name, q.DeadLetterExchange))
+		}
+		if q.DeadLetterExchange == "" && q.DeadLetterRoutingKey != "" && !t.hasQueue(q.DeadLetterRoutingKey) {
+			problems = append(problems, fmt.Sprintf("queue %q dead-letter to undeclared queue %q", q.Name, q.DeadLetterRoutingKey))
+		}
+	}
+
+	for _, b := range t.Bindings {
+		if !exchanges[b.Exchange] {
+			problems = append(problems, fmt.Sprintf("binding %s with undeclared exchange %q", bindingName(b), b.Exchange))
+		}
+		switch {
+		case b.DestinationExchange != "" && b.Queue != "":
+			problems = append(problems, fmt.Sprintf("binding %s with both queue and destination exchange", bindingName(b)))
+		case b.DestinationExchange != "":
+			if !exchanges[b.DestinationExchange] {
+				problems = append(problems, fmt.Sprintf("binding %s with undeclared destination exchange %q", bindingName(b), b.DestinationExchange))
+			}
+		case !queues[b.Queue]:
+			problems = append(problems, fmt.Sprintf("binding %s with undeclared queue %q", bindingName(b), b.Queue))
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func (t *Topology) hasQueue(name string) bool {
+	for _, q := range t.Queues {
+		if q.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func bindingName(b BindingSpec) string {
+	if b.DestinationExchange != "" {
+		return fmt.Sprintf("%s->%s(%s)", b.Exchange, b.DestinationExchange, b.Key)
+	}
+	return fmt.Sprintf("%s->%s(%s)", b.Exchange, b.Queue, b.Key)
+}
+
+// ChangeAction is what Apply does to an object
+type ChangeAction int
+
+const (
+	// ActionNone the object exists, Apply finds whether its arguments conflict with the spec
+	ActionNone ChangeAction = iota
+	// ActionCreate the object does not exist
+	ActionCreate
+	// ActionConflict the live object has different arguments, it is resolved by ConflictStrategy
+	ActionConflict
+	// ActionBind bindings are always bound, binding is idempotent and cannot be inspected through AMQP
+	ActionBind
+)
+
+func (a ChangeAction) String() string {
+	switch a {
+	case ActionNone:
+		return "none"
+	case ActionCreate:
+		return "create"
+	case ActionConflict:
+		return "conflict"
+	case ActionBind:
+		return "bind"
+	default:
+		return "unknown"
+	}
+}
+
+// Change is the difference between a spec and the live broker
+type Change struct {
+	Action ChangeAction
+	// Kind is exchange, queue or binding
+	Kind string
+	Name string
+	// Reason is the error of declaring with the spec when Action is ActionConflict
+	Reason error
+
+	exchange *ExchangeSpec
+	queue    *QueueSpec
+	binding  *BindingSpec
+}
+
+func (c Change) String() string {
+	if c.Reason != nil {
+		return fmt.Sprintf("%s %s %s: %v", c.Action, c.Kind, c.Name, c.Reason)
+	}
+	return fmt.Sprintf("%s %s %s", c.Action, c.Kind, c.Name)
+}
+
+// Diff compare the topology with the live broker, it never changes the broker.
+// It only declares passively, which cannot compare arguments, so existing objects are ActionNone
+// and their conflicts are found by Apply.
+func (t *Topology) Diff(conn *amqp.Connection) ([]Change, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+
+	var out []Change
+	for i := range t.Exchanges {
+		e := &t.Exchanges[i]
+		action, err := diff(conn, func(ch *amqp.Channel) error {
+			return ch.ExchangeDeclarePassive(e.Name, e.kind(), e.Durable, e.AutoDelete, e.Internal, false, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Change{Action: action, Kind: "exchange", Name: e.Name, exchange: e})
+	}
+	for i := range t.Queues {
+		q := &t.Queues[i]
+		action, err := diff(conn, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDeclarePassive(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, Change{Action: action, Kind: "queue", Name: q.Name, queue: q})
+	}
+	for i := range t.Bindings {
+		b := &t.Bindings[i]
+		out = append(out, Change{Action: ActionBind, Kind: "binding", Name: bindingName(*b), binding: b})
+	}
+	return out, nil
+}
+
+// diff tell whether an object exists by passive declare
+func diff(conn *amqp.Connection, passive func(ch *amqp.Channel) error) (ChangeAction, error) {
+	err := withChannel(conn, passive)
+	if isAMQPError(err, amqp.NotFound) {
+		return ActionCreate, nil
+	}
+	if err != nil {
+		return ActionNone, err
+	}
+	return ActionNone, nil
+}
+
+// Apply make the live broker match the topology, it is idempotent. Conflicts are resolved by strategy,
+// with ConflictFail nothing is changed if any conflict found. The applied changes are returned.
+// Existing objects are declared again with the spec before any change, a precondition failure means a conflict,
+// a declare with the same arguments changes nothing.
+func (t *Topology) Apply(conn *amqp.Connection, strategy ConflictStrategy) ([]Change, error) {
+	changes, err := t.Diff(conn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		c := &changes[i]
+		if c.Action != ActionNone {
+			continue
+		}
+		err := withChannel(conn, c.declare)
+		if isAMQPError(err, amqp.PreconditionFailed) {
+			c.Action, c.Reason = ActionConflict, err
+		} else if err != nil {
+			return changes, err
+		}
+	}
+
+	if strategy == ConflictFail {
+		var conflicts []string
+		for _, c := range changes {
+			if c.Action == ActionConflict {
+				conflicts = append(conflicts, c.String())
+			}
+		}
+		if len(conflicts) > 0 {
+			return changes, fmt.Errorf("%w: %s", ErrTopologyConflict, strings.Join(conflicts, "; "))
+		}
+	}
+
+	for _, c := range changes {
+		if err := c.apply(conn, strategy); err != nil {
+			return changes, fmt.Errorf("apply %s error: %w", c, err)
+		}
+	}
+	return changes, nil
+}
+
+func (c Change) apply(conn *amqp.Connection, strategy ConflictStrategy) error {
+	switch c.Action {
+	case ActionCreate:
+		return withChannel(conn, c.declare)
+	case ActionBind:
+		return withChannel(conn, c.binding.bind)
+	case ActionConflict:
+		return c.resolve(conn, strategy)
+	default:
+		return nil
+	}
+}
+
+func (c Change) declare(ch *amqp.Channel) error {
+	if c.exchange != nil {
+		return c.exchange.declare(ch)
+	}
+	return c.queue.declare(ch)
+}
+
+func (c Change) resolve(conn *amqp.Connection, strategy ConflictStrategy) error {
+	switch strategy {
+	case ConflictIgnore:
+		log.Warn("keep conflicted live object", zap.Stringer("change", c))
+		return nil
+	case ConflictRecreate, ConflictRecreateIfEmpty:
+		if c.exchange != nil {
+			return fmt.Errorf("%w: exchange %s cannot be recreated without dropping its bindings, resolve it manually: %v",
+				ErrTopologyConflict, c.Name, c.Reason)
+		}
+		ifEmpty := strategy == ConflictRecreateIfEmpty
+		log.Warn("recreate conflicted queue", zap.Stringer("change", c), zap.Bool("if_empty", ifEmpty))
+		err := withChannel(conn, func(ch *amqp.Channel) error {
+			_, err := ch.QueueDelete(c.Name, false, ifEmpty, false)
+			return err
+		})
+		if err != nil {
+			if isAMQPError(err, amqp.PreconditionFailed) {
+				return fmt.Errorf("%w: %s is in use, resolve it manually: %v", ErrTopologyConflict, c.Name, c.Reason)
+			}
+			return err
+		}
+		return withChannel(conn, c.declare)
+	default:
+		return fmt.Errorf("%w: %v", ErrTopologyConflict, c.Reason)
+	}
+}
+
+// withChannel run fn on a new channel, a failed declare closes the channel so each check needs its own
+func withChannel(conn *amqp.Connection, fn func(ch *amqp.Channel) error) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	return fn(ch)
+}
+
+func isAMQPError(err error, code int) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == code
+}
@@ -0,0 +1,78 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func testTopology() *Topology {
+	return &Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "test.dlx", Durable: true},
+			{Name: "test.alt", Durable: true, Kind: amqp.ExchangeFanout},
+			{Name: "test.topic", Durable: true, AlternateExchange: "test.alt"},
+		},
+		Queues: []QueueSpec{
+			{Name: "test.user", Durable: true, DeadLetterExchange: "test.dlx", DeadLetterRoutingKey: "error.user"},
+			{Name: "test.user.retry", Durable: true, DeadLetterRoutingKey: "test.user", MessageTTL: time.Second},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "test.user", Exchange: "test.topic", Key: "user.*"},
+		},
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	require.NoError(t, testTopology().Validate())
+
+	invalid := testTopology().Merge(&Topology{
+		Exchanges: []ExchangeSpec{
+			{Name: "test.topic"},
+			{Name: "amq.topic"},
+			{Name: "test.bad", Kind: "unknown", AlternateExchange: "missing.alt"},
+		},
+		Queues: []QueueSpec{
+			{Name: ""},
+			{Name: "test.dead", DeadLetterExchange: "missing.dlx"},
+			{Name: "test.retry", DeadLetterRoutingKey: "missing.queue"},
+		},
+		Bindings: []BindingSpec{
+			{Queue: "missing", Exchange: "missing", Key: "#"},
+			{DestinationExchange: "missing.dest", Exchange: "test.topic", Key: "#"},
+			{Queue: "test.user", DestinationExchange: "test.dlx", Exchange: "test.topic"},
+		},
+	})
+	err := invalid.Validate()
+	require.IsType(t, ValidationError{}, err)
+	assert.Equal(t, ValidationError{
+		`duplicate exchange "test.topic"`,
+		`invalid exchange name "amq.topic"`,
+		`exchange "test.bad" of unknown kind "unknown"`,
+		`exchange "test.bad" with undeclared alternate exchange "missing.alt"`,
+		`invalid queue name ""`,
+		`queue "test.dead" with undeclared dead letter exchange "missing.dlx"`,
+		`queue "test.retry" dead-letter to undeclared queue "missing.queue"`,
+		`binding missing->missing(#) with undeclared exchange "missing"`,
+		`binding missing->missing(#) with undeclared queue "missing"`,
+		`binding test.topic->missing.dest(#) with undeclared destination exchange "missing.dest"`,
+		`binding test.topic->test.dlx() with both queue and destination exchange`,
+	}, err)
+}
+
+func TestSpecArgs(t *testing.T) {
+	topology := testTopology()
+	assert.Equal(t, amqp.Table{"alternate-exchange": "test.alt"}, topology.Exchanges[2].args())
+	assert.Equal(t, amqp.Table{
+		"x-dead-letter-exchange":    "test.dlx",
+		"x-dead-letter-routing-key": "error.user",
+	}, topology.Queues[0].args())
+	assert.Equal(t, amqp.Table{
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": "test.user",
+		"x-message-ttl":             int32(1000),
+	}, topology.Queues[1].args())
+	assert.Equal(t, amqp.ExchangeTopic, topology.Exchanges[0].kind())
+}
@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"reflect"
+	"time"
+)
+
+const (
+	// ReplyErrorHeader carry the error message of a failed request in the reply
+	ReplyErrorHeader = "x-reply-error"
+)
+
+var (
+	ErrInvalidResponder = errors.New("invalid responder, must be func(context.Context, *Req) (*Resp, error) or func(context.Context, *Req, broker.Metadata) (*Resp, error) which *Req and *Resp implement proto.Message")
+	// ErrReplyQueueLost is returned to pending requests when the connection of the reply queue lost
+	ErrReplyQueueLost = errors.New("reply queue lost")
+)
+
+// Requester send requests to responders and wait their replies, see Broker.RegisterResponder
+type Requester interface {
+	// Request publish req to topic and decode the reply into resp, it waits until ctx done.
+	// ErrPublishMessageMiss is returned if no responder subscribed the topic, *RemoteError if the responder failed.
+	Request(ctx context.Context, topic string, req, resp proto.Message, opts ...PublishOption) error
+}
+
+// RemoteError is the error returned by a responder
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote error: " + e.Message
+}
+
+// Reply is the reply of a request, Err is the error returned by the responder
+type Reply func(ctx context.Context, meta Metadata, resp proto.Message, err error) error
+
+// NewResponder check h is one of below, which *Req and *Resp implement proto.Message,
+// and wrap it into a Handler which call reply with the result of h.
+// The handler fails only if reply fails, an error returned by h is sent to the requester.
+//
+//	func(ctx context.Context, req *Req) (*Resp, error)
+//	func(ctx context.Context, req *Req, meta broker.Metadata) (*Resp, error)
+func NewResponder(h interface{}, reply Reply) (*Handler, error) {
+	ht := reflect.TypeOf(h)
+	if ht == nil || ht.Kind() != reflect.Func {
+		return nil, ErrInvalidResponder
+	}
+	if ht.NumIn() < 2 || ht.NumIn() > 3 || ht.NumOut() != 2 {
+		return nil, ErrInvalidResponder
+	}
+	if ht.In(0) != contextType || checkIsProtoMessage(ht.In(1)) != nil {
+		return nil, ErrInvalidResponder
+	}
+	withMeta := ht.NumIn() == 3
+	if withMeta && ht.In(2) != metadataType {
+		return nil, ErrInvalidResponder
+	}
+	if checkIsProtoMessage(ht.Out(0)) != nil || checkIsError(ht.Out(1)) != nil {
+		return nil, ErrInvalidResponder
+	}
+
+	fn := reflect.ValueOf(h)
+	handlerType := reflect.FuncOf([]reflect.Type{contextType, ht.In(1), metadataType}, []reflect.Type{errorType}, false)
+	handler := reflect.MakeFunc(handlerType, func(in []reflect.Value) []reflect.Value {
+		args := in
+		if !withMeta {
+			args = in[:2]
+		}
+		out := fn.Call(args)
+
+		var (
+			resp proto.Message
+			err  error
+		)
+		if !out[0].IsNil() {
+			resp = out[0].Interface().(proto.Message)
+		}
+		if !out[1].IsNil() {
+			err = out[1].Interface().(error)
+		}
+
+		ctx := in[0].Interface().(context.Context)
+		meta := in[2].Interface().(Metadata)
+		result := reflect.Zero(errorType)
+		if replyErr := reply(ctx, meta, resp, err); replyErr != nil {
+			result = reflect.ValueOf(replyErr)
+		}
+		return []reflect.Value{result}
+	})
+
+	return NewHandler(handler.Interface())
+}
+
+// RequestExpiration return how long a request should live in queue, the time left before ctx deadline
+func RequestExpiration(ctx context.Context) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0
+	}
+	if d := time.Until(deadline); d > time.Millisecond {
+		return d
+	}
+	return time.Millisecond
+}
+
+// ReplyHeaders is the headers of the reply carrying err, nil if err is nil
+func ReplyHeaders(err error) map[string]interface{} {
+	if err == nil {
+		return nil
+	}
+	return map[string]interface{}{ReplyErrorHeader: err.Error()}
+}
+
+// ReplyError return the *RemoteError carried by the headers of a reply, nil if the request succeeded
+func ReplyError(headers map[string]interface{}) error {
+	msg, ok := headers[ReplyErrorHeader].(string)
+	if !ok {
+		return nil
+	}
+	return &RemoteError{Message: msg}
+}
+
+// ReplyCodec is the codec to reply the request meta, the reply is encoded as the request if the content type is known
+func ReplyCodec(preferred Codec, meta Metadata) Codec {
+	if c, err := CodecFor(preferred, meta.ContentType); err == nil {
+		return c
+	}
+	if preferred != nil {
+		return preferred
+	}
+	return ProtoCodec
+}
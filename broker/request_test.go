@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"testing"
+	"time"
+)
+
+type replyRecorder struct {
+	meta Metadata
+	resp proto.Message
+	err  error
+}
+
+func (r *replyRecorder) reply(ctx context.Context, meta Metadata, resp proto.Message, err error) error {
+	r.meta, r.resp, r.err = meta, resp, err
+	return nil
+}
+
+func TestNewResponder(t *testing.T) {
+	meta := Metadata{Topic: "test", CorrelationID: "1", ReplyTo: "reply"}
+	want := &testProtoMessage{}
+
+	r := &replyRecorder{}
+	h, err := NewResponder(func(ctx context.Context, req *testProtoMessage) (*testProtoMessage, error) {
+		return want, nil
+	}, r.reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Call(context.Background(), h.NewMessage(), meta); err != nil {
+		t.Error(err)
+	}
+	if r.resp != want || r.err != nil || r.meta.CorrelationID != "1" {
+		t.Errorf("unexpected reply %+v", r)
+	}
+
+	r = &replyRecorder{}
+	h, err = NewResponder(func(ctx context.Context, req *testProtoMessage, m Metadata) (*testProtoMessage, error) {
+		if m.ReplyTo != "reply" {
+			t.Error("expect metadata passed")
+		}
+		return nil, errTest
+	}, r.reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Call(context.Background(), h.NewMessage(), meta); err != nil {
+		t.Error(err)
+	}
+	if r.resp != nil || r.err != errTest {
+		t.Errorf("unexpected reply %+v", r)
+	}
+
+	// the handler fails only if reply failed
+	h, err = NewResponder(func(ctx context.Context, req *testProtoMessage) (*testProtoMessage, error) {
+		return want, nil
+	}, func(ctx context.Context, meta Metadata, resp proto.Message, err error) error {
+		return errTest
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Call(context.Background(), h.NewMessage(), meta); err != errTest {
+		t.Errorf("expect %v but %v", errTest, err)
+	}
+
+	invalids := []interface{}{
+		nil,
+		func(ctx context.Context, req *testProtoMessage) error { return nil },
+		func(req *testProtoMessage) (*testProtoMessage, error) { return nil, nil },
+		func(ctx context.Context, req *testProtoMessage) (testProtoMessage, error) {
+			return testProtoMessage{}, nil
+		},
+		func(ctx context.Context, req *testProtoMessage, m *Metadata) (*testProtoMessage, error) {
+			return nil, nil
+		},
+	}
+	for _, invalid := range invalids {
+		if _, err := NewResponder(invalid, r.reply); err != ErrInvalidResponder {
+			t.Errorf("expect %v but %v", ErrInvalidResponder, err)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	if err := ReplyError(ReplyHeaders(nil)); err != nil {
+		t.Errorf("expect nil but %v", err)
+	}
+
+	err := ReplyError(ReplyHeaders(errTest))
+	var remote *RemoteError
+	if !errors.As(err, &remote) || remote.Message != errTest.Error() {
+		t.Errorf("expect remote error %q but %v", errTest, err)
+	}
+}
+
+func TestRequestExpiration(t *testing.T) {
+	if d := RequestExpiration(context.Background()); d != 0 {
+		t.Errorf("expect 0 but %v", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if d := RequestExpiration(ctx); d <= 0 || d > time.Minute {
+		t.Errorf("unexpected expiration %v", d)
+	}
+}
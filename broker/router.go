@@ -0,0 +1,135 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrNoRoute = errors.New("no route matches the topic")
+)
+
+// FallbackPattern is bound by a router subscription with fallback, it matches every topic
+const FallbackPattern = "#"
+
+// Fallback set the handler of a router for messages matching no route, the subscription binds FallbackPattern
+// as well so it receives the messages of every topic published to the broker. Without it such messages are not
+// received, unless bound by a previous subscription of the queue, and fail with ErrNoRoute.
+// The fallback is not checked against the schemas, see SchemaRegistry.CheckRouter.
+func Fallback(handler interface{}) Option {
+	return func(opts *Options) {
+		opts.Fallback = handler
+	}
+}
+
+type route struct {
+	pattern string
+	handler *Handler
+}
+
+// Router dispatch messages of a subscription to handlers by topic
+type Router struct {
+	routes   []route
+	fallback *Handler
+}
+
+// NewRouter create a router from topic patterns to handlers, fallback is optional.
+// If several patterns match a topic, the most specific one wins: fewer wildcards, then more words, then lexical order.
+func NewRouter(routes map[string]interface{}, fallback interface{}) (*Router, error) {
+	out := &Router{}
+	for pattern, h := range routes {
+		handler, err := NewHandler(h)
+		if err != nil {
+			return nil, err
+		}
+		out.routes = append(out.routes, route{pattern: pattern, handler: handler})
+	}
+	sort.Slice(out.routes, func(i, j int) bool {
+		return moreSpecific(out.routes[i].pattern, out.routes[j].pattern)
+	})
+
+	if fallback != nil {
+		handler, err := NewHandler(fallback)
+		if err != nil {
+			return nil, err
+		}
+		out.fallback = handler
+	}
+	return out, nil
+}
+
+// SingleRouter route all messages to h
+func SingleRouter(h *Handler) *Router {
+	return &Router{routes: []route{{pattern: FallbackPattern, handler: h}}}
+}
+
+// Patterns return the patterns of routes, most specific first
+func (r *Router) Patterns() []string {
+	out := make([]string, len(r.routes))
+	for i, rt := range r.routes {
+		out[i] = rt.pattern
+	}
+	return out
+}
+
+// Bindings return the patterns a subscription of the router binds, the patterns and FallbackPattern with fallback
+func (r *Router) Bindings() []string {
+	out := r.Patterns()
+	if r.fallback == nil {
+		return out
+	}
+	for _, pattern := range out {
+		if pattern == FallbackPattern {
+			return out
+		}
+	}
+	return append(out, FallbackPattern)
+}
+
+// Route return the handler of topic, ErrNoRoute if no route matches and no fallback
+func (r *Router) Route(topic string) (*Handler, error) {
+	if h := r.match(topic); h != nil {
+		return h, nil
+	}
+	if r.fallback != nil {
+		return r.fallback, nil
+	}
+	return nil, ErrNoRoute
+}
+
+// match return the handler of the route matching topic, nil if none
+func (r *Router) match(topic string) *Handler {
+	for _, rt := range r.routes {
+		if MatchTopic(rt.pattern, topic) {
+			return rt.handler
+		}
+	}
+	return nil
+}
+
+func moreSpecific(a, b string) bool {
+	aw, bw := wildcards(a), wildcards(b)
+	if aw != bw {
+		return aw < bw
+	}
+	an, bn := strings.Count(a, "."), strings.Count(b, ".")
+	if an != bn {
+		return an > bn
+	}
+	return a < b
+}
+
+// wildcards weight # more than *, # matches any number of words
+func wildcards(pattern string) int {
+	out := 0
+	for _, w := range strings.Split(pattern, ".") {
+		switch w {
+		case "*":
+			out++
+		case "#":
+			out += 2
+		}
+	}
+	return out
+}
@@ -0,0 +1,65 @@
+package broker
+
+import (
+	"context"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var called string
+	handler := func(name string) func(*wrappers.StringValue) error {
+		return func(*wrappers.StringValue) error {
+			called = name
+			return nil
+		}
+	}
+
+	r, err := NewRouter(map[string]interface{}{
+		"#":            handler("all"),
+		"user.*":       handler("user"),
+		"user.created": handler("created"),
+		"user.#":       handler("user-all"),
+		"*.deleted":    handler("deleted"),
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"user.created", "*.deleted", "user.*", "user.#", "#"}, r.Patterns())
+
+	for topic, expect := range map[string]string{
+		"user.created":    "created",
+		"user.updated":    "user",
+		"user.deleted":    "deleted",
+		"user.profile.up": "user-all",
+		"order.paid":      "all",
+	} {
+		fn, err := r.Route(topic)
+		require.NoError(t, err)
+		require.NoError(t, fn.Call(context.Background(), &wrappers.StringValue{}, Metadata{}))
+		assert.Equal(t, expect, called, topic)
+	}
+}
+
+func TestRouterFallback(t *testing.T) {
+	r, err := NewRouter(map[string]interface{}{
+		"user.*": func(*wrappers.StringValue) error { return nil },
+	}, nil)
+	require.NoError(t, err)
+	_, err = r.Route("order.paid")
+	assert.Equal(t, ErrNoRoute, err)
+
+	r, err = NewRouter(map[string]interface{}{
+		"user.*": func(*wrappers.StringValue) error { return nil },
+	}, func(*wrappers.Int64Value) error { return nil })
+	require.NoError(t, err)
+	fn, err := r.Route("order.paid")
+	require.NoError(t, err)
+	assert.IsType(t, &wrappers.Int64Value{}, fn.NewMessage())
+	assert.Equal(t, []string{"user.*", FallbackPattern}, r.Bindings())
+
+	_, err = NewRouter(map[string]interface{}{"user.*": "not a handler"}, nil)
+	assert.Equal(t, ErrInvalidHandler, err)
+	_, err = NewRouter(nil, "not a handler")
+	assert.Equal(t, ErrInvalidHandler, err)
+}
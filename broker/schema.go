@@ -0,0 +1,284 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrSchemaMismatch     = errors.New("message type mismatch the schema of topic")
+	ErrIncompatibleSchema = errors.New("incompatible schema")
+)
+
+// Schemas enforce the schemas of registry on a publisher or subscription, see SchemaRegistry
+func Schemas(registry *SchemaRegistry) Option {
+	return func(opts *Options) {
+		opts.Schemas = registry
+	}
+}
+
+// Schema is a version of the contract of a topic, messages of the topic are of the proto message Descriptor
+type Schema struct {
+	Topic      string
+	Version    int
+	Descriptor protoreflect.MessageDescriptor
+}
+
+// Name return the full name of the proto message, it is the type of messages carried with them, see Metadata.Type
+func (s *Schema) Name() string {
+	return string(s.Descriptor.FullName())
+}
+
+// SchemaRegistry map topics to versions of their proto messages. The versions of a topic keep the message full name,
+// and each version must be wire compatible with the one before it, see CheckCompatible.
+// Publishers reject messages of another type, and subscriptions reject handlers of another type on registering and
+// deliveries typed otherwise on consuming. A nil registry check nothing, topics not registered are unchecked as well.
+type SchemaRegistry struct {
+	m sync.RWMutex
+	// topics hold the versions of each topic in ascending order
+	topics map[string][]*Schema
+}
+
+func NewSchemaRegistry() *SchemaRegistry {
+	return &SchemaRegistry{
+		topics: map[string][]*Schema{},
+	}
+}
+
+// Register add version of the schema of topic, msg is the generated message of the version
+func (r *SchemaRegistry) Register(topic string, version int, msg proto.Message) error {
+	return r.RegisterDescriptor(topic, version, proto.MessageReflect(msg).Descriptor())
+}
+
+// RegisterDescriptor add version of the schema of topic, e.g. a descriptor of an older release built by protodesc.
+// Registering a version again with the same message is a no-op.
+func (r *SchemaRegistry) RegisterDescriptor(topic string, version int, desc protoreflect.MessageDescriptor) error {
+	if version < 1 {
+		return fmt.Errorf("invalid schema version %d of topic %s", version, topic)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	versions := r.topics[topic]
+	i := sort.Search(len(versions), func(i int) bool {
+		return versions[i].Version >= version
+	})
+	if i < len(versions) && versions[i].Version == version {
+		if versions[i].Descriptor.FullName() == desc.FullName() {
+			return nil
+		}
+		return fmt.Errorf("%w: version %d of topic %s is %s already", ErrIncompatibleSchema, version, topic,
+			versions[i].Descriptor.FullName())
+	}
+
+	if i > 0 {
+		if err := checkVersion(topic, versions[i-1].Descriptor, desc); err != nil {
+			return err
+		}
+	}
+	if i < len(versions) {
+		if err := checkVersion(topic, desc, versions[i].Descriptor); err != nil {
+			return err
+		}
+	}
+
+	schema := &Schema{
+		Topic:      topic,
+		Version:    version,
+		Descriptor: desc,
+	}
+	versions = append(versions, nil)
+	copy(versions[i+1:], versions[i:])
+	versions[i] = schema
+	r.topics[topic] = versions
+	return nil
+}
+
+func checkVersion(topic string, old, new protoreflect.MessageDescriptor) error {
+	if old.FullName() != new.FullName() {
+		return fmt.Errorf("%w: message of topic %s renamed from %s to %s", ErrIncompatibleSchema, topic,
+			old.FullName(), new.FullName())
+	}
+	if err := CheckCompatible(old, new); err != nil {
+		return fmt.Errorf("topic %s: %w", topic, err)
+	}
+	return nil
+}
+
+// Lookup return the latest version of the schema of topic
+func (r *SchemaRegistry) Lookup(topic string) (*Schema, bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	versions := r.topics[topic]
+	if len(versions) == 0 {
+		return nil, false
+	}
+	return versions[len(versions)-1], true
+}
+
+// Versions return the schemas of topic in ascending order of version
+func (r *SchemaRegistry) Versions(topic string) []*Schema {
+	if r == nil {
+		return nil
+	}
+	r.m.RLock()
+	defer r.m.RUnlock()
+	return append([]*Schema(nil), r.topics[topic]...)
+}
+
+// CheckPublish check msg against the schema of topic, and stamp its type onto options. The schema version is stamped
+// as v<version> into SchemaVersionHeader unless set already, e.g. by SchemaVersion.
+func (r *SchemaRegistry) CheckPublish(topic string, msg proto.Message, options *PublishOptions) error {
+	options.Type = proto.MessageName(msg)
+	schema, ok := r.Lookup(topic)
+	if !ok {
+		return nil
+	}
+	if options.Type != schema.Name() {
+		return fmt.Errorf("%w: %s is not %s of topic %s", ErrSchemaMismatch, options.Type, schema.Name(), topic)
+	}
+	if _, ok := options.Headers[SchemaVersionHeader]; !ok {
+		Header(SchemaVersionHeader, fmt.Sprintf("v%d", schema.Version))(options)
+	}
+	return nil
+}
+
+// CheckRouter check the handlers of router against the schemas of the registered topics matching patterns,
+// the subscription would receive messages of these topics. The fallback is not checked, it receives any topic.
+func (r *SchemaRegistry) CheckRouter(patterns []string, router *Router) error {
+	if r == nil {
+		return nil
+	}
+	r.m.RLock()
+	var schemas []*Schema
+	for topic, versions := range r.topics {
+		for _, pattern := range patterns {
+			if MatchTopic(pattern, topic) {
+				schemas = append(schemas, versions[len(versions)-1])
+				break
+			}
+		}
+	}
+	r.m.RUnlock()
+
+	for _, schema := range schemas {
+		h := router.match(schema.Topic)
+		if h == nil {
+			continue
+		}
+		desc := proto.MessageReflect(h.NewMessage()).Descriptor()
+		if desc.FullName() != schema.Descriptor.FullName() {
+			return fmt.Errorf("%w: handler of %s for topic %s of %s", ErrSchemaMismatch, desc.FullName(),
+				schema.Topic, schema.Name())
+		}
+		// the handler may be built from another release than the registered version
+		if err := CheckCompatible(schema.Descriptor, desc); err != nil {
+			return fmt.Errorf("handler of topic %s: %w", schema.Topic, err)
+		}
+	}
+	return nil
+}
+
+// CheckType check the type of a delivery is the message of its handler h, deliveries without type are accepted
+func (r *SchemaRegistry) CheckType(meta Metadata, h *Handler) error {
+	if r == nil || meta.Type == "" {
+		return nil
+	}
+	if name := proto.MessageName(h.NewMessage()); meta.Type != name {
+		return fmt.Errorf("%w: %s delivered to handler of %s", ErrSchemaMismatch, meta.Type, name)
+	}
+	return nil
+}
+
+// CheckCompatible check messages of new and old can be decoded by each other: fields of the same number keep
+// wire compatible kinds and cardinality, and no required field is added. Removing a field is compatible,
+// as long as its number is not reused by another kind.
+func CheckCompatible(old, new protoreflect.MessageDescriptor) error {
+	if err := checkCompatible(old, new, map[[2]protoreflect.FullName]bool{}); err != nil {
+		return fmt.Errorf("%w: %v", ErrIncompatibleSchema, err)
+	}
+	return nil
+}
+
+func checkCompatible(old, new protoreflect.MessageDescriptor, visited map[[2]protoreflect.FullName]bool) error {
+	pair := [2]protoreflect.FullName{old.FullName(), new.FullName()}
+	if visited[pair] {
+		return nil
+	}
+	visited[pair] = true
+
+	oldFields, newFields := old.Fields(), new.Fields()
+	for i := 0; i < oldFields.Len(); i++ {
+		of := oldFields.Get(i)
+		nf := newFields.ByNumber(of.Number())
+		if nf == nil {
+			continue
+		}
+		if err := checkField(of, nf, visited); err != nil {
+			return fmt.Errorf("%s field %d %v", old.FullName(), of.Number(), err)
+		}
+	}
+	for i := 0; i < newFields.Len(); i++ {
+		nf := newFields.Get(i)
+		if nf.Cardinality() == protoreflect.Required && oldFields.ByNumber(nf.Number()) == nil {
+			return fmt.Errorf("%s field %d added as required", new.FullName(), nf.Number())
+		}
+	}
+	return nil
+}
+
+func checkField(old, new protoreflect.FieldDescriptor, visited map[[2]protoreflect.FullName]bool) error {
+	if old.IsMap() != new.IsMap() || old.IsList() != new.IsList() {
+		return fmt.Errorf("changed from %s to %s", cardinalityOf(old), cardinalityOf(new))
+	}
+	if new.Cardinality() == protoreflect.Required && old.Cardinality() != protoreflect.Required {
+		return fmt.Errorf("changed to required")
+	}
+	if wireKindOf(old.Kind()) != wireKindOf(new.Kind()) {
+		return fmt.Errorf("changed from %s to %s", old.Kind(), new.Kind())
+	}
+	if old.Message() != nil && new.Message() != nil {
+		if err := checkCompatible(old.Message(), new.Message(), visited); err != nil {
+			return fmt.Errorf("of %v", err)
+		}
+	}
+	return nil
+}
+
+func cardinalityOf(field protoreflect.FieldDescriptor) string {
+	switch {
+	case field.IsMap():
+		return "map"
+	case field.IsList():
+		return "repeated"
+	default:
+		return "singular"
+	}
+}
+
+// wireKindOf group kinds whose encodings are interchangeable on the wire
+func wireKindOf(kind protoreflect.Kind) protoreflect.Kind {
+	switch kind {
+	case protoreflect.Int32Kind, protoreflect.Int64Kind, protoreflect.Uint32Kind, protoreflect.Uint64Kind,
+		protoreflect.BoolKind, protoreflect.EnumKind:
+		return protoreflect.Int64Kind
+	case protoreflect.Sint32Kind, protoreflect.Sint64Kind:
+		return protoreflect.Sint64Kind
+	case protoreflect.Fixed32Kind, protoreflect.Sfixed32Kind:
+		return protoreflect.Fixed32Kind
+	case protoreflect.Fixed64Kind, protoreflect.Sfixed64Kind:
+		return protoreflect.Fixed64Kind
+	case protoreflect.StringKind, protoreflect.BytesKind:
+		return protoreflect.BytesKind
+	default:
+		return kind
+	}
+}
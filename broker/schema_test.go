@@ -0,0 +1,187 @@
+package broker
+
+import (
+	"errors"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"testing"
+)
+
+type testField struct {
+	name     string
+	number   int32
+	kind     descriptorpb.FieldDescriptorProto_Type
+	label    descriptorpb.FieldDescriptorProto_Label
+	typeName string
+}
+
+// newTestDescriptor build message test.User with fields, and message test.Address of a single string field
+func newTestDescriptor(t *testing.T, syntax string, fields ...testField) protoreflect.MessageDescriptor {
+	user := &descriptorpb.DescriptorProto{Name: proto.String("User")}
+	for _, f := range fields {
+		label := f.label
+		if label == 0 {
+			label = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		}
+		field := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(f.name),
+			Number: proto.Int32(f.number),
+			Type:   f.kind.Enum(),
+			Label:  label.Enum(),
+		}
+		if f.typeName != "" {
+			field.TypeName = proto.String(f.typeName)
+		}
+		user.Field = append(user.Field, field)
+	}
+	address := &descriptorpb.DescriptorProto{
+		Name: proto.String("Address"),
+		Field: []*descriptorpb.FieldDescriptorProto{{
+			Name:   proto.String("city"),
+			Number: proto.Int32(1),
+			Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}},
+	}
+
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String("test/user.proto"),
+		Package:     proto.String("test"),
+		Syntax:      proto.String(syntax),
+		MessageType: []*descriptorpb.DescriptorProto{user, address},
+	}, nil)
+	require.NoError(t, err)
+	return file.Messages().ByName("User")
+}
+
+var (
+	nameField    = testField{name: "name", number: 1, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING}
+	ageField     = testField{name: "age", number: 2, kind: descriptorpb.FieldDescriptorProto_TYPE_INT64}
+	addressField = testField{name: "address", number: 3, kind: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, typeName: ".test.Address"}
+)
+
+func TestCheckCompatible(t *testing.T) {
+	v1 := newTestDescriptor(t, "proto3", nameField, ageField, addressField)
+	for name, c := range map[string]struct {
+		fields     []testField
+		syntax     string
+		compatible bool
+	}{
+		"field added": {
+			fields:     []testField{nameField, ageField, addressField, {name: "email", number: 4, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING}},
+			compatible: true,
+		},
+		"field removed": {
+			fields:     []testField{nameField, addressField},
+			compatible: true,
+		},
+		"field renamed": {
+			fields:     []testField{{name: "full_name", number: 1, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING}, ageField, addressField},
+			compatible: true,
+		},
+		"string to bytes": {
+			fields:     []testField{{name: "name", number: 1, kind: descriptorpb.FieldDescriptorProto_TYPE_BYTES}, ageField, addressField},
+			compatible: true,
+		},
+		"int64 to int32": {
+			fields:     []testField{nameField, {name: "age", number: 2, kind: descriptorpb.FieldDescriptorProto_TYPE_INT32}, addressField},
+			compatible: true,
+		},
+		"number reused by another kind": {
+			fields: []testField{nameField, {name: "age", number: 2, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING}, addressField},
+		},
+		"singular to repeated": {
+			fields: []testField{{name: "name", number: 1, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING, label: descriptorpb.FieldDescriptorProto_LABEL_REPEATED}, ageField, addressField},
+		},
+		"message field of a wire compatible message": {
+			fields:     []testField{nameField, ageField, {name: "address", number: 3, kind: descriptorpb.FieldDescriptorProto_TYPE_MESSAGE, typeName: ".test.User"}},
+			compatible: true,
+		},
+		"message to scalar": {
+			fields: []testField{nameField, ageField, {name: "address", number: 3, kind: descriptorpb.FieldDescriptorProto_TYPE_INT64}},
+		},
+		"required added": {
+			fields: []testField{nameField, ageField, addressField, {name: "email", number: 4, kind: descriptorpb.FieldDescriptorProto_TYPE_STRING, label: descriptorpb.FieldDescriptorProto_LABEL_REQUIRED}},
+			syntax: "proto2",
+		},
+	} {
+		syntax := c.syntax
+		if syntax == "" {
+			syntax = "proto3"
+		}
+		err := CheckCompatible(v1, newTestDescriptor(t, syntax, c.fields...))
+		if c.compatible {
+			assert.NoError(t, err, name)
+		} else {
+			assert.True(t, errors.Is(err, ErrIncompatibleSchema), "%s: %v", name, err)
+		}
+	}
+}
+
+func TestSchemaRegistryVersions(t *testing.T) {
+	r := NewSchemaRegistry()
+	v1 := newTestDescriptor(t, "proto3", nameField)
+	v2 := newTestDescriptor(t, "proto3", nameField, ageField)
+
+	require.NoError(t, r.RegisterDescriptor("user.created", 2, v2))
+	// versions may be registered out of order, each one is checked against its neighbours
+	require.NoError(t, r.RegisterDescriptor("user.created", 1, v1))
+	require.NoError(t, r.RegisterDescriptor("user.created", 1, v1))
+
+	bad := newTestDescriptor(t, "proto3", testField{name: "name", number: 1, kind: descriptorpb.FieldDescriptorProto_TYPE_INT64})
+	assert.True(t, errors.Is(r.RegisterDescriptor("user.created", 3, bad), ErrIncompatibleSchema))
+	renamed := proto.MessageReflect(&wrappers.StringValue{}).Descriptor()
+	assert.True(t, errors.Is(r.RegisterDescriptor("user.created", 3, renamed), ErrIncompatibleSchema))
+	assert.True(t, errors.Is(r.RegisterDescriptor("user.created", 2, renamed), ErrIncompatibleSchema))
+	assert.Error(t, r.RegisterDescriptor("user.created", 0, v1))
+
+	schema, ok := r.Lookup("user.created")
+	require.True(t, ok)
+	assert.Equal(t, 2, schema.Version)
+	assert.Equal(t, "test.User", schema.Name())
+	versions := r.Versions("user.created")
+	require.Len(t, versions, 2)
+	assert.Equal(t, 1, versions[0].Version)
+	_, ok = r.Lookup("user.deleted")
+	assert.False(t, ok)
+}
+
+func TestSchemaRegistryCheck(t *testing.T) {
+	r := NewSchemaRegistry()
+	require.NoError(t, r.Register("user.created", 1, &wrappers.StringValue{}))
+
+	options := NewPublishOptions(false)
+	require.NoError(t, r.CheckPublish("user.created", &wrappers.StringValue{}, options))
+	assert.Equal(t, "google.protobuf.StringValue", options.Type)
+	assert.Equal(t, "v1", options.Headers[SchemaVersionHeader])
+
+	options = NewPublishOptions(false)
+	assert.True(t, errors.Is(r.CheckPublish("user.created", &wrappers.Int64Value{}, options), ErrSchemaMismatch))
+	// unregistered topics are unchecked, the type is stamped still
+	require.NoError(t, r.CheckPublish("user.deleted", &wrappers.Int64Value{}, options))
+	assert.Equal(t, "google.protobuf.Int64Value", options.Type)
+
+	stringHandler, err := NewHandler(func(msg *wrappers.StringValue) error { return nil })
+	require.NoError(t, err)
+	int64Handler, err := NewHandler(func(msg *wrappers.Int64Value) error { return nil })
+	require.NoError(t, err)
+	assert.NoError(t, r.CheckRouter([]string{"user.created"}, SingleRouter(stringHandler)))
+	assert.True(t, errors.Is(r.CheckRouter([]string{"user.*"}, SingleRouter(int64Handler)), ErrSchemaMismatch))
+	assert.NoError(t, r.CheckRouter([]string{"order.*"}, SingleRouter(int64Handler)))
+
+	assert.NoError(t, r.CheckType(Metadata{Type: "google.protobuf.StringValue"}, stringHandler))
+	assert.NoError(t, r.CheckType(Metadata{}, stringHandler))
+	assert.True(t, errors.Is(r.CheckType(Metadata{Type: "google.protobuf.StringValue"}, int64Handler), ErrSchemaMismatch))
+
+	var none *SchemaRegistry
+	options = NewPublishOptions(false)
+	assert.NoError(t, none.CheckPublish("user.created", &wrappers.Int64Value{}, options))
+	assert.Equal(t, "google.protobuf.Int64Value", options.Type)
+	assert.NoError(t, none.CheckRouter([]string{"#"}, SingleRouter(int64Handler)))
+	assert.NoError(t, none.CheckType(Metadata{Type: "other"}, int64Handler))
+}
@@ -0,0 +1,430 @@
+// Package spill provides a bounded disk-backed FIFO of records, e.g. to hold publishings while the broker is down.
+// Records are appended to segment files and removed once acknowledged, the read position survives restarts.
+package spill
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrFull      = errors.New("spill log is full")
+	ErrEmpty     = errors.New("spill log is empty")
+	ErrClosed    = errors.New("spill log closed")
+	ErrCorrupted = errors.New("spill record corrupted")
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	// headerSize is the length and crc32 of a record
+	headerSize = 8
+)
+
+type Options struct {
+	// SegmentSize is the size a segment rolled at, default 16MiB
+	SegmentSize int64
+	// MaxSize bound the bytes of unacknowledged records including their headers, default 1GiB
+	MaxSize int64
+	// Sync fsync segments after each append and the cursor after each ack
+	Sync bool
+}
+
+type Option func(opts *Options)
+
+func WithSegmentSize(size int64) Option {
+	return func(opts *Options) {
+		opts.SegmentSize = size
+	}
+}
+
+func WithMaxSize(size int64) Option {
+	return func(opts *Options) {
+		opts.MaxSize = size
+	}
+}
+
+// WithSync make records durable on power loss at the cost of throughput, they survive process crash without it
+func WithSync() Option {
+	return func(opts *Options) {
+		opts.Sync = true
+	}
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+	file *os.File
+}
+
+// Log is a bounded FIFO of records stored in segment files of a directory, it is safe for concurrent use
+type Log struct {
+	dir     string
+	options *Options
+
+	m        sync.Mutex
+	closed   bool
+	segments []*segment
+	cursor   *os.File
+	// offset is the read position in the oldest segment
+	offset int64
+	size   int64
+	count  int
+}
+
+// Open the log in dir, created if not exist. A torn record at the tail, e.g. by a crash during append, is truncated.
+func Open(dir string, opts ...Option) (*Log, error) {
+	options := &Options{
+		SegmentSize: 16 << 20,
+		MaxSize:     1 << 30,
+	}
+	for _, o := range opts {
+		o(options)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	out := &Log{
+		dir:     dir,
+		options: options,
+	}
+	if err := out.load(); err != nil {
+		out.closeFiles()
+		return nil, err
+	}
+	return out, nil
+}
+
+func (l *Log) load() error {
+	seqs, err := l.listSegments()
+	if err != nil {
+		return err
+	}
+
+	if l.cursor, err = os.OpenFile(filepath.Join(l.dir, cursorFile), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	cursorSeq, offset, err := l.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range seqs {
+		if seq < cursorSeq {
+			// fully acknowledged, the removal was interrupted
+			if err := os.Remove(l.segmentPath(seq)); err != nil {
+				return err
+			}
+			continue
+		}
+		file, err := os.OpenFile(l.segmentPath(seq), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		s := &segment{seq: seq, file: file}
+		l.segments = append(l.segments, s)
+
+		start := int64(0)
+		if seq == cursorSeq {
+			start = offset
+			l.offset = offset
+		}
+		if err := l.scan(s, start); err != nil {
+			return err
+		}
+	}
+
+	if len(l.segments) == 0 {
+		return l.roll()
+	}
+	return nil
+}
+
+// scan count the records of s after start, and truncate s at the first invalid one
+func (l *Log) scan(s *segment, start int64) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	pos := int64(0)
+	for pos < info.Size() {
+		n, err := recordSize(s.file, pos, info.Size())
+		if err != nil {
+			log.Warn("truncate torn spill record", zap.Uint64("segment", s.seq), zap.Int64("offset", pos))
+			if err := s.file.Truncate(pos); err != nil {
+				return err
+			}
+			break
+		}
+		if pos >= start {
+			l.count++
+			l.size += n
+		}
+		pos += n
+	}
+	s.size = pos
+	return nil
+}
+
+// recordSize validate the record at pos and return its size including the header
+func recordSize(file *os.File, pos, limit int64) (int64, error) {
+	var header [headerSize]byte
+	if _, err := file.ReadAt(header[:], pos); err != nil {
+		return 0, ErrCorrupted
+	}
+	n := int64(binary.BigEndian.Uint32(header[:4]))
+	if pos+headerSize+n > limit {
+		return 0, ErrCorrupted
+	}
+	data := make([]byte, n)
+	if _, err := file.ReadAt(data, pos+headerSize); err != nil {
+		return 0, ErrCorrupted
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, ErrCorrupted
+	}
+	return headerSize + n, nil
+}
+
+func (l *Log) listSegments() ([]uint64, error) {
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var out []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		out = append(out, seq)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i] < out[j]
+	})
+	return out, nil
+}
+
+func (l *Log) segmentPath(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func (l *Log) readCursor() (uint64, int64, error) {
+	var data [16]byte
+	if _, err := l.cursor.ReadAt(data[:], 0); err != nil {
+		if err == io.EOF {
+			return 0, 0, nil
+		}
+		return 0, 0, err
+	}
+	return binary.BigEndian.Uint64(data[:8]), int64(binary.BigEndian.Uint64(data[8:])), nil
+}
+
+func (l *Log) writeCursor() error {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], l.segments[0].seq)
+	binary.BigEndian.PutUint64(data[8:], uint64(l.offset))
+	if _, err := l.cursor.WriteAt(data[:], 0); err != nil {
+		return err
+	}
+	if l.options.Sync {
+		return l.cursor.Sync()
+	}
+	return nil
+}
+
+// roll start a new active segment
+func (l *Log) roll() error {
+	seq := uint64(1)
+	if n := len(l.segments); n > 0 {
+		seq = l.segments[n-1].seq + 1
+	}
+	file, err := os.OpenFile(l.segmentPath(seq), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, &segment{seq: seq, file: file})
+	if len(l.segments) == 1 {
+		l.offset = 0
+		return l.writeCursor()
+	}
+	return nil
+}
+
+// Append add data at the tail, ErrFull if it would exceed MaxSize
+func (l *Log) Append(data []byte) error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+
+	n := int64(headerSize + len(data))
+	if l.size+n > l.options.MaxSize {
+		return ErrFull
+	}
+	active := l.segments[len(l.segments)-1]
+	if active.size > 0 && active.size+n > l.options.SegmentSize {
+		if err := l.roll(); err != nil {
+			return err
+		}
+		active = l.segments[len(l.segments)-1]
+	}
+
+	record := make([]byte, n)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:headerSize], crc32.ChecksumIEEE(data))
+	copy(record[headerSize:], data)
+	if _, err := active.file.WriteAt(record, active.size); err != nil {
+		// a partial record is overwritten by the next append, or truncated on open
+		return err
+	}
+	if l.options.Sync {
+		if err := active.file.Sync(); err != nil {
+			return err
+		}
+	}
+
+	active.size += n
+	l.size += n
+	l.count++
+	return nil
+}
+
+// Peek return the record at the head without removing it, ErrEmpty if none
+func (l *Log) Peek() ([]byte, error) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return nil, ErrClosed
+	}
+	if l.count == 0 {
+		return nil, ErrEmpty
+	}
+
+	head := l.head()
+	if _, err := recordSize(head.file, l.offset, head.size); err != nil {
+		return nil, err
+	}
+	var header [headerSize]byte
+	if _, err := head.file.ReadAt(header[:], l.offset); err != nil {
+		return nil, err
+	}
+	out := make([]byte, binary.BigEndian.Uint32(header[:4]))
+	if _, err := head.file.ReadAt(out, l.offset+headerSize); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// head return the segment of the head record, segments fully read are removed
+func (l *Log) head() *segment {
+	for l.offset >= l.segments[0].size && len(l.segments) > 1 {
+		l.removeHead()
+	}
+	return l.segments[0]
+}
+
+func (l *Log) removeHead() {
+	head := l.segments[0]
+	l.segments = l.segments[1:]
+	l.offset = 0
+	if err := head.file.Close(); err != nil {
+		log.Error("close spill segment error", zap.Error(err), zap.Uint64("segment", head.seq))
+	}
+	if err := os.Remove(l.segmentPath(head.seq)); err != nil {
+		log.Error("remove spill segment error", zap.Error(err), zap.Uint64("segment", head.seq))
+	}
+}
+
+// Ack remove the record at the head, the next Peek return the record after it
+func (l *Log) Ack() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	if l.count == 0 {
+		return ErrEmpty
+	}
+
+	head := l.head()
+	n, err := recordSize(head.file, l.offset, head.size)
+	if err != nil {
+		return err
+	}
+	l.offset += n
+	l.size -= n
+	l.count--
+
+	if l.count == 0 {
+		// reclaim the disk space once drained
+		for len(l.segments) > 1 {
+			l.removeHead()
+		}
+		if err := l.segments[0].file.Truncate(0); err != nil {
+			return err
+		}
+		l.segments[0].size = 0
+		l.offset = 0
+	} else if l.offset >= head.size && len(l.segments) > 1 {
+		l.removeHead()
+	}
+	return l.writeCursor()
+}
+
+// Len return the number of records
+func (l *Log) Len() int {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.count
+}
+
+// Size return the bytes of records including their headers
+func (l *Log) Size() int64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.size
+}
+
+func (l *Log) Close() error {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		return ErrClosed
+	}
+	l.closed = true
+	return l.closeFiles()
+}
+
+func (l *Log) closeFiles() error {
+	var result error
+	for _, s := range l.segments {
+		if err := s.file.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	if l.cursor != nil {
+		if err := l.cursor.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,125 @@
+package spill
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spill")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func drain(t *testing.T, l *Log) []string {
+	var out []string
+	for {
+		data, err := l.Peek()
+		if err == ErrEmpty {
+			return out
+		}
+		require.NoError(t, err)
+		out = append(out, string(data))
+		require.NoError(t, l.Ack())
+	}
+}
+
+func TestLogOrder(t *testing.T) {
+	l, err := Open(tempDir(t), WithSegmentSize(32))
+	require.NoError(t, err)
+	defer l.Close()
+
+	var expected []string
+	for i := 0; i < 10; i++ {
+		expected = append(expected, fmt.Sprintf("record-%d", i))
+		require.NoError(t, l.Append([]byte(expected[i])))
+	}
+	assert.Equal(t, 10, l.Len())
+	assert.Equal(t, int64(10*(headerSize+8)), l.Size())
+
+	// peek without ack return the same record
+	data, err := l.Peek()
+	require.NoError(t, err)
+	assert.Equal(t, "record-0", string(data))
+
+	assert.Equal(t, expected, drain(t, l))
+	assert.Equal(t, 0, l.Len())
+	assert.Equal(t, int64(0), l.Size())
+	assert.Equal(t, ErrEmpty, l.Ack())
+
+	segments, err := l.listSegments()
+	require.NoError(t, err)
+	assert.Len(t, segments, 1, "drained segments are removed")
+}
+
+func TestLogFull(t *testing.T) {
+	l, err := Open(tempDir(t), WithMaxSize(2*(headerSize+1)))
+	require.NoError(t, err)
+	defer l.Close()
+
+	require.NoError(t, l.Append([]byte("a")))
+	require.NoError(t, l.Append([]byte("b")))
+	assert.Equal(t, ErrFull, l.Append([]byte("c")))
+
+	_, err = l.Peek()
+	require.NoError(t, err)
+	require.NoError(t, l.Ack())
+	assert.NoError(t, l.Append([]byte("c")))
+	assert.Equal(t, []string{"b", "c"}, drain(t, l))
+}
+
+func TestLogReopen(t *testing.T) {
+	dir := tempDir(t)
+	l, err := Open(dir, WithSegmentSize(20), WithSync())
+	require.NoError(t, err)
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		require.NoError(t, l.Append([]byte(s)))
+	}
+	for i := 0; i < 3; i++ {
+		_, err := l.Peek()
+		require.NoError(t, err)
+		require.NoError(t, l.Ack())
+	}
+	require.NoError(t, l.Close())
+	assert.Equal(t, ErrClosed, l.Append([]byte("f")))
+
+	l, err = Open(dir, WithSegmentSize(20))
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, 2, l.Len())
+	require.NoError(t, l.Append([]byte("f")))
+	assert.Equal(t, []string{"d", "e", "f"}, drain(t, l))
+}
+
+func TestLogTornRecord(t *testing.T) {
+	dir := tempDir(t)
+	l, err := Open(dir)
+	require.NoError(t, err)
+	require.NoError(t, l.Append([]byte("complete")))
+	require.NoError(t, l.Append([]byte("torn")))
+	require.NoError(t, l.Close())
+
+	// a crash in the middle of the last append
+	path := l.segmentPath(1)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(path, info.Size()-2))
+
+	l, err = Open(dir)
+	require.NoError(t, err)
+	defer l.Close()
+	assert.Equal(t, 1, l.Len())
+	require.NoError(t, l.Append([]byte("next")))
+	assert.Equal(t, []string{"complete", "next"}, drain(t, l))
+
+	_, err = os.Stat(filepath.Join(dir, cursorFile))
+	assert.NoError(t, err)
+}
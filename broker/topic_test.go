@@ -0,0 +1,32 @@
+package broker
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.c", false},
+		{"a.*", "a.b.c", false},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"#", "a.b.c", true},
+		{"#.c", "a.b.c", true},
+		{"#.c", "a.b.d", false},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.b.c", true},
+		{"*.#", "a", true},
+		{"error.#", "error.user.created", true},
+	}
+
+	for _, c := range cases {
+		if got := MatchTopic(c.pattern, c.key); got != c.match {
+			t.Errorf("MatchTopic(%q, %q) expect %v but %v", c.pattern, c.key, c.match, got)
+		}
+	}
+}
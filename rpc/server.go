@@ -15,6 +15,8 @@ import (
 type Server struct {
 	*grpc.Server
 	Address string
+	// Health is the registered health service, dependencies report their status to it, e.g. rabbitmq.WithHealthReporter
+	Health *health.Server
 }
 
 func NewServerWithConfig(interceptors ...grpc.UnaryServerInterceptor) *Server {
@@ -30,9 +32,10 @@ func NewServer(cfg *Config, interceptors ...grpc.UnaryServerInterceptor) *Server
 			),
 		),
 	)
-	healthPB.RegisterHealthServer(s, health.NewServer())
+	hs := health.NewServer()
+	healthPB.RegisterHealthServer(s, hs)
 	reflection.Register(s)
-	return &Server{Server: s, Address: cfg.ListenAddress}
+	return &Server{Server: s, Address: cfg.ListenAddress, Health: hs}
 }
 
 func (s *Server) MustListenAndServe() {